@@ -1,6 +1,10 @@
 package netconf
 
 import (
+	"errors"
+	"time"
+
+	"github.com/freeconf/yang/fc"
 	"github.com/freeconf/yang/node"
 	"github.com/freeconf/yang/nodeutil"
 )
@@ -14,9 +18,120 @@ func Api(s *Server) node.Node {
 			switch r.Meta.Ident() {
 			case "ssh":
 				return api.ssh(s.sshHandler), nil
+			case "auth":
+				return api.auth(s.authGuard), nil
+			case "sessions":
+				return api.sessions(s.Sessions()), nil
+			case "subscriptions":
+				return api.subscriptions(s.configured), nil
 			}
 			return nil, nil
 		},
+		OnAction: func(r node.ActionRequest) (node.Node, error) {
+			switch r.Meta.Ident() {
+			case "generate-asymmetric-key":
+				return api.generateKey(s.keystore, r)
+			}
+			return nil, fc.NotImplementedError
+		},
+		OnNotify: func(r node.NotifyRequest) (node.NotifyCloser, error) {
+			switch r.Meta.Ident() {
+			case "auth-event":
+				unsubscribe := s.authGuard.OnEvent(func(e AuthEvent) {
+					r.SendWhen(&nodeutil.Node{Object: &e}, e.Time)
+				})
+				return func() error {
+					unsubscribe()
+					return nil
+				}, nil
+			}
+			return nil, fc.NotImplementedError
+		},
+	}
+}
+
+type sessionEntry struct {
+	Id            int64
+	User          string
+	Transport     string
+	RemoteAddress string
+	StartTime     string
+
+	DroppedNotifications int64
+}
+
+func (api api) sessions(sessions []*Session) node.Node {
+	entries := make(map[int64]*sessionEntry, len(sessions))
+	for _, ses := range sessions {
+		entries[ses.Id] = &sessionEntry{
+			Id:            ses.Id,
+			User:          ses.User(),
+			Transport:     ses.Transport(),
+			RemoteAddress: ses.RemoteAddress(),
+			StartTime:     ses.StartTime().Format(time.RFC3339),
+
+			DroppedNotifications: ses.DroppedNotifications(),
+		}
+	}
+	return &nodeutil.Node{Object: &struct {
+		Session map[int64]*sessionEntry
+	}{entries}}
+}
+
+func (api api) subscriptions(c *ConfiguredSubscriptions) node.Node {
+	var opts = c.Options()
+	return &nodeutil.Node{Object: &opts,
+		Options: nodeutil.NodeOptions{
+			EnumAsStrings: true,
+			IgnoreEmpty:   true,
+		},
+		OnField: func(n *nodeutil.Node, r node.FieldRequest, hnd *node.ValueHandle) error {
+			if r.Meta.Ident() != "state" {
+				return n.DoField(r, hnd)
+			}
+			var state string
+			switch x := n.Object.(type) {
+			case *SubscriptionConfig:
+				state = c.State(uint32(x.Id))
+			case *ReceiverConfig:
+				state = c.ReceiverState(subscriptionId(r.Path), x.Name)
+			}
+			if state == "" {
+				// not applied yet
+				return nil
+			}
+			var err error
+			hnd.Val, err = node.NewValue(r.Meta.Type(), state)
+			return err
+		},
+		OnEndEdit: func(n *nodeutil.Node, r node.NodeRequest) error {
+			// edits of subscriptions and receivers end before edit of
+			// everything does
+			if n.Object != any(&opts) {
+				return nil
+			}
+			return c.Apply(opts)
+		},
+	}
+}
+
+// subscriptionId is id of subscription path is in
+func subscriptionId(p *node.Path) uint32 {
+	for ; p != nil; p = p.Parent {
+		if p.Meta.Ident() == "subscription" && len(p.Key) > 0 {
+			id, _ := p.Key[0].Value().(int64)
+			return uint32(id)
+		}
+	}
+	return 0
+}
+
+func (api api) auth(g *AuthGuard) node.Node {
+	var opts = g.Options()
+	return &nodeutil.Node{Object: &opts,
+		OnEndEdit: func(n *nodeutil.Node, r node.NodeRequest) error {
+			return g.Apply(opts)
+		},
 	}
 }
 
@@ -32,14 +147,141 @@ func (api api) ssh(s *SshHandler) node.Node {
 			}
 			return n.DoChild(r)
 		},
+		OnAction: func(n *nodeutil.Node, r node.ActionRequest) (node.Node, error) {
+			switch r.Meta.Ident() {
+			case "rotate-host-key", "retire-host-key":
+				alg, err := r.Input.GetValue("algorithm")
+				if err != nil {
+					return nil, err
+				}
+				if alg == nil {
+					return nil, errors.New("algorithm required")
+				}
+				var k *AsymmetricKey
+				if r.Meta.Ident() == "rotate-host-key" {
+					k, err = s.RotateHostKey(alg.String())
+				} else {
+					k, err = s.RetireHostKey(alg.String())
+				}
+				if err != nil {
+					return nil, err
+				}
+				return n.New(r.Meta.Output(), k)
+			}
+			return nil, fc.NotImplementedError
+		},
 	}
 }
 
 func (api api) sshOptions(s *SshHandler) node.Node {
 	var opts = s.Options()
 	return &nodeutil.Node{Object: &opts,
+		Options: nodeutil.NodeOptions{
+			EnumAsStrings: true,
+		},
 		OnEndEdit: func(n *nodeutil.Node, r node.NodeRequest) error {
 			return s.Apply(opts)
 		},
 	}
 }
+
+// keystoreApi is ietf-keystore module
+func keystoreApi(ks *Keystore) node.Node {
+	var api api
+	return &nodeutil.Basic{
+		OnChild: func(r node.ChildRequest) (node.Node, error) {
+			switch r.Meta.Ident() {
+			case "keystore":
+				return api.keystore(ks), nil
+			}
+			return nil, nil
+		},
+	}
+}
+
+// truststoreApi is ietf-truststore module
+func truststoreApi(ts *Truststore) node.Node {
+	var api api
+	return &nodeutil.Basic{
+		OnChild: func(r node.ChildRequest) (node.Node, error) {
+			switch r.Meta.Ident() {
+			case "truststore":
+				return api.truststore(ts), nil
+			}
+			return nil, nil
+		},
+	}
+}
+
+// storeChild skips containers that only group a list in yang because go
+// structs have the list directly
+func storeChild(n *nodeutil.Node, r node.ChildRequest) (node.Node, error) {
+	switch r.Meta.Ident() {
+	case "asymmetric-keys", "certificates", "certificate-bags", "public-key-bags":
+		return n, nil
+	}
+	return n.DoChild(r)
+}
+
+func (api api) keystore(ks *Keystore) node.Node {
+	data := ks.data()
+	return &nodeutil.Node{
+		Object:  data,
+		OnChild: storeChild,
+		OnField: func(n *nodeutil.Node, r node.FieldRequest, hnd *node.ValueHandle) error {
+			switch r.Meta.Ident() {
+			case "cleartext-private-key":
+				if !r.Write {
+					// private keys are write-only
+					return nil
+				}
+			}
+			return n.DoField(r, hnd)
+		},
+		OnEndEdit: func(n *nodeutil.Node, r node.NodeRequest) error {
+			// edits of keys end before edit of keystore does
+			if n.Object != any(data) {
+				return nil
+			}
+			ks.apply(data)
+			return nil
+		},
+	}
+}
+
+func (api api) generateKey(ks *Keystore, r node.ActionRequest) (node.Node, error) {
+	name, err := r.Input.GetValue("name")
+	if err != nil {
+		return nil, err
+	}
+	if name == nil {
+		return nil, NewRpcError("protocol", "missing-element", "key name required")
+	}
+	alg, err := r.Input.GetValue("algorithm")
+	if err != nil {
+		return nil, err
+	}
+	if alg == nil {
+		return nil, NewRpcError("protocol", "missing-element", "algorithm required")
+	}
+	k, err := ks.GenerateKey(name.String(), alg.String())
+	if err != nil {
+		return nil, err
+	}
+	return &nodeutil.Node{Object: k}, nil
+}
+
+func (api api) truststore(ts *Truststore) node.Node {
+	data := ts.data()
+	return &nodeutil.Node{
+		Object:  data,
+		OnChild: storeChild,
+		OnEndEdit: func(n *nodeutil.Node, r node.NodeRequest) error {
+			if n.Object != any(data) {
+				return nil
+			}
+			ts.apply(data)
+			return nil
+		},
+	}
+}
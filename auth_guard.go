@@ -0,0 +1,246 @@
+package netconf
+
+import (
+	"container/list"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/freeconf/yang/fc"
+)
+
+// AuthGuard tracks failed logins by remote address and by username to slow
+// down and then temporarily lock out brute force attempts.  Every
+// authentication attempt is also reported to listeners for auditing.
+type AuthGuard struct {
+	opts      AuthGuardOptions
+	mu        sync.Mutex
+	failures  map[string]*authFailures
+	listeners *list.List
+	now       func() time.Time
+
+	// failures are pruned when there are this many
+	pruneAt int
+}
+
+type AuthGuardOptions struct {
+
+	// MaxFailures from the same address or for the same user before temporary
+	// lockout. Zero disables lockout
+	MaxFailures int
+
+	// LockoutTime in seconds
+	LockoutTime int
+
+	// BackoffMax in seconds.  After each consecutive failure, attempts from the
+	// same address or for the same user are rejected for 1s, 2s, 4s... up to
+	// this.  Zero disables backoff
+	BackoffMax int
+}
+
+type AuthEvent struct {
+	Time          time.Time
+	Result        string
+	User          string
+	RemoteAddress string
+	Method        string
+}
+
+// values of AuthEvent.Result
+const (
+	AuthSuccess = "success"
+	AuthFailure = "failure"
+	AuthLocked  = "locked"
+)
+
+var ErrLockedOut = errors.New("too many failed logins, try again later")
+
+// fewest failures kept before pruning
+const authPruneMin = 1024
+
+type authFailures struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+func NewAuthGuard() *AuthGuard {
+	return &AuthGuard{
+		failures:  make(map[string]*authFailures),
+		listeners: list.New(),
+		now:       time.Now,
+		pruneAt:   authPruneMin,
+		opts: AuthGuardOptions{
+			LockoutTime: 300,
+		},
+	}
+}
+
+func (g *AuthGuard) Options() AuthGuardOptions {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.opts
+}
+
+func (g *AuthGuard) Apply(opts AuthGuardOptions) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.opts = opts
+	return nil
+}
+
+// OnEvent registers for every authentication attempt. Call returned function
+// to unregister.
+func (g *AuthGuard) OnEvent(l func(AuthEvent)) func() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	e := g.listeners.PushBack(l)
+	return func() {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		g.listeners.Remove(e)
+	}
+}
+
+func authIpKey(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	return "ip:" + host
+}
+
+func authUserKey(user string) string {
+	return "user:" + user
+}
+
+// Allowed checks that neither the user nor the address is locked out. Call
+// before checking credentials so locked out attempts are rejected even with
+// valid credentials.
+func (g *AuthGuard) Allowed(user string, remoteAddr string, method string) error {
+	g.mu.Lock()
+	now := g.now()
+	locked := g.locked(authIpKey(remoteAddr), now) || g.locked(authUserKey(user), now)
+	g.mu.Unlock()
+	if locked {
+		fc.Info.Printf("rejected locked out login for '%s' from %s", user, remoteAddr)
+		g.publish(AuthEvent{Time: now, Result: AuthLocked, User: user, RemoteAddress: remoteAddr, Method: method})
+		return ErrLockedOut
+	}
+	return nil
+}
+
+func (g *AuthGuard) locked(key string, now time.Time) bool {
+	f, found := g.failures[key]
+	return found && now.Before(f.lockedUntil)
+}
+
+// Succeeded clears failure history for user and address
+func (g *AuthGuard) Succeeded(user string, remoteAddr string, method string) {
+	g.mu.Lock()
+	now := g.now()
+	delete(g.failures, authIpKey(remoteAddr))
+	delete(g.failures, authUserKey(user))
+	g.mu.Unlock()
+	fc.Info.Printf("valid %s auth for '%s' from %s", method, user, remoteAddr)
+	g.publish(AuthEvent{Time: now, Result: AuthSuccess, User: user, RemoteAddress: remoteAddr, Method: method})
+}
+
+// Failed records failure and returns backoff during which Allowed rejects the
+// address and user to slow down guessing.  Lockout after MaxFailures lasts
+// LockoutTime and is not part of backoff returned.  Callers reject right away
+// and do not wait so connections do not hold onto resources.
+func (g *AuthGuard) Failed(user string, remoteAddr string, method string) time.Duration {
+	g.mu.Lock()
+	now := g.now()
+	if len(g.failures) >= g.pruneAt {
+		g.prune(now)
+	}
+	ipKey, userKey := authIpKey(remoteAddr), authUserKey(user)
+	n := g.fail(ipKey, now)
+	if byUser := g.fail(userKey, now); byUser > n {
+		n = byUser
+	}
+	delay := g.backoff(n)
+	g.lock(ipKey, now.Add(delay))
+	g.lock(userKey, now.Add(delay))
+	g.mu.Unlock()
+	fc.Info.Printf("invalid %s auth attempt for '%s' from %s", method, user, remoteAddr)
+	g.publish(AuthEvent{Time: now, Result: AuthFailure, User: user, RemoteAddress: remoteAddr, Method: method})
+	return delay
+}
+
+func (g *AuthGuard) fail(key string, now time.Time) int {
+	f, found := g.failures[key]
+	if !found {
+		f = &authFailures{}
+		g.failures[key] = f
+	}
+	f.count++
+	f.last = now
+	n := f.count
+	if g.opts.MaxFailures > 0 && f.count >= g.opts.MaxFailures {
+		fc.Info.Printf("locking out %s for %ds", key, g.opts.LockoutTime)
+		f.lockedUntil = now.Add(g.lockoutTime())
+		f.count = 0
+	}
+	return n
+}
+
+// lock until given time unless already locked longer
+func (g *AuthGuard) lock(key string, until time.Time) {
+	if f := g.failures[key]; until.After(f.lockedUntil) {
+		f.lockedUntil = until
+	}
+}
+
+func (g *AuthGuard) lockoutTime() time.Duration {
+	return time.Duration(g.opts.LockoutTime) * time.Second
+}
+
+func (g *AuthGuard) backoff(failures int) time.Duration {
+	max := time.Duration(g.opts.BackoffMax) * time.Second
+	if max <= 0 || failures <= 0 {
+		return 0
+	}
+	delay := time.Second
+	for i := 1; i < failures && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		return max
+	}
+	return delay
+}
+
+// prune forgets failures that are no longer relevant so map doesn't grow
+// unbounded from scanners.  Next prune is not until map doubles so the
+// cost is spread over many failures.
+func (g *AuthGuard) prune(now time.Time) {
+	forget := g.lockoutTime()
+	if forget < time.Hour {
+		forget = time.Hour
+	}
+	for key, f := range g.failures {
+		if now.After(f.lockedUntil) && now.Sub(f.last) > forget {
+			delete(g.failures, key)
+		}
+	}
+	g.pruneAt = 2 * len(g.failures)
+	if g.pruneAt < authPruneMin {
+		g.pruneAt = authPruneMin
+	}
+}
+
+func (g *AuthGuard) publish(e AuthEvent) {
+	g.mu.Lock()
+	var listeners []func(AuthEvent)
+	for p := g.listeners.Front(); p != nil; p = p.Next() {
+		listeners = append(listeners, p.Value.(func(AuthEvent)))
+	}
+	g.mu.Unlock()
+	for _, l := range listeners {
+		l(e)
+	}
+}
@@ -0,0 +1,106 @@
+package netconf
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/freeconf/restconf/device"
+	"github.com/freeconf/restconf/estream"
+	"github.com/freeconf/yang/fc"
+	"github.com/freeconf/yang/node"
+	"github.com/freeconf/yang/nodeutil"
+)
+
+func TestAuthGuardLockout(t *testing.T) {
+	g := NewAuthGuard()
+	now := time.Now()
+	g.now = func() time.Time { return now }
+	g.Apply(AuthGuardOptions{MaxFailures: 3, LockoutTime: 60, BackoffMax: 4})
+	var events []string
+	g.OnEvent(func(e AuthEvent) {
+		events = append(events, e.Result)
+	})
+
+	fc.AssertEqual(t, nil, g.Allowed("joe", "1.2.3.4:1000", "password"))
+	fc.AssertEqual(t, time.Second, g.Failed("joe", "1.2.3.4:1000", "password"))
+	fc.AssertEqual(t, 2*time.Second, g.Failed("joe", "1.2.3.4:1001", "password"))
+
+	// different user, same address still counts
+	fc.AssertEqual(t, 4*time.Second, g.Failed("mary", "1.2.3.4:1002", "password"))
+	fc.AssertEqual(t, ErrLockedOut, g.Allowed("sam", "1.2.3.4:1003", "password"))
+	fc.AssertEqual(t, nil, g.Allowed("sam", "5.6.7.8:1003", "password"))
+
+	now = now.Add(61 * time.Second)
+	fc.AssertEqual(t, nil, g.Allowed("sam", "1.2.3.4:1003", "password"))
+	g.Succeeded("sam", "1.2.3.4:1003", "password")
+	fc.AssertEqual(t, []string{"failure", "failure", "failure", "locked", "success"}, events)
+}
+
+func TestAuthGuardRejectsDuringBackoff(t *testing.T) {
+	g := NewAuthGuard()
+	now := time.Now()
+	g.now = func() time.Time { return now }
+	g.Apply(AuthGuardOptions{BackoffMax: 4})
+
+	fc.AssertEqual(t, time.Second, g.Failed("joe", "1.2.3.4:1000", "password"))
+	fc.AssertEqual(t, 2*time.Second, g.Failed("joe", "1.2.3.4:1000", "password"))
+	fc.AssertEqual(t, ErrLockedOut, g.Allowed("mary", "1.2.3.4:1001", "password"))
+	fc.AssertEqual(t, ErrLockedOut, g.Allowed("joe", "5.6.7.8:1000", "password"))
+	fc.AssertEqual(t, nil, g.Allowed("mary", "5.6.7.8:1000", "password"))
+
+	now = now.Add(2 * time.Second)
+	fc.AssertEqual(t, nil, g.Allowed("joe", "1.2.3.4:1000", "password"))
+}
+
+func TestAuthGuardPrune(t *testing.T) {
+	g := NewAuthGuard()
+	now := time.Now()
+	g.now = func() time.Time { return now }
+	for i := 0; i < authPruneMin/2; i++ {
+		g.Failed(fmt.Sprintf("u%d", i), fmt.Sprintf("10.0.%d.%d:1000", i/256, i%256), "password")
+	}
+	fc.AssertEqual(t, authPruneMin, len(g.failures))
+
+	// old failures are forgotten once there are too many
+	now = now.Add(2 * time.Hour)
+	g.Failed("joe", "1.2.3.4:1000", "password")
+	fc.AssertEqual(t, 2, len(g.failures))
+	fc.AssertEqual(t, authPruneMin, g.pruneAt)
+
+	// recent failures are not forgotten, next prune waits until map doubles
+	for i := 0; i < authPruneMin/2; i++ {
+		g.Failed(fmt.Sprintf("u%d", i), fmt.Sprintf("10.0.%d.%d:1000", i/256, i%256), "password")
+	}
+	g.Failed("mary", "5.6.7.8:1000", "password")
+	fc.AssertEqual(t, authPruneMin+4, len(g.failures))
+	fc.AssertEqual(t, 2*authPruneMin, g.pruneAt)
+}
+
+func TestAuthGuardBackoff(t *testing.T) {
+	g := NewAuthGuard()
+	fc.AssertEqual(t, time.Duration(0), g.backoff(3))
+	g.Apply(AuthGuardOptions{BackoffMax: 10})
+	fc.AssertEqual(t, time.Second, g.backoff(1))
+	fc.AssertEqual(t, 8*time.Second, g.backoff(4))
+	fc.AssertEqual(t, 10*time.Second, g.backoff(5))
+	fc.AssertEqual(t, 10*time.Second, g.backoff(100))
+}
+
+func TestAuthEventNotification(t *testing.T) {
+	d := device.New(testYPath)
+	s := NewServer(d, estream.NewService())
+	b, err := d.Browser("fc-netconf")
+	fc.RequireEqual(t, nil, err)
+	sel, err := b.Root().Find("auth-event")
+	fc.RequireEqual(t, nil, err)
+	var actual string
+	closer, err := sel.Notifications(func(n node.Notification) {
+		actual, err = nodeutil.WriteJSON(n.Event)
+		fc.AssertEqual(t, nil, err)
+	})
+	fc.RequireEqual(t, nil, err)
+	s.AuthGuard().Failed("joe", "1.2.3.4:1000", "password")
+	fc.AssertEqual(t, `{"result":"failure","user":"joe","remoteAddress":"1.2.3.4:1000","method":"password"}`, actual)
+	closer()
+}
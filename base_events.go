@@ -0,0 +1,257 @@
+package netconf
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/freeconf/yang/fc"
+	"github.com/freeconf/yang/meta"
+	"github.com/freeconf/yang/node"
+	"github.com/freeconf/yang/nodeutil"
+	"github.com/freeconf/yang/val"
+)
+
+// NETCONF base notifications
+//
+//	https://datatracker.ietf.org/doc/html/rfc6470
+const (
+	EventConfigChange     = "netconf-config-change"
+	EventCapabilityChange = "netconf-capability-change"
+	EventSessionStart     = "netconf-session-start"
+	EventSessionEnd       = "netconf-session-end"
+	EventConfirmedCommit  = "netconf-confirmed-commit"
+)
+
+// values of NetconfEvent.TerminationReason
+const (
+	TerminationClosed   = "closed"
+	TerminationKilled   = "killed"
+	TerminationDropped  = "dropped"
+	TerminationTimeout  = "timeout"
+	TerminationBadHello = "bad-hello"
+	TerminationOther    = "other"
+)
+
+// NetconfEvent is any one of the base notifications.  Only fields that
+// belong to the Type of event are set.
+type NetconfEvent struct {
+	Type string
+	Time time.Time
+
+	// session that caused event
+	Username   string
+	SessionId  int64
+	SourceHost string
+
+	// config and capability changes
+	ChangedBy *ChangedBy
+
+	// session end
+	TerminationReason string
+	KilledBy          int64
+
+	// config change
+	Datastore string
+	Edit      []*ConfigEdit
+
+	// capability change
+	AddedCapability    []string
+	DeletedCapability  []string
+	ModifiedCapability []string
+
+	// confirmed commit
+	ConfirmEvent string
+	Timeout      int
+}
+
+// ChangedBy is either the server itself or a session
+type ChangedBy struct {
+	Server     bool
+	Username   string
+	SessionId  int64
+	SourceHost string
+}
+
+type ConfigEdit struct {
+	// path to top-most node of change
+	Target string
+
+	// merge, replace, create, delete or remove
+	Operation string
+}
+
+func sessionChangedBy(ses *Session) *ChangedBy {
+	return &ChangedBy{
+		Username:   ses.User(),
+		SessionId:  ses.Id,
+		SourceHost: ses.sourceHost(),
+	}
+}
+
+type netconfEvents struct {
+	mu        sync.Mutex
+	listeners *list.List
+}
+
+// OnNetconfEvent registers for all base events. Call returned function to
+// unregister.
+func (s *Server) OnNetconfEvent(l func(NetconfEvent)) func() {
+	s.events.mu.Lock()
+	defer s.events.mu.Unlock()
+	if s.events.listeners == nil {
+		s.events.listeners = list.New()
+	}
+	e := s.events.listeners.PushBack(l)
+	return func() {
+		s.events.mu.Lock()
+		defer s.events.mu.Unlock()
+		s.events.listeners.Remove(e)
+	}
+}
+
+// PublishEvent sends event to listeners and subscribers of the base
+// notifications.  Server publishes session and config change events,
+// applications publish capability change and confirmed commit events when
+// they make those changes.
+func (s *Server) PublishEvent(e NetconfEvent) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	fc.Debug.Printf("netconf event %s", e.Type)
+	s.events.mu.Lock()
+	var listeners []func(NetconfEvent)
+	if s.events.listeners != nil {
+		for p := s.events.listeners.Front(); p != nil; p = p.Next() {
+			listeners = append(listeners, p.Value.(func(NetconfEvent)))
+		}
+	}
+	s.events.mu.Unlock()
+	for _, l := range listeners {
+		l(e)
+	}
+}
+
+// RFC 6470 when expressions freeconf's xpath cannot evaluate.  It evaluates
+// a leaf's when from the leaf's parent and has neither '..' nor 'or'.
+// netconfEventNode applies the RFC conditions to the values of these leaves
+// so these only need to be expressions freeconf can evaluate that do not
+// exclude them.  Module file is kept as it is in the RFC.
+var baseEventsWhen = []struct {
+	notification string
+	leaf         string
+	when         string
+}{
+	{EventSessionEnd, "killed-by", "termination-reason = 'killed'"},
+	{EventConfirmedCommit, "timeout", "confirm-event != 'timeout'"},
+}
+
+// useBaseEventsWhen replaces when expressions in ietf-netconf-notifications
+// with ones from baseEventsWhen
+func useBaseEventsWhen(m *meta.Module) error {
+	b := &meta.Builder{}
+	for _, w := range baseEventsWhen {
+		n, found := m.Notifications()[w.notification]
+		if !found {
+			return fmt.Errorf("notification %s not found in %s", w.notification, m.Ident())
+		}
+		leaf := n.Definition(w.leaf)
+		if leaf == nil {
+			return fmt.Errorf("leaf %s not found in %s", w.leaf, w.notification)
+		}
+		b.When(leaf, w.when)
+	}
+	return b.LastErr
+}
+
+// baseEvents is the ietf-netconf-notifications module
+func baseEvents(s *Server) node.Node {
+	return &nodeutil.Basic{
+		OnNotify: func(r node.NotifyRequest) (node.NotifyCloser, error) {
+			eventType := r.Meta.Ident()
+			unsubscribe := s.OnNetconfEvent(func(e NetconfEvent) {
+				if e.Type == eventType {
+					r.SendWhen(netconfEventNode(&e), e.Time)
+				}
+			})
+			return func() error {
+				unsubscribe()
+				return nil
+			}, nil
+		},
+	}
+}
+
+func netconfEventNode(e *NetconfEvent) node.Node {
+	return &nodeutil.Node{
+		Object:  e,
+		Options: nodeutil.NodeOptions{EnumAsStrings: true},
+		OnChild: func(n *nodeutil.Node, r node.ChildRequest) (node.Node, error) {
+			switch r.Meta.Ident() {
+			case "changed-by":
+				if e.ChangedBy == nil {
+					return nil, nil
+				}
+				return changedByNode(e.ChangedBy), nil
+			}
+			return n.DoChild(r)
+		},
+		OnField: func(n *nodeutil.Node, r node.FieldRequest, hnd *node.ValueHandle) error {
+			switch r.Meta.Ident() {
+			case "session-id":
+				hnd.Val = val.UInt32(e.SessionId)
+			case "killed-by":
+				// RFC when expression
+				if e.KilledBy > 0 && e.TerminationReason == TerminationKilled {
+					hnd.Val = val.UInt32(e.KilledBy)
+				}
+			case "timeout":
+				// RFC when expression
+				if e.Timeout > 0 && (e.ConfirmEvent == "start" || e.ConfirmEvent == "extend") {
+					hnd.Val = val.UInt32(e.Timeout)
+				}
+			case "source-host", "termination-reason", "confirm-event", "datastore":
+				if err := n.DoField(r, hnd); err != nil {
+					return err
+				}
+				if hnd.Val != nil && hnd.Val.String() == "" {
+					hnd.Val = nil
+				}
+			default:
+				return n.DoField(r, hnd)
+			}
+			return nil
+		},
+	}
+}
+
+func changedByNode(c *ChangedBy) node.Node {
+	return &nodeutil.Basic{
+		OnChoose: func(sel *node.Selection, choice *meta.Choice) (*meta.ChoiceCase, error) {
+			if c.Server {
+				return choice.Cases()["server"], nil
+			}
+			return choice.Cases()["by-user"], nil
+		},
+		OnField: func(r node.FieldRequest, hnd *node.ValueHandle) error {
+			if c.Server {
+				if r.Meta.Ident() == "server" {
+					hnd.Val = val.NotEmpty
+				}
+				return nil
+			}
+			switch r.Meta.Ident() {
+			case "username":
+				hnd.Val = val.String(c.Username)
+			case "session-id":
+				hnd.Val = val.UInt32(c.SessionId)
+			case "source-host":
+				if c.SourceHost != "" {
+					hnd.Val = val.String(c.SourceHost)
+				}
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,131 @@
+package netconf
+
+import (
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/freeconf/restconf/testdata"
+	"github.com/freeconf/yang/fc"
+	"github.com/freeconf/yang/node"
+	"github.com/freeconf/yang/nodeutil"
+	"github.com/freeconf/yang/patch/xml"
+)
+
+func TestBaseEvents(t *testing.T) {
+	d, s := newTestServer(t, testdata.Manage(testdata.New()))
+	var mu sync.Mutex
+	var events []NetconfEvent
+	s.OnNetconfEvent(func(e NetconfEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, e)
+	})
+
+	c := newTestConn(t, s, d)
+	c.ses.remoteAddr = "10.0.0.1:2000"
+	c.start()
+
+	reply := c.call(1, `<create-subscription xmlns="urn:ietf:params:xml:ns:netconf:notification:1.0"/>`)
+	fc.AssertEqual(t, true, strings.Contains(reply, "<ok"), reply)
+
+	// reply and notification are interleaved in either order
+	reply = c.call(2, `<edit-config><target><running/></target><config><car xmlns="c"><speed>10</speed></car></config></edit-config>`)
+	notification := c.recv()
+	if strings.Contains(reply, "<notification") {
+		reply, notification = notification, reply
+	}
+	fc.AssertEqual(t, true, strings.Contains(reply, "<ok"), reply)
+	fc.AssertEqual(t, true, strings.Contains(notification, "netconf-config-change"), notification)
+	fc.AssertEqual(t, true, strings.Contains(notification, "<target>/car:speed</target>"), notification)
+	fc.AssertEqual(t, true, strings.Contains(notification, "<username>joe</username>"), notification)
+
+	c.kill()
+	mu.Lock()
+	defer mu.Unlock()
+	fc.RequireEqual(t, 3, len(events))
+	fc.AssertEqual(t, EventSessionStart, events[0].Type)
+	fc.AssertEqual(t, "10.0.0.1", events[0].SourceHost)
+	fc.AssertEqual(t, EventConfigChange, events[1].Type)
+	fc.AssertEqual(t, "merge", events[1].Edit[0].Operation)
+	fc.AssertEqual(t, EventSessionEnd, events[2].Type)
+	fc.AssertEqual(t, TerminationKilled, events[2].TerminationReason)
+	fc.AssertEqual(t, int64(7), events[2].KilledBy)
+}
+
+func TestBaseEventsConfigChange(t *testing.T) {
+	d, s := newTestServer(t, testdata.Manage(testdata.New()))
+	var events []NetconfEvent
+	s.OnNetconfEvent(func(e NetconfEvent) {
+		events = append(events, e)
+	})
+	rt := newRpcTester(t, s, d)
+	edit := func(config string) string {
+		return rt.send(`<edit-config><target><running/></target>` + config + `</edit-config>`)
+	}
+
+	// nothing changed
+	reply := edit(`<default-operation>none</default-operation><config><car xmlns="c"><speed>10</speed></car></config>`)
+	fc.AssertEqual(t, true, strings.Contains(reply, "<ok"), reply)
+	fc.AssertEqual(t, 0, len(events))
+
+	// edits before the one that failed still happened
+	reply = edit(`<config><car xmlns="c"><speed>20</speed></car><bogus xmlns="b"/></config>`)
+	fc.AssertEqual(t, true, strings.Contains(reply, "unknown-element"), reply)
+	fc.RequireEqual(t, 1, len(events))
+	fc.RequireEqual(t, 1, len(events[0].Edit))
+	fc.AssertEqual(t, "/car:speed", events[0].Edit[0].Target)
+}
+
+func TestBaseEventsSessionEndWithoutStart(t *testing.T) {
+	d, s := newTestServer(t, nil)
+	var events []NetconfEvent
+	s.OnNetconfEvent(func(e NetconfEvent) {
+		events = append(events, e)
+	})
+	ses := NewSession(s, "joe", d, strings.NewReader(`<rpc/>]]>]]>`), io.Discard)
+	fc.AssertEqual(t, true, ses.readMessages(ses.Context()) != nil)
+	ses.close()
+	fc.RequireEqual(t, 1, len(events))
+	fc.AssertEqual(t, EventSessionEnd, events[0].Type)
+	fc.AssertEqual(t, TerminationBadHello, events[0].TerminationReason)
+
+	// no hello at all is not a session
+	events = nil
+	ses = NewSession(s, "joe", d, strings.NewReader(``), io.Discard)
+	fc.AssertEqual(t, true, ses.readMessages(ses.Context()) != nil)
+	ses.close()
+	fc.AssertEqual(t, 0, len(events))
+}
+
+func TestBaseEventsEncoded(t *testing.T) {
+	d, s := newTestServer(t, nil)
+	b, err := d.Browser("ietf-netconf-notifications")
+	fc.RequireEqual(t, nil, err)
+	encode := func(e NetconfEvent) string {
+		t.Helper()
+		sel, err := b.Root().Find(e.Type)
+		fc.RequireEqual(t, nil, err)
+		var actual []byte
+		closer, err := sel.Notifications(func(n node.Notification) {
+			wtr := &nodeutil.XMLWtr2{XMLName: xml.Name{Local: e.Type}}
+			fc.RequireEqual(t, nil, n.Event.UpsertInto(wtr))
+			actual, err = xml.Marshal(wtr)
+			fc.RequireEqual(t, nil, err)
+		})
+		fc.RequireEqual(t, nil, err)
+		defer closer()
+		s.PublishEvent(e)
+		return string(actual)
+	}
+
+	actual := encode(NetconfEvent{Type: EventSessionEnd, Username: "joe", SessionId: 100, TerminationReason: TerminationKilled, KilledBy: 7})
+	fc.AssertEqual(t, true, strings.Contains(actual, ">7</killed-by>"), actual)
+	actual = encode(NetconfEvent{Type: EventSessionEnd, Username: "joe", SessionId: 100, TerminationReason: TerminationClosed, KilledBy: 7})
+	fc.AssertEqual(t, false, strings.Contains(actual, "killed-by"), actual)
+	actual = encode(NetconfEvent{Type: EventConfirmedCommit, Username: "joe", SessionId: 100, ConfirmEvent: "start", Timeout: 600})
+	fc.AssertEqual(t, true, strings.Contains(actual, ">600</timeout>"), actual)
+	actual = encode(NetconfEvent{Type: EventConfirmedCommit, Username: "joe", SessionId: 100, ConfirmEvent: "complete", Timeout: 600})
+	fc.AssertEqual(t, false, strings.Contains(actual, "timeout"), actual)
+}
@@ -2,6 +2,7 @@ package netconf
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
 	"strconv"
@@ -21,34 +22,46 @@ import (
 //	  ##
 //
 //	This has 2 chunks of sizes 4 and 12 bytes.
+//
+// A reader is sent only once the first chunk of a message arrives so callers
+// waiting on the channel are waiting for the next message.  Channel is closed
+// when input ends.  Reader of a message cut short gets io.ErrUnexpectedEOF.
 func NewChunkedRdr(in io.Reader) <-chan io.Reader {
 	buf := make([]byte, 4096)
 	rdrs := make(chan io.Reader)
 	chunked := bufio.NewReader(in)
 	go func() {
-		rdr, wtr := io.Pipe()
-		rdrs <- rdr
+		var wtr *io.PipeWriter
+		defer close(rdrs)
 		for {
 			// RFC max size is 4.3 billion (uint32)
 			chunkSize, err := readChunkSize(chunked)
-			if err == io.EOF {
-				wtr.Close()
-				close(rdrs)
+			if err != nil {
+				if wtr != nil {
+					wtr.CloseWithError(unexpectedEOF(err))
+				}
 				return
 			}
 			if chunkSize == 0 {
-				// don't close reader
-				wtr.Close()
+				// end of message
+				if wtr != nil {
+					wtr.Close()
+					wtr = nil
+				}
+				continue
+			}
+			if wtr == nil {
+				var rdr *io.PipeReader
 				rdr, wtr = io.Pipe()
 				rdrs <- rdr
-				continue
 			}
 			remainingSize := chunkSize
 			for remainingSize > 0 {
-				grabSize := minInt64(chunkSize, int64(len(buf)))
+				grabSize := minInt64(remainingSize, int64(len(buf)))
 				readSize, err := chunked.Read(buf[:grabSize])
 				if err != nil {
-					panic(err)
+					wtr.CloseWithError(unexpectedEOF(err))
+					return
 				}
 				wtr.Write(buf[:readSize])
 				remainingSize -= int64(readSize)
@@ -58,6 +71,38 @@ func NewChunkedRdr(in io.Reader) <-chan io.Reader {
 	return rdrs
 }
 
+// unexpectedEOF is err unless input ended in the middle of a message
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// hello is small, anything larger is not a valid client
+const maxEomMessageSize = 1 << 20
+
+// readEomMessage reads a single message framed with the end-of-message
+// delimiter. Only the hello exchange uses this framing in base:1.1.
+//
+//	see https://datatracker.ietf.org/doc/html/rfc6242#section-4.3
+func readEomMessage(r *bufio.Reader) ([]byte, error) {
+	var msg []byte
+	for {
+		b, err := r.ReadBytes('>')
+		msg = append(msg, b...)
+		if err != nil {
+			return nil, err
+		}
+		if bytes.HasSuffix(msg, []byte(msgDelim)) {
+			return msg[:len(msg)-len(msgDelim)], nil
+		}
+		if len(msg) > maxEomMessageSize {
+			return nil, fmt.Errorf("message exceeds %d bytes w/o delimiter", maxEomMessageSize)
+		}
+	}
+}
+
 func readChunkSize(r io.ByteReader) (int64, error) {
 	d := make([]byte, 0, 8)
 	lf := 0
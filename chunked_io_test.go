@@ -28,14 +28,30 @@ func TestChunkedRdr(t *testing.T) {
 	msg2, err := io.ReadAll(<-rdrs)
 	fc.AssertEqual(t, nil, err)
 	fc.AssertEqual(t, `1`, string(msg2))
-	msg3, err := io.ReadAll(<-rdrs)
+	fc.AssertEqual(t, nil, <-rdrs)
+}
+
+func TestChunkedRdrEnd(t *testing.T) {
+	// used to hand out an empty reader after last message, now channel just
+	// closes
+	rdrs := NewChunkedRdr(strings.NewReader("\n#1\n1\n##\n"))
+	msg, err := io.ReadAll(<-rdrs)
 	fc.AssertEqual(t, nil, err)
+	fc.AssertEqual(t, `1`, string(msg))
+	_, more := <-rdrs
+	fc.AssertEqual(t, false, more)
 
-	// unfortunately artifact of underlying implementation is that
-	// there will always be an empty reader just before closing.
-	fc.AssertEqual(t, ``, string(msg3))
+	// message cut short
+	rdrs = NewChunkedRdr(strings.NewReader("\n#4\n12"))
+	_, err = io.ReadAll(<-rdrs)
+	fc.AssertEqual(t, io.ErrUnexpectedEOF, err)
+	_, more = <-rdrs
+	fc.AssertEqual(t, false, more)
 
-	fc.AssertEqual(t, nil, <-rdrs)
+	// missing end of message
+	rdrs = NewChunkedRdr(strings.NewReader("\n#2\n12"))
+	_, err = io.ReadAll(<-rdrs)
+	fc.AssertEqual(t, io.ErrUnexpectedEOF, err)
 }
 
 func TestChunkedWtr(t *testing.T) {
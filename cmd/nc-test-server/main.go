@@ -1,6 +1,11 @@
 package main
 
 import (
+	"context"
+	"os"
+	"os/signal"
+	"time"
+
 	"github.com/freeconf/netconf"
 	"github.com/freeconf/restconf"
 	"github.com/freeconf/restconf/device"
@@ -30,10 +35,12 @@ func main() {
 	)
 	d := device.New(ypath)
 	d.Add("car", api)
-	streams := estream.NewService()
+	s, err := netconf.New(d, estream.NewService())
+	chkerr(err)
 
-	// in NETCONF, you pre-register streams you want to support.
-	streams.AddStream(estream.Stream{
+	// in NETCONF, you pre-register streams you want to support beyond the
+	// default NETCONF stream that has every notification.
+	err = s.AddStream(estream.Stream{
 		Name: "car:update",
 		Open: func() (*node.Selection, error) {
 			b, err := d.Browser("car")
@@ -42,10 +49,17 @@ func main() {
 			}
 			return b.Root().Find("update")
 		},
-	})
-	netconf.NewServer(d, streams)
+	}, "Car state changes")
+	chkerr(err)
+	chkerr(s.EnableReplay(netconf.NetconfStream, netconf.ReplayOptions{MaxAge: time.Hour}))
 	chkerr(d.ApplyStartupConfigFile("startup.json"))
-	select {}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	<-sig
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	chkerr(s.Shutdown(ctx))
 }
 
 func chkerr(err error) {
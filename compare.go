@@ -0,0 +1,145 @@
+package netconf
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/freeconf/yang/meta"
+	"github.com/freeconf/yang/node"
+	"github.com/freeconf/yang/nodeutil"
+	"github.com/freeconf/yang/patch/xml"
+)
+
+// Differences between two datastores as a yang-patch. Only running, intended
+// and operational datastores can be compared as there is no startup or
+// candidate datastore.
+//
+//	https://datatracker.ietf.org/doc/html/rfc9144
+const CompareNs = "urn:ietf:params:xml:ns:yang:ietf-nmda-compare"
+
+// compareParams are the input of compare
+type compareParams struct {
+	source       string
+	target       string
+	filter       *RpcFilter
+	all          bool
+	reportOrigin bool
+}
+
+func readCompareParams(op *nodeutil.XmlNode) (*compareParams, error) {
+	p := &compareParams{}
+	for _, n := range op.Nodes {
+		content := strings.TrimSpace(string(n.Content))
+		switch n.XMLName.Local {
+		case "source":
+			p.source = identityName(content)
+		case "target":
+			p.target = identityName(content)
+		case "xpath-filter":
+			p.filter = xpathFilterParam(op, n)
+		case "subtree-filter":
+			f, _, err := subtreeFilterParam(n)
+			if err != nil {
+				return nil, err
+			}
+			p.filter = f
+		case "all":
+			p.all = true
+		case "report-origin":
+			p.reportOrigin = true
+		}
+	}
+	if p.source == "" || p.target == "" {
+		return nil, NewRpcError("protocol", "missing-element", "source and target required")
+	}
+	return p, nil
+}
+
+// handleCompare reports how source datastore would have to change to be the
+// same as target. Running and intended are the same data so comparing
+// against operational is the only comparison that can find differences.
+func (ses *Session) handleCompare(ctx context.Context, req *RpcRequest, reply *RpcReply) error {
+	p, err := readCompareParams(req.Op)
+	if err != nil {
+		return err
+	}
+	sourceContent, err := datastoreData(p.source)
+	if err != nil {
+		return err
+	}
+	targetContent, err := datastoreData(p.target)
+	if err != nil {
+		return err
+	}
+	if p.reportOrigin && p.source != "operational" && p.target != "operational" {
+		return NewRpcError("protocol", "invalid-value", "report-origin requires operational datastore")
+	}
+	if !p.all && sourceContent != targetContent {
+		// only data that can be in both datastores
+		sourceContent, targetContent = node.ContentConfig, node.ContentConfig
+	}
+	source, err := ses.readSnapshot(ctx, p.filter, sourceContent, p.reportOrigin && p.source == "operational")
+	if err != nil {
+		return err
+	}
+	target, err := ses.readSnapshot(ctx, p.filter, targetContent, p.reportOrigin && p.target == "operational")
+	if err != nil {
+		return err
+	}
+	edits := diff(source.snap, target.snap)
+	if len(edits) == 0 {
+		reply.Out = []*nodeutil.XMLWtr2{{XMLName: xml.Name{Space: CompareNs, Local: "no-matches"}}}
+		return nil
+	}
+	for i := range edits {
+		e := &edits[i]
+		if e.value != nil {
+			e.value = target.value(e.target)
+		}
+		if e.operation != "create" {
+			e.source = source.value(e.target)
+		}
+	}
+	patch, err := yangPatch(fmt.Sprintf("%s-%s", p.source, p.target), edits)
+	if err != nil {
+		return err
+	}
+	reply.Out = []*nodeutil.XMLWtr2{{XMLName: xml.Name{Space: CompareNs, Local: "differences"}, Content: patch}}
+	return nil
+}
+
+// datastoreSnapshot is data in a datastore to compare
+type datastoreSnapshot struct {
+	snap snapshot
+	an   originAnnotator
+}
+
+func (ses *Session) readSnapshot(ctx context.Context, f *RpcFilter, c node.ContentConstraint, withOrigin bool) (*datastoreSnapshot, error) {
+	sels, err := readFilter(ctx, ses.dev, f, c)
+	if err != nil {
+		return nil, err
+	}
+	data, origins, err := encodeSelectionsOrigins(sels)
+	if err != nil {
+		return nil, err
+	}
+	return &datastoreSnapshot{
+		snap: newSnapshot(sels, data),
+		an:   originAnnotator{origins: origins, withOrigin: withOrigin},
+	}, nil
+}
+
+// value is data at path as it would be in a yang-patch edit
+func (ds *datastoreSnapshot) value(path string) *annotatedElem {
+	n := ds.snap[path]
+	a := ds.an.annotate(n.elem, n.within, "")
+	if a.XMLName.Space == "" {
+		// namespace was from parent
+		a.XMLName.Space = meta.OriginalModule(meta.Find(n.within, a.XMLName.Local)).Namespace()
+	}
+	if ds.an.withOrigin {
+		a.Attr = append(a.Attr, originNsDecl)
+	}
+	return a
+}
@@ -0,0 +1,27 @@
+package netconf
+
+import (
+	"testing"
+
+	"github.com/freeconf/yang/nodeutil"
+)
+
+func TestCompare(t *testing.T) {
+	car := &originCar{Speed: 10, Miles: 99}
+	d, s := newTestServer(t, &nodeutil.Node{Object: car})
+	rt := newRpcTester(t, s, d)
+	compare := func(params string) {
+		t.Helper()
+		rt.send(`<compare xmlns="urn:ietf:params:xml:ns:yang:ietf-nmda-compare" xmlns:ds="urn:ietf:params:xml:ns:yang:ietf-datastores">` +
+			params + `<subtree-filter><car xmlns="c"><speed/><miles/></car></subtree-filter></compare>`)
+	}
+
+	compare(`<source>ds:running</source><target>ds:operational</target>`)
+	compare(`<source>ds:intended</source><target>ds:operational</target><all/><report-origin/>`)
+	compare(`<source>ds:operational</source><target>ds:running</target><all/>`)
+	compare(`<source>ds:running</source><target>ds:intended</target><report-origin/>`)
+	compare(`<source>ds:candidate</source><target>ds:running</target>`)
+	// startup is not supported
+	compare(`<source>ds:running</source><target>ds:startup</target>`)
+	rt.gold("testdata/gold/compare.xml")
+}
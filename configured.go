@@ -0,0 +1,699 @@
+package netconf
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/freeconf/restconf/device"
+	"github.com/freeconf/yang/fc"
+	"github.com/freeconf/yang/patch/xml"
+)
+
+// States of a configured subscription
+const (
+	SubscriptionValid     = "valid"
+	SubscriptionInvalid   = "invalid"
+	SubscriptionConcluded = "concluded"
+)
+
+// States of a receiver of a configured subscription
+const (
+	ReceiverActive       = "active"
+	ReceiverConnecting   = "connecting"
+	ReceiverDisconnected = "disconnected"
+	ReceiverSuspended    = "suspended"
+)
+
+// wait between attempts to call home, doubles on each failure
+const (
+	callHomeRetryMin = time.Second
+	callHomeRetryMax = time.Minute
+)
+
+// ConfiguredOptions are subscriptions kept in configuration
+type ConfiguredOptions struct {
+	Subscription map[int64]*SubscriptionConfig
+}
+
+// SubscriptionConfig is a configured subscription to either a stream or a
+// datastore
+type SubscriptionConfig struct {
+	Id        int64
+	Stream    string
+	Datastore string
+
+	// XpathFilter prefixes are module names
+	XpathFilter string
+
+	// Period in centiseconds between datastore updates. Zero sends changes
+	// as they happen
+	Period int
+
+	// StopTime in RFC3339 format
+	StopTime string
+
+	Receiver map[string]*ReceiverConfig
+}
+
+type ReceiverConfig struct {
+	Name string
+
+	// Address is host:port of NETCONF client to call home to.  Empty for
+	// receivers added with AddLocalReceiver
+	Address string
+}
+
+// ConfiguredSubscriptions are RFC 8639 configured subscriptions.  Unlike
+// dynamic subscriptions they are not tied to a session, server starts them
+// and sends notifications to each receiver by calling home to a NETCONF
+// client or to a receiver the application registered.
+//
+//	https://datatracker.ietf.org/doc/html/rfc8639#section-2.5
+type ConfiguredSubscriptions struct {
+	mgr     SessionManager
+	dev     device.Device
+	ssh     *SshHandler
+	mu      sync.Mutex
+	opts    ConfiguredOptions
+	local   map[string]func(*Notification) error
+	running map[uint32]*configuredSub
+	stopped bool
+}
+
+func NewConfiguredSubscriptions(mgr SessionManager, dev device.Device, ssh *SshHandler) *ConfiguredSubscriptions {
+	return &ConfiguredSubscriptions{
+		mgr:     mgr,
+		dev:     dev,
+		ssh:     ssh,
+		local:   make(map[string]func(*Notification) error),
+		running: make(map[uint32]*configuredSub),
+	}
+}
+
+func (c *ConfiguredSubscriptions) Options() ConfiguredOptions {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.opts.clone()
+}
+
+// Apply starts new subscriptions, restarts changed ones and terminates ones
+// no longer configured.  Subscriptions that cannot be started are kept as
+// invalid.
+func (c *ConfiguredSubscriptions) Apply(opts ConfiguredOptions) error {
+	// ids and receiver names are filled in on a copy, not caller's options
+	opts = opts.clone()
+	for id, cfg := range opts.Subscription {
+		cfg.Id = id
+		if err := cfg.check(); err != nil {
+			return err
+		}
+	}
+	c.mu.Lock()
+	if c.stopped {
+		c.mu.Unlock()
+		return ErrServerClosed
+	}
+	// receivers are sent notifications after unlocking so a slow receiver
+	// does not hold up everyone else
+	var sends []func()
+	for id, cs := range c.running {
+		cfg, found := opts.Subscription[int64(id)]
+		if !found {
+			sends = append(sends, cs.terminate())
+			delete(c.running, id)
+			continue
+		}
+		if !cs.config.sameSettings(cfg) {
+			sends = append(sends, c.restart(cs, cfg))
+		}
+		sends = append(sends, c.applyReceivers(cs, cfg)...)
+	}
+	for _, cfg := range opts.Subscription {
+		if _, found := c.running[uint32(cfg.Id)]; !found {
+			cs := &configuredSub{receivers: make(map[string]*configuredReceiver)}
+			c.running[uint32(cfg.Id)] = cs
+			sends = append(sends, c.restart(cs, cfg))
+			sends = append(sends, c.applyReceivers(cs, cfg)...)
+		}
+	}
+	c.opts = opts
+	c.mu.Unlock()
+	runSends(sends)
+	return nil
+}
+
+// runSends calls each function that is not nil
+func runSends(sends []func()) {
+	for _, send := range sends {
+		if send != nil {
+			send()
+		}
+	}
+}
+
+// AddLocalReceiver sends notifications of configured subscriptions to
+// function for receivers of given name that have no address.  Replaces any
+// existing receiver of same name.
+func (c *ConfiguredSubscriptions) AddLocalReceiver(name string, r func(*Notification) error) {
+	c.mu.Lock()
+	c.local[name] = r
+	var sends []func()
+	for _, cs := range c.running {
+		cs.mu.Lock()
+		rcv, found := cs.receivers[name]
+		cs.mu.Unlock()
+		if found && rcv.address == "" {
+			sends = append(sends, cs.activation(rcv, localReceiver(r)))
+		}
+	}
+	c.mu.Unlock()
+	runSends(sends)
+}
+
+func (c *ConfiguredSubscriptions) RemoveLocalReceiver(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.local, name)
+	for _, cs := range c.running {
+		if rcv, found := cs.receivers[name]; found && rcv.address == "" {
+			rcv.setState(ReceiverDisconnected, nil)
+		}
+	}
+}
+
+// State of subscription or empty if not configured
+func (c *ConfiguredSubscriptions) State(id uint32) string {
+	c.mu.Lock()
+	cs := c.running[id]
+	c.mu.Unlock()
+	if cs == nil {
+		return ""
+	}
+	return cs.state()
+}
+
+// ReceiverState of receiver of subscription or empty if not configured
+func (c *ConfiguredSubscriptions) ReceiverState(id uint32, name string) string {
+	c.mu.Lock()
+	cs := c.running[id]
+	c.mu.Unlock()
+	if cs == nil {
+		return ""
+	}
+	cs.mu.Lock()
+	rcv, sub := cs.receivers[name], cs.sub
+	cs.mu.Unlock()
+	if rcv == nil {
+		return ""
+	}
+	state := rcv.getState()
+	if state == ReceiverActive && sub != nil {
+		sub.mu.Lock()
+		defer sub.mu.Unlock()
+		if sub.suspended {
+			return ReceiverSuspended
+		}
+	}
+	return state
+}
+
+// stop ends all subscriptions for good
+func (c *ConfiguredSubscriptions) stop() {
+	c.mu.Lock()
+	c.stopped = true
+	var sends []func()
+	for id, cs := range c.running {
+		sends = append(sends, cs.terminate())
+		delete(c.running, id)
+	}
+	c.mu.Unlock()
+	runSends(sends)
+}
+
+// restart ends subscription if running and starts it again with given
+// settings.  Returned function sends active receivers subscription-modified
+// if subscription was running.
+func (c *ConfiguredSubscriptions) restart(cs *configuredSub, cfg *SubscriptionConfig) func() {
+	cs.mu.Lock()
+	old := cs.sub
+	cs.sub = nil
+	cs.config = cfg.clone()
+	cs.mu.Unlock()
+	if old != nil {
+		old.end()
+	}
+	sub, err := c.newSubscription(cs, cfg)
+	if err != nil {
+		c.mgr.HandleErr(fmt.Errorf("configured subscription %d is invalid. %w", cfg.Id, err))
+		for _, rcv := range cs.list() {
+			rcv.stop()
+			rcv.setState(ReceiverDisconnected, nil)
+		}
+		return nil
+	}
+	cs.mu.Lock()
+	cs.sub = sub
+	cs.mu.Unlock()
+	if old == nil {
+		return nil
+	}
+	return func() {
+		sub.announce("subscription-modified")
+	}
+}
+
+func (c *ConfiguredSubscriptions) newSubscription(cs *configuredSub, cfg *SubscriptionConfig) (*Subscription, error) {
+	sub := &Subscription{
+		Id:        uint32(cfg.Id),
+		Stream:    cfg.Stream,
+		Datastore: cfg.Datastore,
+		ctx:       context.Background(),
+		dev:       c.dev,
+		mgr:       c.mgr,
+		to:        cs,
+		// receivers are sent subscription-started as they become active
+		ready: true,
+	}
+	var filter *RpcFilter
+	if cfg.XpathFilter != "" {
+		filter = &RpcFilter{Type: "xpath", Select: cfg.XpathFilter, shortcodes: moduleShortcodes(c.dev)}
+		name := xml.Name{Space: SubscribedNotificationsNs, Local: "stream-xpath-filter"}
+		if cfg.Datastore != "" {
+			name = xml.Name{Space: YangPushNs, Local: "datastore-xpath-filter"}
+		}
+		sub.filterXml = xpathFilterElem(name, filter)
+	}
+	if cfg.Datastore != "" {
+		p := &subscriptionParams{datastore: cfg.Datastore, filter: filter}
+		if cfg.Period > 0 {
+			p.periodic = true
+			p.period = time.Duration(cfg.Period) * 10 * time.Millisecond
+		} else {
+			p.onChange = true
+		}
+		if err := checkPush(c.dev, p, false); err != nil {
+			return nil, err
+		}
+		sub.selection = filter
+		sub.period = p.period
+		sub.onChange = p.onChange
+		sub.syncOnStart = p.onChange
+	} else {
+		var err error
+		if sub.filter, err = compileEventFilter(c.dev, filter); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.StopTime != "" {
+		// checked when applied
+		sub.stopTime, _ = time.Parse(time.RFC3339, cfg.StopTime)
+	}
+	subs := c.mgr.Subscriptions()
+	if err := subs.addConfigured(sub); err != nil {
+		return nil, err
+	}
+	if err := sub.start(); err != nil {
+		subs.remove(sub.Id)
+		return nil, err
+	}
+	return sub, nil
+}
+
+// applyReceivers starts new receivers and stops removed ones.  Returned
+// functions activate receivers the application registered.
+func (c *ConfiguredSubscriptions) applyReceivers(cs *configuredSub, cfg *SubscriptionConfig) []func() {
+	valid := cs.state() == SubscriptionValid
+	cs.mu.Lock()
+	var added []*configuredReceiver
+	for name, rcv := range cs.receivers {
+		if rcfg, found := cfg.Receiver[name]; !found || rcfg.Address != rcv.address {
+			rcv.stop()
+			delete(cs.receivers, name)
+		}
+	}
+	for name, rcfg := range cfg.Receiver {
+		rcv, found := cs.receivers[name]
+		if !found {
+			rcv = &configuredReceiver{name: name, address: rcfg.Address, state: ReceiverDisconnected}
+			cs.receivers[name] = rcv
+			added = append(added, rcv)
+		} else if valid && rcv.getState() == ReceiverDisconnected {
+			// subscription was invalid before
+			added = append(added, rcv)
+		}
+	}
+	cs.mu.Unlock()
+	if !valid {
+		return nil
+	}
+	var sends []func()
+	for _, rcv := range added {
+		if rcv.address != "" {
+			ctx, cancel := context.WithCancel(context.Background())
+			rcv.mu.Lock()
+			rcv.cancel = cancel
+			rcv.state = ReceiverConnecting
+			rcv.mu.Unlock()
+			go c.callHome(ctx, cs, rcv)
+		} else if r, found := c.local[rcv.name]; found {
+			sends = append(sends, cs.activation(rcv, localReceiver(r)))
+		}
+	}
+	return sends
+}
+
+// callHome keeps a NETCONF session to receiver until ctx is done,
+// reconnecting when connection is lost.
+func (c *ConfiguredSubscriptions) callHome(ctx context.Context, cs *configuredSub, rcv *configuredReceiver) {
+	retry := callHomeRetryMin
+	for {
+		rcv.setState(ReceiverConnecting, nil)
+		started := make(chan struct{}, 1)
+		err := c.ssh.CallHome(ctx, rcv.address, func(ses *Session) {
+			select {
+			case started <- struct{}{}:
+			default:
+			}
+			forget := ses.addSub(func() {
+				rcv.deactivate(ses)
+			})
+			rcv.setForget(forget)
+			cs.activate(rcv, ses)
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			fc.Debug.Printf("could not call home to %s. %s", rcv.address, err)
+		}
+		select {
+		case <-started:
+			retry = callHomeRetryMin
+		default:
+		}
+		if cs.state() == SubscriptionConcluded {
+			rcv.setState(ReceiverDisconnected, nil)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retry):
+		}
+		if retry *= 2; retry > callHomeRetryMax {
+			retry = callHomeRetryMax
+		}
+	}
+}
+
+// configuredSub is a configured subscription and it's receivers.  It is the
+// receiver of the subscription and sends each notification to every active
+// receiver.
+type configuredSub struct {
+	mu        sync.Mutex
+	config    *SubscriptionConfig
+	sub       *Subscription
+	receivers map[string]*configuredReceiver
+}
+
+func (cs *configuredSub) state() string {
+	cs.mu.Lock()
+	sub := cs.sub
+	cs.mu.Unlock()
+	if sub == nil {
+		return SubscriptionInvalid
+	}
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if sub.ended {
+		// only stop time ends subscription w/o replacing it
+		return SubscriptionConcluded
+	}
+	return SubscriptionValid
+}
+
+func (cs *configuredSub) list() []*configuredReceiver {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	rcvs := make([]*configuredReceiver, 0, len(cs.receivers))
+	for _, rcv := range cs.receivers {
+		rcvs = append(rcvs, rcv)
+	}
+	sort.Slice(rcvs, func(i, j int) bool {
+		return rcvs[i].name < rcvs[j].name
+	})
+	return rcvs
+}
+
+func (cs *configuredSub) notify(n *Notification) error {
+	return cs.send(n, false)
+}
+
+func (cs *configuredSub) notifyWait(n *Notification) error {
+	return cs.send(n, true)
+}
+
+// send to every active receiver.  Dropped if any receiver dropped it so
+// subscription is suspended until slowest receiver catches up.
+func (cs *configuredSub) send(n *Notification, wait bool) error {
+	var dropped error
+	for _, rcv := range cs.list() {
+		to := rcv.active()
+		if to == nil {
+			continue
+		}
+		var err error
+		if wait {
+			err = to.notifyWait(n)
+		} else {
+			err = to.notify(n)
+		}
+		if err == errNotificationDropped {
+			dropped = err
+		} else if err != nil {
+			fc.Debug.Printf("could not send to receiver %s. %s", rcv.name, err)
+		}
+	}
+	return dropped
+}
+
+// activation is activate bound to receiver so it can be called once locks
+// are released
+func (cs *configuredSub) activation(rcv *configuredReceiver, to receiver) func() {
+	return func() {
+		cs.activate(rcv, to)
+	}
+}
+
+// activate sends subscription-started to receiver that just connected and
+// then includes it in notifications
+func (cs *configuredSub) activate(rcv *configuredReceiver, to receiver) {
+	cs.mu.Lock()
+	sub := cs.sub
+	cs.mu.Unlock()
+	if sub == nil {
+		return
+	}
+	if err := to.notifyWait(sub.stateChange("subscription-started", sub.settings()...)); err != nil {
+		fc.Debug.Printf("could not start subscription %d on receiver %s. %s", sub.Id, rcv.name, err)
+		return
+	}
+	// on-change subscriptions start each receiver with everything
+	if sub.onChange && sub.syncOnStart {
+		content, err := datastoreContent(sub.Datastore)
+		if err == nil {
+			var update *Notification
+			if update, err = sub.update(content); err == nil {
+				err = to.notifyWait(update)
+			}
+		}
+		if err != nil {
+			fc.Debug.Printf("could not sync subscription %d on receiver %s. %s", sub.Id, rcv.name, err)
+		}
+	}
+	rcv.setState(ReceiverActive, to)
+}
+
+// terminate ends subscription.  Returned function tells active receivers
+// subscription no longer exists and stops sending to them.
+func (cs *configuredSub) terminate() func() {
+	cs.mu.Lock()
+	sub := cs.sub
+	cs.mu.Unlock()
+	ended := sub != nil && sub.end()
+	return func() {
+		if ended {
+			if err := cs.notifyWait(sub.stateChange("subscription-terminated", reasonElem("no-such-subscription"))); err != nil {
+				fc.Debug.Printf("could not send subscription-terminated for subscription %d. %s", sub.Id, err)
+			}
+		}
+		for _, rcv := range cs.list() {
+			rcv.stop()
+		}
+	}
+}
+
+type configuredReceiver struct {
+	name    string
+	address string
+	mu      sync.Mutex
+	state   string
+	to      receiver
+	cancel  func()
+
+	// forget tells call home session receiver no longer keeps it alive
+	forget func()
+}
+
+func (rcv *configuredReceiver) getState() string {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	return rcv.state
+}
+
+func (rcv *configuredReceiver) setState(state string, to receiver) {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	rcv.state = state
+	rcv.to = to
+}
+
+// active is where to send notifications or nil if receiver is not active
+func (rcv *configuredReceiver) active() receiver {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	if rcv.state != ReceiverActive {
+		return nil
+	}
+	return rcv.to
+}
+
+// deactivate when call home session ends unless receiver has since moved on
+// to another session
+func (rcv *configuredReceiver) deactivate(ses *Session) {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	if rcv.to == receiver(ses) {
+		rcv.state = ReceiverConnecting
+		rcv.to = nil
+	}
+}
+
+func (rcv *configuredReceiver) setForget(forget func()) {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	rcv.forget = forget
+}
+
+// stop calling home, if calling home
+func (rcv *configuredReceiver) stop() {
+	rcv.mu.Lock()
+	cancel, forget := rcv.cancel, rcv.forget
+	rcv.cancel, rcv.forget = nil, nil
+	rcv.state = ReceiverDisconnected
+	rcv.to = nil
+	rcv.mu.Unlock()
+	if forget != nil {
+		forget()
+	}
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// localReceiver is a receiver registered by the application
+type localReceiver func(*Notification) error
+
+func (r localReceiver) notify(n *Notification) error {
+	return r(n)
+}
+
+func (r localReceiver) notifyWait(n *Notification) error {
+	return r(n)
+}
+
+func (cfg *SubscriptionConfig) check() error {
+	if (cfg.Stream == "") == (cfg.Datastore == "") {
+		return fmt.Errorf("subscription %d requires either stream or datastore", cfg.Id)
+	}
+	if cfg.Period < 0 {
+		return fmt.Errorf("subscription %d has negative period", cfg.Id)
+	}
+	if cfg.StopTime != "" {
+		if _, err := time.Parse(time.RFC3339, cfg.StopTime); err != nil {
+			return fmt.Errorf("subscription %d has bad stop time. %w", cfg.Id, err)
+		}
+	}
+	for name, rcv := range cfg.Receiver {
+		if name == "" {
+			return errors.New("receiver name required")
+		}
+		rcv.Name = name
+	}
+	return nil
+}
+
+// sameSettings is true when subscription does not need to restart,
+// receivers can change w/o a restart
+func (cfg *SubscriptionConfig) sameSettings(other *SubscriptionConfig) bool {
+	return cfg.Stream == other.Stream &&
+		cfg.Datastore == other.Datastore &&
+		cfg.XpathFilter == other.XpathFilter &&
+		cfg.Period == other.Period &&
+		cfg.StopTime == other.StopTime
+}
+
+func (cfg *SubscriptionConfig) clone() *SubscriptionConfig {
+	copy := *cfg
+	copy.Receiver = make(map[string]*ReceiverConfig, len(cfg.Receiver))
+	for name, rcv := range cfg.Receiver {
+		rcvCopy := *rcv
+		copy.Receiver[name] = &rcvCopy
+	}
+	return &copy
+}
+
+// clone so edits are not seen until applied
+func (opts ConfiguredOptions) clone() ConfiguredOptions {
+	copy := ConfiguredOptions{Subscription: make(map[int64]*SubscriptionConfig, len(opts.Subscription))}
+	for id, cfg := range opts.Subscription {
+		copy.Subscription[id] = cfg.clone()
+	}
+	return copy
+}
+
+// moduleShortcodes uses module names as xpath prefixes
+func moduleShortcodes(dev device.Device) map[string]string {
+	shortcodes := make(map[string]string)
+	for name, m := range dev.Modules() {
+		shortcodes[name] = m.Namespace()
+	}
+	return shortcodes
+}
+
+// xpathFilterElem is filter as it appears in subscription-started with
+// prefixes in expression declared
+func xpathFilterElem(name xml.Name, f *RpcFilter) string {
+	var prefixes []string
+	for prefix := range f.shortcodes {
+		if strings.Contains(f.Select, prefix+":") {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	sort.Strings(prefixes)
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<%s xmlns="%s"`, name.Local, name.Space)
+	for _, prefix := range prefixes {
+		fmt.Fprintf(&buf, ` xmlns:%s="%s"`, prefix, f.shortcodes[prefix])
+	}
+	buf.WriteString(">")
+	xml.EscapeText(&buf, []byte(f.Select))
+	fmt.Fprintf(&buf, "</%s>", name.Local)
+	return buf.String()
+}
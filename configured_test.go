@@ -0,0 +1,236 @@
+package netconf
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/freeconf/yang/fc"
+	"github.com/freeconf/yang/nodeutil"
+	"github.com/freeconf/yang/patch/xml"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestConfiguredSubscriptions(t *testing.T) {
+	var errs []error
+	d, s := newTestServer(t, nil, WithErrorHandler(func(err error) {
+		errs = append(errs, err)
+	}))
+	defer s.Shutdown(context.Background())
+	received := make(chan string, 10)
+	s.ConfiguredSubscriptions().AddLocalReceiver("app", func(n *Notification) error {
+		data, err := xml.Marshal(n)
+		received <- string(data)
+		return err
+	})
+	expect := func(expected ...string) {
+		t.Helper()
+		msg := <-received
+		for _, e := range expected {
+			fc.AssertEqual(t, true, strings.Contains(msg, e), msg)
+		}
+	}
+	b, err := d.Browser("fc-netconf")
+	fc.RequireEqual(t, nil, err)
+	status := func() string {
+		t.Helper()
+		sel, err := b.Root().Find("subscriptions")
+		fc.RequireEqual(t, nil, err)
+		actual, err := nodeutil.WriteJSON(sel)
+		fc.RequireEqual(t, nil, err)
+		return actual
+	}
+
+	err = b.Root().UpsertFrom(readJson(`{
+		"subscriptions": {
+			"subscription": [{
+				"id": 100,
+				"stream": "NETCONF",
+				"xpathFilter": "ietf-netconf-notifications:netconf-session-start/username='bob'",
+				"receiver": [{
+					"name": "app"
+				},{
+					"name": "collector",
+					"address": "127.0.0.1:1"
+				}]
+			},{
+				"id": 101,
+				"stream": "bogus"
+			}]
+		}
+	}`))
+	fc.RequireEqual(t, nil, err)
+	expect("subscription-started", "<id>100</id>", "<stream>NETCONF</stream>", `xmlns:ietf-netconf-notifications=`)
+	fc.AssertEqual(t, 1, len(errs))
+
+	s.PublishEvent(NetconfEvent{Type: EventSessionStart, Username: "joe", SessionId: 1})
+	s.PublishEvent(NetconfEvent{Type: EventSessionStart, Username: "bob", SessionId: 2})
+	expect(">bob</username>")
+
+	actual := status()
+	fc.AssertEqual(t, true, strings.Contains(actual, `"name":"app","state":"active"`), actual)
+	// ssh is not running so cannot call home
+	fc.AssertEqual(t, true, strings.Contains(actual, `"address":"127.0.0.1:1","state":"connecting"`), actual)
+	fc.AssertEqual(t, true, strings.Contains(actual, `"id":101,"stream":"bogus","state":"invalid"`), actual)
+
+	// listed with dynamic subscriptions so ids are not reused
+	fc.AssertEqual(t, true, s.Subscriptions().Find(100) != nil)
+
+	sel, err := b.Root().Find("subscriptions/subscription=100")
+	fc.RequireEqual(t, nil, err)
+	fc.RequireEqual(t, nil, sel.Delete())
+	expect("subscription-terminated", "<id>100</id>", "no-such-subscription")
+	fc.AssertEqual(t, true, s.Subscriptions().Find(100) == nil)
+
+	// invalid subscription is fixed
+	err = b.Root().UpsertFrom(readJson(`{
+		"subscriptions": {
+			"subscription": [{
+				"id": 101,
+				"stream": "NETCONF",
+				"receiver": [{
+					"name": "app"
+				}]
+			}]
+		}
+	}`))
+	fc.RequireEqual(t, nil, err)
+	expect("subscription-started", "<id>101</id>")
+	actual = status()
+	fc.AssertEqual(t, `{"subscription":[{"id":101,"stream":"NETCONF","state":"valid","receiver":[{"name":"app","state":"active"}]}]}`, actual)
+
+	s.ConfiguredSubscriptions().RemoveLocalReceiver("app")
+	actual = status()
+	fc.AssertEqual(t, true, strings.Contains(actual, `"name":"app","state":"disconnected"`), actual)
+}
+
+func TestCallHome(t *testing.T) {
+	d, s := newTestServer(t, nil)
+	defer s.Shutdown(context.Background())
+	client, err := net.Listen("tcp", "127.0.0.1:0")
+	fc.RequireEqual(t, nil, err)
+	defer client.Close()
+
+	b, err := d.Browser("fc-netconf")
+	fc.RequireEqual(t, nil, err)
+	err = b.Root().UpsertFrom(readJson(fmt.Sprintf(`{
+		"ssh": {
+			"options": {
+				"port": "127.0.0.1:9005",
+				"hostKeyFile": "testdata/host.key",
+				"adminUsername": "admin",
+				"adminPassword": "bird"
+			}
+		},
+		"subscriptions": {
+			"subscription": [{
+				"id": 1,
+				"stream": "NETCONF",
+				"receiver": [{
+					"name": "collector",
+					"address": "%s"
+				}]
+			}]
+		}
+	}`, client.Addr())))
+	fc.RequireEqual(t, nil, err)
+
+	// NETCONF client waits for server to call and then is the ssh client
+	conn, err := client.Accept()
+	fc.RequireEqual(t, nil, err)
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, conn.RemoteAddr().String(), &ssh.ClientConfig{
+		User:            "admin",
+		Auth:            []ssh.AuthMethod{ssh.Password("bird")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	fc.RequireEqual(t, nil, err)
+	sshClient := ssh.NewClient(sshConn, chans, reqs)
+	defer sshClient.Close()
+	ses, err := sshClient.NewSession()
+	fc.RequireEqual(t, nil, err)
+	out, err := ses.StdoutPipe()
+	fc.RequireEqual(t, nil, err)
+	in, err := ses.StdinPipe()
+	fc.RequireEqual(t, nil, err)
+	fc.RequireEqual(t, nil, ses.RequestSubsystem("netconf"))
+	raw := bufio.NewReader(out)
+	hello, err := readEomMessage(raw)
+	fc.RequireEqual(t, nil, err)
+	fc.AssertEqual(t, true, strings.Contains(string(hello), "<capabilities>"), string(hello))
+	_, err = in.Write([]byte(testClientHello))
+	fc.RequireEqual(t, nil, err)
+	msgs := NewChunkedRdr(raw)
+
+	started := recv(t, msgs)
+	fc.AssertEqual(t, true, strings.Contains(started, "subscription-started"), started)
+	fc.AssertEqual(t, ReceiverActive, s.ConfiguredSubscriptions().ReceiverState(1, "collector"))
+	s.PublishEvent(NetconfEvent{Type: EventSessionStart, Username: "joe", SessionId: 100})
+	event := recv(t, msgs)
+	fc.AssertEqual(t, true, strings.Contains(event, ">100</session-id>"), event)
+}
+
+func TestConfiguredSendsWithoutLock(t *testing.T) {
+	_, s := newTestServer(t, nil)
+	defer s.Shutdown(context.Background())
+	c := s.ConfiguredSubscriptions()
+	received := make(chan string)
+	release := make(chan struct{})
+	c.AddLocalReceiver("app", func(n *Notification) error {
+		data, err := xml.Marshal(n)
+		received <- string(data)
+		<-release
+		return err
+	})
+	// receiver is stuck but subscriptions can still be read
+	readable := func(id uint32, expected string) {
+		t.Helper()
+		state := make(chan string, 1)
+		go func() {
+			state <- c.State(id)
+		}()
+		select {
+		case actual := <-state:
+			fc.AssertEqual(t, expected, actual)
+		case <-time.After(time.Second):
+			t.Error("locked while sending")
+		}
+	}
+	applied := make(chan error, 1)
+	apply := func(opts ConfiguredOptions) {
+		go func() {
+			applied <- c.Apply(opts)
+		}()
+	}
+
+	opts := ConfiguredOptions{Subscription: map[int64]*SubscriptionConfig{
+		1: {Stream: NetconfStream, Receiver: map[string]*ReceiverConfig{"app": {}}},
+	}}
+	apply(opts)
+	msg := <-received
+	fc.AssertEqual(t, true, strings.Contains(msg, "subscription-started"), msg)
+	readable(1, SubscriptionValid)
+	release <- struct{}{}
+	fc.AssertEqual(t, nil, <-applied)
+	// caller's options are not changed
+	fc.AssertEqual(t, int64(0), opts.Subscription[1].Id)
+	fc.AssertEqual(t, "", opts.Subscription[1].Receiver["app"].Name)
+
+	opts.Subscription[1].XpathFilter = "ietf-netconf-notifications:netconf-session-start"
+	apply(opts)
+	msg = <-received
+	fc.AssertEqual(t, true, strings.Contains(msg, "subscription-modified"), msg)
+	readable(1, SubscriptionValid)
+	release <- struct{}{}
+	fc.AssertEqual(t, nil, <-applied)
+
+	apply(ConfiguredOptions{})
+	msg = <-received
+	fc.AssertEqual(t, true, strings.Contains(msg, "subscription-terminated"), msg)
+	readable(1, "")
+	release <- struct{}{}
+	fc.AssertEqual(t, nil, <-applied)
+}
@@ -0,0 +1,30 @@
+package netconf
+
+import "context"
+
+type ctxKey int
+
+const rpcCtxKey ctxKey = 0
+
+// RpcContext identifies the caller of an rpc.  Every selection created while
+// handling an rpc carries it so application handlers can find out who is
+// calling
+//
+//	rc, found := netconf.RpcContextFrom(r.Selection.Context)
+//
+// Selection's context is also cancelled when the session ends so long running
+// handlers should watch Context.Done().
+type RpcContext struct {
+	SessionId int64
+	User      string
+	MessageId string
+}
+
+func WithRpcContext(ctx context.Context, rc *RpcContext) context.Context {
+	return context.WithValue(ctx, rpcCtxKey, rc)
+}
+
+func RpcContextFrom(ctx context.Context) (*RpcContext, bool) {
+	rc, found := ctx.Value(rpcCtxKey).(*RpcContext)
+	return rc, found
+}
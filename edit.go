@@ -130,3 +130,33 @@ func getOp(attrs []xml.Attr) string {
 	}
 	return ""
 }
+
+// instanceIdentifier converts an edit path relative to module like
+// tire=0/size into a YANG instance-identifier like /car:tire[pos='0']/size
+func instanceIdentifier(m *meta.Module, path string) string {
+	var b strings.Builder
+	var parent meta.Meta = m
+	for i, seg := range strings.Split(path, "/") {
+		ident, keys, _ := strings.Cut(seg, "=")
+		b.WriteRune('/')
+		if i == 0 {
+			b.WriteString(m.Ident())
+			b.WriteRune(':')
+		}
+		b.WriteString(ident)
+		def := meta.Find(parent, ident)
+		if def == nil {
+			continue
+		}
+		if l, isList := def.(*meta.List); isList && keys != "" {
+			keyMeta := l.KeyMeta()
+			for j, k := range strings.Split(keys, ",") {
+				if j < len(keyMeta) {
+					fmt.Fprintf(&b, "[%s='%s']", keyMeta[j].Ident(), k)
+				}
+			}
+		}
+		parent = def
+	}
+	return b.String()
+}
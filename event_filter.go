@@ -0,0 +1,222 @@
+package netconf
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/freeconf/restconf/device"
+	"github.com/freeconf/yang/meta"
+	"github.com/freeconf/yang/node"
+	"github.com/freeconf/yang/nodeutil"
+	"github.com/freeconf/yang/patch/xml"
+	"github.com/freeconf/yang/xpath"
+)
+
+// eventFilter is the filter of a create-subscription.  Events the filter does
+// not select are not sent and subtree filters also trim what is sent of each
+// event.
+//
+//	https://datatracker.ietf.org/doc/html/rfc5277#section-3.6
+type eventFilter struct {
+	// subtree filter for each notification by element name
+	subtrees map[xml.Name]*subtreeFilter
+
+	// first segment is notification, rest must hold for event to be sent
+	xpath *xpath.Path
+}
+
+func compileEventFilter(dev device.Device, f *RpcFilter) (*eventFilter, error) {
+	if f == nil {
+		return nil, nil
+	}
+	switch f.Type {
+	case "xpath":
+		top, err := xpath.Parse2(deviceNamespaces(dev, f.shortcodes), f.Select)
+		if err != nil {
+			return nil, NewRpcError("protocol", "invalid-value", fmt.Sprintf("bad filter select. %s", err))
+		}
+		if err := checkEventXPath(dev, top); err != nil {
+			return nil, err
+		}
+		return &eventFilter{xpath: top}, nil
+	case "subtree", "":
+		ef := &eventFilter{subtrees: make(map[xml.Name]*subtreeFilter)}
+		for _, e := range f.Elems {
+			var sf subtreeFilter
+			if err := compileSubtree(e, &sf); err != nil {
+				return nil, err
+			}
+			ef.subtrees[e.XMLName] = &sf
+		}
+		return ef, nil
+	}
+	return nil, NewRpcError("protocol", "bad-attribute", fmt.Sprintf("filter type '%s' not supported", f.Type))
+}
+
+// checkEventXPath ensures path is a notification followed by a predicate
+// freeconf's xpath can evaluate
+func checkEventXPath(dev device.Device, top *xpath.Path) error {
+	var notif *meta.Notification
+	for _, mod := range dev.Modules() {
+		if top.Module == "" || top.Module == mod.Ident() {
+			if notif = mod.Notifications()[top.Ident]; notif != nil {
+				break
+			}
+		}
+	}
+	if notif == nil {
+		return NewRpcError("protocol", "invalid-value", fmt.Sprintf("notification '%s' not found", top.QualifiedIdent()))
+	}
+	return checkXPathSegments(notif, top.Next)
+}
+
+// checkXPathSegments ensures path only ends on a leaf when it is compared
+// to a value as freeconf's xpath cannot select a leaf itself
+func checkXPathSegments(parent meta.HasDefinitions, segs *xpath.Path) error {
+	for seg := segs; seg != nil; seg = seg.Next {
+		def := meta.Find(parent, seg.Ident)
+		if def == nil {
+			return NewRpcError("protocol", "invalid-value", fmt.Sprintf("'%s' not found in '%s'", seg.Ident, parent.Ident()))
+		}
+		if meta.IsLeaf(def) {
+			if seg.Expr == nil || seg.Next != nil {
+				return NewRpcError("protocol", "invalid-value", fmt.Sprintf("leaf '%s' must end select with a comparison", seg.Ident))
+			}
+			return nil
+		}
+		parent = def.(meta.HasDefinitions)
+	}
+	return nil
+}
+
+// apply is event trimmed by filter or nil if event is not selected
+func (f *eventFilter) apply(event *node.Selection) (*node.Selection, error) {
+	if f == nil {
+		return event, nil
+	}
+	m := event.Meta()
+	if f.xpath != nil {
+		if f.xpath.Ident != m.Ident() {
+			return nil, nil
+		}
+		if f.xpath.Module != "" && f.xpath.Module != meta.OriginalModule(m).Ident() {
+			return nil, nil
+		}
+		if f.xpath.Next == nil {
+			return event, nil
+		}
+		found, err := event.XPredicate(f.xpath.Next)
+		if !found || err != nil {
+			return nil, err
+		}
+		return event, nil
+	}
+	sf := f.subtrees[xml.Name{Space: meta.OriginalModule(m).Namespace(), Local: m.Ident()}]
+	if sf == nil {
+		sf = f.subtrees[xml.Name{Local: m.Ident()}]
+	}
+	if sf == nil {
+		return nil, nil
+	}
+	if match, err := subtreeMatches(event, sf); !match || err != nil {
+		return nil, err
+	}
+	filtered := *event
+	if event.Constraints != nil {
+		filtered.Constraints = node.NewConstraints(event.Constraints)
+	} else {
+		filtered.Constraints = &node.Constraints{}
+	}
+	filtered.Constraints.AddConstraint("filter", 10, 0, sf)
+	return &filtered, nil
+}
+
+// applyLogged is apply for an event from the replay log
+func (f *eventFilter) applyLogged(dev device.Device, e loggedEvent) (loggedEvent, bool, error) {
+	if f == nil {
+		return e, true, nil
+	}
+	event, err := loggedEventSelection(dev, e)
+	if err != nil {
+		return e, false, err
+	}
+	if event, err = f.apply(event); event == nil || err != nil {
+		return e, false, err
+	}
+	payload, err := encodeEvent(event)
+	if err != nil {
+		return e, false, err
+	}
+	return loggedEvent{eventTime: e.eventTime, event: payload}, true, nil
+}
+
+// loggedEventSelection reads event back from it's xml so it can be
+// filtered
+func loggedEventSelection(dev device.Device, e loggedEvent) (*node.Selection, error) {
+	var mod *meta.Module
+	for _, candidate := range dev.Modules() {
+		if candidate.Namespace() == e.event.XMLName.Space {
+			mod = candidate
+			break
+		}
+	}
+	if mod == nil {
+		return nil, fmt.Errorf("module for namespace '%s' not found", e.event.XMLName.Space)
+	}
+	b, err := dev.Browser(mod.Ident())
+	if err != nil {
+		return nil, err
+	}
+	sel, err := b.Root().Find(e.event.XMLName.Local)
+	if err != nil {
+		return nil, err
+	}
+	if sel == nil {
+		return nil, fmt.Errorf("notification '%s' not found", e.event.XMLName.Local)
+	}
+	data, err := xml.Marshal(e.event)
+	if err != nil {
+		return nil, err
+	}
+	n, err := nodeutil.ReadXMLDoc(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	event := *sel
+	event.Node = n
+	return &event, nil
+}
+
+// subtreeMatches checks content match nodes that decide if event is sent.
+// Content match nodes inside lists only decide which list items are sent.
+func subtreeMatches(sel *node.Selection, f *subtreeFilter) (bool, error) {
+	for _, m := range f.matching {
+		v, err := sel.GetValue(m.field.Local)
+		if err != nil {
+			return false, err
+		}
+		if v == nil || v.String() != m.value {
+			return false, nil
+		}
+	}
+	for name, child := range f.containment {
+		def := meta.Find(sel.Meta().(meta.HasDefinitions), name.Local)
+		if def == nil || !meta.IsContainer(def) {
+			continue
+		}
+		childSel, err := sel.Find(name.Local)
+		if err != nil {
+			return false, err
+		}
+		if childSel == nil {
+			if len(child.matching) > 0 {
+				return false, nil
+			}
+			continue
+		}
+		if match, err := subtreeMatches(childSel, child); !match || err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
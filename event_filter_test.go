@@ -0,0 +1,83 @@
+package netconf
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/freeconf/restconf/testdata"
+	"github.com/freeconf/yang/fc"
+	"github.com/freeconf/yang/patch/xml"
+)
+
+func TestEventFilter(t *testing.T) {
+	d, s := newTestServer(t, testdata.Manage(testdata.New()))
+
+	tests := []struct {
+		name   string
+		filter string
+	}{
+		{
+			name:   "subtree",
+			filter: `<filter type="subtree"><netconf-session-start xmlns="urn:ietf:params:xml:ns:yang:ietf-netconf-notifications"><username>bob</username><session-id/></netconf-session-start></filter>`,
+		},
+		{
+			name:   "xpath",
+			filter: `<filter type="xpath" xmlns:ncn="urn:ietf:params:xml:ns:yang:ietf-netconf-notifications" select="ncn:netconf-session-start/ncn:username='bob'"/>`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newTestConn(t, s, d)
+			c.start()
+			reply := c.call(1, `<create-subscription xmlns="urn:ietf:params:xml:ns:netconf:notification:1.0">`+test.filter+`</create-subscription>`)
+			fc.AssertEqual(t, true, strings.Contains(reply, "<ok"), reply)
+
+			s.PublishEvent(NetconfEvent{Type: EventSessionStart, Username: "joe", SessionId: 100, SourceHost: "10.0.0.1"})
+			s.PublishEvent(NetconfEvent{Type: EventSessionStart, Username: "bob", SessionId: 101, SourceHost: "10.0.0.2"})
+			notification := c.recv()
+			fc.AssertEqual(t, true, strings.Contains(notification, ">bob</username>"), notification)
+			if test.name == "subtree" {
+				// only selected fields
+				fc.AssertEqual(t, true, strings.Contains(notification, ">101</session-id>"), notification)
+				fc.AssertEqual(t, false, strings.Contains(notification, "source-host"), notification)
+			}
+
+			c.kill()
+		})
+	}
+}
+
+func TestEventFilterBadSelect(t *testing.T) {
+	d, _ := newTestServer(t, nil)
+	_, err := compileEventFilter(d, &RpcFilter{Type: "xpath", Select: "no-such-event"})
+	fc.AssertEqual(t, "invalid-value: notification 'no-such-event' not found", err.Error())
+	_, err = compileEventFilter(d, &RpcFilter{Type: "xpath", Select: "netconf-session-start/username"})
+	fc.AssertEqual(t, "invalid-value: leaf 'username' must end select with a comparison", err.Error())
+}
+
+func TestEventFilterReplayed(t *testing.T) {
+	d, s := newTestServer(t, nil)
+	fc.RequireEqual(t, nil, s.EnableReplay(NetconfStream, ReplayOptions{}))
+	defer s.closeReplayLogs()
+	start := s.ReplayLog(NetconfStream).CreationTime()
+	s.PublishEvent(NetconfEvent{Type: EventSessionStart, Username: "joe", SessionId: 100})
+	s.PublishEvent(NetconfEvent{Type: EventSessionStart, Username: "bob", SessionId: 101})
+	events, _, err := s.ReplayLog(NetconfStream).subscribe(start, func(loggedEvent) {})
+	fc.RequireEqual(t, nil, err)
+	fc.RequireEqual(t, 2, len(events))
+
+	f, err := compileEventFilter(d, &RpcFilter{
+		Elems: []*Msg{{
+			XMLName: xml.Name{Space: "urn:ietf:params:xml:ns:yang:ietf-netconf-notifications", Local: "netconf-session-start"},
+			Elems:   []*Msg{{XMLName: xml.Name{Local: "username"}, Content: "bob"}},
+		}},
+	})
+	fc.RequireEqual(t, nil, err)
+	_, selected, err := f.applyLogged(d, events[0])
+	fc.RequireEqual(t, nil, err)
+	fc.AssertEqual(t, false, selected)
+	e, selected, err := f.applyLogged(d, events[1])
+	fc.RequireEqual(t, nil, err)
+	fc.AssertEqual(t, true, selected)
+	fc.AssertEqual(t, 1, len(e.event.Elem))
+}
@@ -1,9 +1,94 @@
 package netconf
 
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/freeconf/restconf/device"
+	"github.com/freeconf/restconf/estream"
+	"github.com/freeconf/yang/meta"
+	"github.com/freeconf/yang/node"
+)
+
 // Implements request in RFC5277 for events from a "named" event
 // stream.  This presumably was from before YANG driven data models where each
 // event stream had a unique identifier known as the data path.
 
+// NamedStreams maps legacy stream names to the notification in a device
+// module that carries the events as "module:notification"
+//
+//	Predefined: map[string]string{
+//		"car-events": "car:update",
+//	}
 type NamedStreams struct {
 	Predefined map[string]string
 }
+
+// WithNamedStreams makes named streams available to subscribe to
+func WithNamedStreams(streams NamedStreams) ServerOption {
+	return func(s *Server) error {
+		return s.AddNamedStreams(streams)
+	}
+}
+
+// AddNamedStreams registers each named stream with the stream service.
+// Notifications are found when subscribed to so modules can be added to
+// device later.
+func (s *Server) AddNamedStreams(streams NamedStreams) error {
+	names := make([]string, 0, len(streams.Predefined))
+	for name := range streams.Predefined {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		qualified := streams.Predefined[name]
+		if _, _, err := splitQualified(qualified); err != nil {
+			return fmt.Errorf("named stream %s. %w", name, err)
+		}
+		err := s.AddStream(estream.Stream{
+			Name: name,
+			Open: func() (*node.Selection, error) {
+				return findNotification(s.main, qualified)
+			},
+		}, fmt.Sprintf("RFC 5277 named stream of %s notifications", qualified))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func splitQualified(qualified string) (string, string, error) {
+	module, path, found := strings.Cut(qualified, ":")
+	if !found || module == "" || path == "" {
+		return "", "", fmt.Errorf("'%s' is not in form module:notification", qualified)
+	}
+	return module, path, nil
+}
+
+// findNotification is notification named as "module:notification"
+func findNotification(dev device.Device, qualified string) (*node.Selection, error) {
+	module, path, err := splitQualified(qualified)
+	if err != nil {
+		return nil, err
+	}
+	b, err := dev.Browser(module)
+	if err != nil {
+		return nil, err
+	}
+	if b == nil {
+		return nil, fmt.Errorf("module '%s' not found", module)
+	}
+	sel, err := b.Root().Find(path)
+	if err != nil {
+		return nil, err
+	}
+	if sel == nil {
+		return nil, fmt.Errorf("notification '%s' not found", qualified)
+	}
+	if _, isNotification := sel.Meta().(*meta.Notification); !isNotification {
+		return nil, fmt.Errorf("'%s' is not a notification", qualified)
+	}
+	return sel, nil
+}
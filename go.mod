@@ -2,9 +2,12 @@ module github.com/freeconf/netconf
 
 go 1.20
 
+require (
+	github.com/freeconf/yang v0.0.0-20240126135339-ef92ddeb9f99
+	golang.org/x/crypto v0.16.0
+)
+
 require (
 	github.com/freeconf/restconf v0.0.0-20240126143528-7e8989aa69af // indirect
-	github.com/freeconf/yang v0.0.0-20240126135339-ef92ddeb9f99 // indirect
-	golang.org/x/crypto v0.16.0 // indirect
 	golang.org/x/sys v0.15.0 // indirect
 )
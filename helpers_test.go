@@ -0,0 +1,161 @@
+package netconf
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/freeconf/restconf"
+	"github.com/freeconf/restconf/device"
+	"github.com/freeconf/restconf/estream"
+	"github.com/freeconf/yang/fc"
+	"github.com/freeconf/yang/node"
+	"github.com/freeconf/yang/source"
+)
+
+// testYPath has fc-netconf, the ietf models it implements and the car model
+var testYPath = source.Any(
+	restconf.InternalYPath,
+	restconf.InternalIetfRfcYPath,
+	source.Dir("./yang"),
+	source.Dir("./testdata/yang"),
+)
+
+// newTestServer is a server on a new device that manages car with n unless
+// n is nil
+func newTestServer(t *testing.T, n node.Node, opts ...ServerOption) (*device.Local, *Server) {
+	t.Helper()
+	d := device.New(testYPath)
+	if n != nil {
+		fc.RequireEqual(t, nil, d.Add("car", n))
+	}
+	s, err := New(d, estream.NewService(), opts...)
+	fc.RequireEqual(t, nil, err)
+	return d, s
+}
+
+// rpcTester sends rpcs straight to a session's rpc handler and keeps every
+// reply to compare to a gold file
+type rpcTester struct {
+	t       *testing.T
+	ses     *Session
+	out     bytes.Buffer
+	replies bytes.Buffer
+}
+
+func newRpcTester(t *testing.T, mgr SessionManager, d device.Device) *rpcTester {
+	rt := &rpcTester{t: t}
+	rdr, _ := io.Pipe()
+	rt.ses = NewSession(mgr, "joe", d, rdr, &rt.out)
+	return rt
+}
+
+// send op in an rpc and return the reply
+func (rt *rpcTester) send(op string) string {
+	rt.t.Helper()
+	rt.out.Reset()
+	req, err := DecodeRequest(strings.NewReader(`<rpc xmlns="urn:ietf:params:xml:ns:netconf:base:1.0" message-id="1">` + op + `</rpc>`))
+	fc.RequireEqual(rt.t, nil, err)
+	fc.RequireEqual(rt.t, nil, rt.ses.handleRpc(context.Background(), req.Rpc))
+	fmt.Fprintf(&rt.replies, "<!-- %s -->\n%s\n\n", op, strings.TrimSpace(rt.out.String()))
+	return rt.out.String()
+}
+
+// gold compares every reply so far to file
+func (rt *rpcTester) gold(file string) {
+	rt.t.Helper()
+	fc.Gold(rt.t, *updateFlag, rt.replies.Bytes(), file)
+}
+
+// testConn is a session reading messages from a client over pipes like it
+// would from an ssh channel
+type testConn struct {
+	t      *testing.T
+	ses    *Session
+	client *io.PipeWriter
+	msgs   <-chan io.Reader
+	done   chan error
+}
+
+// newTestConn is a session that is not reading yet so it can be adjusted
+// before start
+func newTestConn(t *testing.T, s *Server, d device.Device) *testConn {
+	in, client := io.Pipe()
+	replies, out := io.Pipe()
+	return &testConn{
+		t:      t,
+		ses:    NewSession(s, "joe", d, in, out),
+		client: client,
+		msgs:   NewChunkedRdr(replies),
+		done:   make(chan error, 1),
+	}
+}
+
+// start reading messages and send client hello
+func (c *testConn) start() {
+	go func() {
+		err := c.ses.readMessages(c.ses.Context())
+		c.ses.close()
+		c.done <- err
+	}()
+	c.client.Write([]byte(testClientHello))
+}
+
+// send op in an rpc w/o waiting for reply
+func (c *testConn) send(id int, op string) {
+	msg := fmt.Sprintf(`<rpc xmlns="urn:ietf:params:xml:ns:netconf:base:1.0" message-id="%d">%s</rpc>`, id, op)
+	go fmt.Fprintf(c.client, "\n#%d\n%s\n##\n", len(msg), msg)
+}
+
+// recv next message
+func recv(t *testing.T, msgs <-chan io.Reader) string {
+	t.Helper()
+	msg, err := io.ReadAll(<-msgs)
+	fc.RequireEqual(t, nil, err)
+	return string(msg)
+}
+
+// recv next reply or notification
+func (c *testConn) recv() string {
+	c.t.Helper()
+	return recv(c.t, c.msgs)
+}
+
+// expect next message to contain each of expected
+func (c *testConn) expect(expected ...string) string {
+	c.t.Helper()
+	msg := c.recv()
+	for _, e := range expected {
+		fc.AssertEqual(c.t, true, strings.Contains(msg, e), msg)
+	}
+	return msg
+}
+
+// expectNone makes sure no message arrives for a while
+func (c *testConn) expectNone(wait time.Duration) {
+	c.t.Helper()
+	select {
+	case msg := <-c.msgs:
+		unexpected, _ := io.ReadAll(msg)
+		fc.AssertEqual(c.t, "", string(unexpected))
+	case <-time.After(wait):
+	}
+}
+
+// call sends op and returns next message which is reply unless
+// notifications are also being sent
+func (c *testConn) call(id int, op string) string {
+	c.t.Helper()
+	c.send(id, op)
+	return c.recv()
+}
+
+// kill session as if by session 7 and wait for session to end
+func (c *testConn) kill() error {
+	c.ses.Kill(7)
+	return <-c.done
+}
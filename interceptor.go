@@ -0,0 +1,102 @@
+package netconf
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/freeconf/yang/fc"
+)
+
+// RpcInterceptor wraps every rpc for things like logging, metrics, auditing
+// or rate limiting.  Call next to continue on to the next interceptor and
+// eventually the operation or return w/o calling next to short-circuit.
+// Return an *RpcError to have it reported to the client.
+type RpcInterceptor func(ctx context.Context, req *RpcRequest, reply *RpcReply, next RpcHandler) error
+
+// NotifyInterceptor wraps every notification sent to a client.  Call next to
+// send the notification, possibly altered, or return w/o calling next to
+// suppress it.
+type NotifyInterceptor func(ses *Session, n *Notification, next func(*Notification) error) error
+
+type interceptors struct {
+	mu     sync.RWMutex
+	rpc    []RpcInterceptor
+	notify []NotifyInterceptor
+}
+
+// Intercept adds interceptor to every rpc.  First interceptor added is the
+// first to be called.
+func (s *Server) Intercept(i RpcInterceptor) {
+	s.interceptors.mu.Lock()
+	defer s.interceptors.mu.Unlock()
+	s.interceptors.rpc = append(s.interceptors.rpc, i)
+}
+
+// InterceptNotifications adds interceptor to every notification.  First
+// interceptor added is the first to be called.
+func (s *Server) InterceptNotifications(i NotifyInterceptor) {
+	s.interceptors.mu.Lock()
+	defer s.interceptors.mu.Unlock()
+	s.interceptors.notify = append(s.interceptors.notify, i)
+}
+
+func (s *Server) RpcInterceptors() []RpcInterceptor {
+	s.interceptors.mu.RLock()
+	defer s.interceptors.mu.RUnlock()
+	return s.interceptors.rpc
+}
+
+func (s *Server) NotifyInterceptors() []NotifyInterceptor {
+	s.interceptors.mu.RLock()
+	defer s.interceptors.mu.RUnlock()
+	return s.interceptors.notify
+}
+
+func chainRpc(chain []RpcInterceptor, h RpcHandler) RpcHandler {
+	for i := len(chain) - 1; i >= 0; i-- {
+		interceptor, next := chain[i], h
+		h = func(ctx context.Context, req *RpcRequest, reply *RpcReply) error {
+			return interceptor(ctx, req, reply, next)
+		}
+	}
+	return h
+}
+
+func chainNotify(ses *Session, chain []NotifyInterceptor, send func(*Notification) error) func(*Notification) error {
+	for i := len(chain) - 1; i >= 0; i-- {
+		interceptor, next := chain[i], send
+		send = func(n *Notification) error {
+			return interceptor(ses, n, next)
+		}
+	}
+	return send
+}
+
+// errNotificationDropped is when client is not reading notifications fast
+// enough and notification was not queued
+var errNotificationDropped = errors.New("notification dropped")
+
+// notify sends notification thru interceptors
+func (ses *Session) notify(n *Notification) error {
+	send := chainNotify(ses, ses.mgr.NotifyInterceptors(), func(n *Notification) error {
+		sent, err := ses.wtr.Notify(n)
+		if err != nil {
+			return err
+		}
+		if !sent {
+			fc.Info.Printf("client not keeping up, dropped notification on ses=%d", ses.Id)
+			return errNotificationDropped
+		}
+		return nil
+	})
+	return send(n)
+}
+
+// notifyWait waits for room to queue notification instead of dropping it
+func (ses *Session) notifyWait(n *Notification) error {
+	send := chainNotify(ses, ses.mgr.NotifyInterceptors(), func(n *Notification) error {
+		return ses.wtr.Send(n)
+	})
+	return send(n)
+}
@@ -0,0 +1,51 @@
+package netconf
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/freeconf/yang/fc"
+)
+
+func TestInterceptors(t *testing.T) {
+	srv := &Server{}
+	var log []string
+	srv.Intercept(func(ctx context.Context, req *RpcRequest, reply *RpcReply, next RpcHandler) error {
+		log = append(log, "a:"+req.Operation.Local)
+		err := next(ctx, req, reply)
+		log = append(log, "a:done")
+		return err
+	})
+	srv.Intercept(func(ctx context.Context, req *RpcRequest, reply *RpcReply, next RpcHandler) error {
+		if req.Session.User() == "guest" {
+			return NewRpcError("application", "access-denied", "guests are read-only")
+		}
+		log = append(log, "b")
+		return next(ctx, req, reply)
+	})
+	srv.InterceptNotifications(func(ses *Session, n *Notification, next func(*Notification) error) error {
+		log = append(log, "notify")
+		if len(n.Elems) == 0 {
+			// suppress
+			return nil
+		}
+		return next(n)
+	})
+	rt := newRpcTester(t, srv, nil)
+	ses := rt.ses
+	kill := `<kill-session><session-id>99</session-id></kill-session>`
+	rt.send(kill)
+	fc.AssertEqual(t, "a:kill-session,b,a:done", strings.Join(log, ","))
+
+	log = nil
+	ses.user = "guest"
+	actual := rt.send(kill)
+	fc.AssertEqual(t, "a:kill-session,a:done", strings.Join(log, ","))
+	fc.AssertEqual(t, true, strings.Contains(actual, "access-denied"), actual)
+
+	log = nil
+	fc.AssertEqual(t, nil, ses.notify(&Notification{}))
+	fc.AssertEqual(t, "notify", strings.Join(log, ","))
+	fc.AssertEqual(t, 0, len(ses.wtr.queue))
+}
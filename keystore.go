@@ -0,0 +1,490 @@
+package netconf
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Keystore holds asymmetric keys and their certificates by name so transport
+// handlers like ssh reference keys w/o knowing where they came from.  Data
+// model follows
+//
+//	https://www.rfc-editor.org/rfc/rfc9642 (ietf-keystore)
+//
+// Keys are not changed once they are in the keystore, edits replace them, so
+// a key can be used w/o holding the lock.
+type Keystore struct {
+	mu   sync.RWMutex
+	keys map[string]*AsymmetricKey
+}
+
+// keystoreData is what management api reads and edits. Edits are applied all
+// at once when edit ends.
+type keystoreData struct {
+	AsymmetricKey map[string]*AsymmetricKey
+}
+
+type AsymmetricKey struct {
+	Name        string
+	Certificate map[string]*Certificate
+
+	// never exported so private key cannot be read back thru api
+	signer crypto.Signer
+}
+
+type Certificate struct {
+	Name string
+
+	// PEM encoded X.509 certificate
+	CertData string
+}
+
+// supported values of generate-asymmetric-key algorithm
+const (
+	AlgRsa2048   = "rsa2048"
+	AlgRsa3072   = "rsa3072"
+	AlgRsa4096   = "rsa4096"
+	AlgEcdsaP256 = "ecdsa-p256"
+	AlgEcdsaP384 = "ecdsa-p384"
+	AlgEcdsaP521 = "ecdsa-p521"
+	AlgEd25519   = "ed25519"
+)
+
+var ErrKeyNotFound = errors.New("key not found")
+
+func NewKeystore() *Keystore {
+	return &Keystore{
+		keys: make(map[string]*AsymmetricKey),
+	}
+}
+
+func (ks *Keystore) Key(name string) (*AsymmetricKey, error) {
+	ks.mu.RLock()
+	k, found := ks.keys[name]
+	ks.mu.RUnlock()
+	if !found || k.signer == nil {
+		return nil, fmt.Errorf("%w. '%s'", ErrKeyNotFound, name)
+	}
+	return k, nil
+}
+
+// KeyNames in sorted order
+func (ks *Keystore) KeyNames() []string {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	names := make([]string, 0, len(ks.keys))
+	for name := range ks.keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SetKey adds key, replacing any existing key with the same name
+func (ks *Keystore) SetKey(k *AsymmetricKey) {
+	ks.mu.Lock()
+	ks.keys[k.Name] = k
+	ks.mu.Unlock()
+}
+
+func (ks *Keystore) RemoveKey(name string) {
+	ks.mu.Lock()
+	delete(ks.keys, name)
+	ks.mu.Unlock()
+}
+
+// GenerateKey creates a new private key, replacing any existing key with the
+// same name.
+func (ks *Keystore) GenerateKey(name string, algorithm string) (*AsymmetricKey, error) {
+	k, err := newAsymmetricKey(name, algorithm)
+	if err != nil {
+		return nil, err
+	}
+	ks.SetKey(k)
+	return k, nil
+}
+
+// data is a copy of all keys safe to edit
+func (ks *Keystore) data() *keystoreData {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	data := &keystoreData{AsymmetricKey: make(map[string]*AsymmetricKey, len(ks.keys))}
+	for name, k := range ks.keys {
+		data.AsymmetricKey[name] = k.clone()
+	}
+	return data
+}
+
+// apply replaces all keys with edited copy
+func (ks *Keystore) apply(data *keystoreData) {
+	keys := make(map[string]*AsymmetricKey, len(data.AsymmetricKey))
+	for name, k := range data.AsymmetricKey {
+		keys[name] = k
+	}
+	ks.mu.Lock()
+	ks.keys = keys
+	ks.mu.Unlock()
+}
+
+func (k *AsymmetricKey) clone() *AsymmetricKey {
+	dup := *k
+	if k.Certificate != nil {
+		dup.Certificate = make(map[string]*Certificate, len(k.Certificate))
+		for name, c := range k.Certificate {
+			cc := *c
+			dup.Certificate[name] = &cc
+		}
+	}
+	return &dup
+}
+
+func newAsymmetricKey(name string, algorithm string) (*AsymmetricKey, error) {
+	if name == "" {
+		return nil, errors.New("key name required")
+	}
+	signer, err := generateSigner(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	return &AsymmetricKey{
+		Name:   name,
+		signer: signer,
+	}, nil
+}
+
+func generateSigner(algorithm string) (crypto.Signer, error) {
+	switch algorithm {
+	case AlgRsa2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case AlgRsa3072:
+		return rsa.GenerateKey(rand.Reader, 3072)
+	case AlgRsa4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case AlgEcdsaP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case AlgEcdsaP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case AlgEcdsaP521:
+		return ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	case AlgEd25519:
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		return priv, err
+	}
+	return nil, fmt.Errorf("unsupported key algorithm '%s'", algorithm)
+}
+
+// SshSigner is for using key as ssh host key
+func (ks *Keystore) SshSigner(name string) (ssh.Signer, error) {
+	k, err := ks.Key(name)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.NewSignerFromSigner(k.signer)
+}
+
+// TLSCertificate pairs a key with one of it's certificates for use in a
+// tls.Config
+func (ks *Keystore) TLSCertificate(keyName string, certName string) (tls.Certificate, error) {
+	var empty tls.Certificate
+	k, err := ks.Key(keyName)
+	if err != nil {
+		return empty, err
+	}
+	c, found := k.Certificate[certName]
+	if !found {
+		return empty, fmt.Errorf("certificate '%s' not found on key '%s'", certName, keyName)
+	}
+	certs, err := parseCertificates(c.CertData)
+	if err != nil {
+		return empty, err
+	}
+	tlsCert := tls.Certificate{PrivateKey: k.signer, Leaf: certs[0]}
+	for _, x := range certs {
+		tlsCert.Certificate = append(tlsCert.Certificate, x.Raw)
+	}
+	return tlsCert, nil
+}
+
+// SetCleartextPrivateKey accepts PEM encoded PKCS#1, PKCS#8, SEC 1 or OpenSSH
+// private keys
+func (k *AsymmetricKey) SetCleartextPrivateKey(data string) error {
+	raw, err := ssh.ParseRawPrivateKey([]byte(data))
+	if err != nil {
+		return fmt.Errorf("could not parse private key '%s'. %w", k.Name, err)
+	}
+	if x, isPtr := raw.(*ed25519.PrivateKey); isPtr {
+		// normalize to value as that is what ed25519 library generates
+		raw = *x
+	}
+	signer, valid := raw.(crypto.Signer)
+	if !valid {
+		return fmt.Errorf("unsupported private key type %T for '%s'", raw, k.Name)
+	}
+	k.signer = signer
+	return nil
+}
+
+func (k *AsymmetricKey) Signer() crypto.Signer {
+	return k.signer
+}
+
+// Algorithm is the family of the key: rsa, ecdsa or ed25519
+func (k *AsymmetricKey) Algorithm() string {
+	switch k.signer.(type) {
+	case *rsa.PrivateKey:
+		return "rsa"
+	case *ecdsa.PrivateKey:
+		return "ecdsa"
+	case ed25519.PrivateKey:
+		return "ed25519"
+	}
+	return ""
+}
+
+// PublicKey in ssh authorized key format
+func (k *AsymmetricKey) PublicKey() (string, error) {
+	if k.signer == nil {
+		return "", nil
+	}
+	pub, err := ssh.NewPublicKey(k.signer.Public())
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub))), nil
+}
+
+// Truststore holds public keys and certificates of peers, bundled into named
+// bags.  Data model follows
+//
+//	https://www.rfc-editor.org/rfc/rfc9641 (ietf-truststore)
+//
+// Like keys in keystore, bags are replaced and never changed once they are
+// in the truststore.
+type Truststore struct {
+	mu              sync.RWMutex
+	publicKeyBags   map[string]*PublicKeyBag
+	certificateBags map[string]*CertificateBag
+}
+
+// truststoreData is what management api reads and edits
+type truststoreData struct {
+	PublicKeyBag   map[string]*PublicKeyBag
+	CertificateBag map[string]*CertificateBag
+}
+
+type PublicKeyBag struct {
+	Name        string
+	Description string
+	PublicKey   map[string]*TrustedPublicKey
+}
+
+type TrustedPublicKey struct {
+	Name string
+
+	// ssh authorized key format
+	PublicKey string
+}
+
+type CertificateBag struct {
+	Name        string
+	Description string
+	Certificate map[string]*Certificate
+}
+
+func NewTruststore() *Truststore {
+	return &Truststore{
+		publicKeyBags:   make(map[string]*PublicKeyBag),
+		certificateBags: make(map[string]*CertificateBag),
+	}
+}
+
+func (ts *Truststore) PublicKeyBag(name string) (*PublicKeyBag, bool) {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	bag, found := ts.publicKeyBags[name]
+	return bag, found
+}
+
+// SetPublicKeyBag adds bag, replacing any existing bag with the same name
+func (ts *Truststore) SetPublicKeyBag(bag *PublicKeyBag) {
+	ts.mu.Lock()
+	ts.publicKeyBags[bag.Name] = bag
+	ts.mu.Unlock()
+}
+
+func (ts *Truststore) RemovePublicKeyBag(name string) {
+	ts.mu.Lock()
+	delete(ts.publicKeyBags, name)
+	ts.mu.Unlock()
+}
+
+func (ts *Truststore) CertificateBag(name string) (*CertificateBag, bool) {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	bag, found := ts.certificateBags[name]
+	return bag, found
+}
+
+// SetCertificateBag adds bag, replacing any existing bag with the same name
+func (ts *Truststore) SetCertificateBag(bag *CertificateBag) {
+	ts.mu.Lock()
+	ts.certificateBags[bag.Name] = bag
+	ts.mu.Unlock()
+}
+
+func (ts *Truststore) RemoveCertificateBag(name string) {
+	ts.mu.Lock()
+	delete(ts.certificateBags, name)
+	ts.mu.Unlock()
+}
+
+// data is a copy of all bags safe to edit
+func (ts *Truststore) data() *truststoreData {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	data := &truststoreData{
+		PublicKeyBag:   make(map[string]*PublicKeyBag, len(ts.publicKeyBags)),
+		CertificateBag: make(map[string]*CertificateBag, len(ts.certificateBags)),
+	}
+	for name, bag := range ts.publicKeyBags {
+		dup := *bag
+		dup.PublicKey = make(map[string]*TrustedPublicKey, len(bag.PublicKey))
+		for kname, k := range bag.PublicKey {
+			kcopy := *k
+			dup.PublicKey[kname] = &kcopy
+		}
+		data.PublicKeyBag[name] = &dup
+	}
+	for name, bag := range ts.certificateBags {
+		dup := *bag
+		dup.Certificate = make(map[string]*Certificate, len(bag.Certificate))
+		for cname, c := range bag.Certificate {
+			ccopy := *c
+			dup.Certificate[cname] = &ccopy
+		}
+		data.CertificateBag[name] = &dup
+	}
+	return data
+}
+
+// apply replaces all bags with edited copy
+func (ts *Truststore) apply(data *truststoreData) {
+	pubs := make(map[string]*PublicKeyBag, len(data.PublicKeyBag))
+	for name, bag := range data.PublicKeyBag {
+		pubs[name] = bag
+	}
+	certs := make(map[string]*CertificateBag, len(data.CertificateBag))
+	for name, bag := range data.CertificateBag {
+		certs[name] = bag
+	}
+	ts.mu.Lock()
+	ts.publicKeyBags, ts.certificateBags = pubs, certs
+	ts.mu.Unlock()
+}
+
+// SshPublicKeys parses all keys in a bag for checking ssh client key auth
+func (ts *Truststore) SshPublicKeys(bagName string) ([]ssh.PublicKey, error) {
+	bag, found := ts.PublicKeyBag(bagName)
+	if !found {
+		return nil, fmt.Errorf("public key bag '%s' not found", bagName)
+	}
+	keys := make([]ssh.PublicKey, 0, len(bag.PublicKey))
+	for _, k := range bag.PublicKey {
+		pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k.PublicKey))
+		if err != nil {
+			return nil, fmt.Errorf("could not parse public key '%s' in bag '%s'. %w", k.Name, bagName, err)
+		}
+		keys = append(keys, pub)
+	}
+	return keys, nil
+}
+
+// CertPool is for verifying peer certificates in a tls.Config
+func (ts *Truststore) CertPool(bagName string) (*x509.CertPool, error) {
+	bag, found := ts.CertificateBag(bagName)
+	if !found {
+		return nil, fmt.Errorf("certificate bag '%s' not found", bagName)
+	}
+	pool := x509.NewCertPool()
+	for _, c := range bag.Certificate {
+		certs, err := parseCertificates(c.CertData)
+		if err != nil {
+			return nil, err
+		}
+		for _, x := range certs {
+			pool.AddCert(x)
+		}
+	}
+	return pool, nil
+}
+
+func parseCertificates(data string) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	rest := []byte(data)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		c, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, c)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no PEM encoded certificates found")
+	}
+	return certs, nil
+}
+
+// LoadKeyFile reads a PEM encoded private key from disk into the keystore
+func (ks *Keystore) LoadKeyFile(name string, fname string) (*AsymmetricKey, error) {
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	k := &AsymmetricKey{Name: name}
+	if err = k.SetCleartextPrivateKey(string(data)); err != nil {
+		return nil, err
+	}
+	ks.SetKey(k)
+	return k, nil
+}
+
+// WriteKeyFile saves private key in OpenSSH PEM format readable only by
+// owner.  File is written along side and then moved into place so an existing
+// key is not lost if write fails.
+func (k *AsymmetricKey) WriteKeyFile(fname string) error {
+	if k.signer == nil {
+		return fmt.Errorf("no private key for '%s'", k.Name)
+	}
+	block, err := ssh.MarshalPrivateKey(k.signer, k.Name)
+	if err != nil {
+		return err
+	}
+	tmp := fname + ".new"
+	if err = os.WriteFile(tmp, pem.EncodeToMemory(block), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fname)
+}
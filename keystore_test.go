@@ -0,0 +1,115 @@
+package netconf
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/freeconf/restconf/device"
+	"github.com/freeconf/restconf/estream"
+	"github.com/freeconf/yang/fc"
+	"github.com/freeconf/yang/nodeutil"
+)
+
+func TestKeystoreGenerate(t *testing.T) {
+	ks := NewKeystore()
+	tests := []struct {
+		alg    string
+		family string
+		prefix string
+	}{
+		{alg: AlgEd25519, family: "ed25519", prefix: "ssh-ed25519 "},
+		{alg: AlgEcdsaP256, family: "ecdsa", prefix: "ecdsa-sha2-nistp256 "},
+		{alg: AlgRsa2048, family: "rsa", prefix: "ssh-rsa "},
+	}
+	for _, test := range tests {
+		k, err := ks.GenerateKey("k", test.alg)
+		fc.RequireEqual(t, nil, err)
+		fc.AssertEqual(t, test.family, k.Algorithm())
+		pub, err := k.PublicKey()
+		fc.AssertEqual(t, nil, err)
+		fc.AssertEqual(t, true, strings.HasPrefix(pub, test.prefix), pub)
+		_, err = ks.SshSigner("k")
+		fc.AssertEqual(t, nil, err)
+	}
+	_, err := ks.GenerateKey("k", "bogus")
+	fc.AssertEqual(t, true, err != nil)
+	_, err = ks.SshSigner("nope")
+	fc.AssertEqual(t, true, err != nil)
+}
+
+func TestKeystoreApi(t *testing.T) {
+	d := device.New(testYPath)
+	s := NewServer(d, estream.NewService())
+	pem, err := os.ReadFile("testdata/host.key")
+	fc.RequireEqual(t, nil, err)
+	ks, err := d.Browser("ietf-keystore")
+	fc.RequireEqual(t, nil, err)
+	n, err := nodeutil.ReadJSONValues(map[string]interface{}{
+		"keystore": map[string]interface{}{
+			"asymmetric-keys": map[string]interface{}{
+				"asymmetric-key": []interface{}{
+					map[string]interface{}{
+						"name":                  "host",
+						"cleartext-private-key": string(pem),
+					},
+				},
+			},
+		},
+	})
+	fc.RequireEqual(t, nil, err)
+	fc.RequireEqual(t, nil, ks.Root().UpsertFrom(n))
+	ts, err := d.Browser("ietf-truststore")
+	fc.RequireEqual(t, nil, err)
+	n, err = nodeutil.ReadJSONValues(map[string]interface{}{
+		"truststore": map[string]interface{}{
+			"public-key-bags": map[string]interface{}{
+				"public-key-bag": []interface{}{
+					map[string]interface{}{
+						"name": "admins",
+						"public-key": []interface{}{
+							map[string]interface{}{
+								"name":       "joe",
+								"public-key": "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGCUWK6UUKPOd0+Zt4hP8mEgsTnSuMahTJ2/v8rzupcg joe@example.com",
+							},
+						},
+					},
+				},
+			},
+		},
+	})
+	fc.RequireEqual(t, nil, err)
+	fc.RequireEqual(t, nil, ts.Root().UpsertFrom(n))
+	_, err = s.Keystore().SshSigner("host")
+	fc.AssertEqual(t, nil, err)
+	admins, err := s.Truststore().SshPublicKeys("admins")
+	fc.AssertEqual(t, nil, err)
+	fc.AssertEqual(t, 1, len(admins))
+
+	actual, err := nodeutil.WriteJSON(ks.Root())
+	fc.AssertEqual(t, nil, err)
+	fc.AssertEqual(t, false, strings.Contains(actual, "private"), actual)
+	fc.AssertEqual(t, true, strings.Contains(actual, `{"keystore":{"asymmetric-keys":{"asymmetric-key":[{"name":"host","public-key":"ssh-rsa `), actual)
+	actual, err = nodeutil.WriteJSON(ts.Root())
+	fc.AssertEqual(t, nil, err)
+	fc.AssertEqual(t, true, strings.Contains(actual, `"public-key-bags":{"public-key-bag":[{"name":"admins"`), actual)
+
+	b, err := d.Browser("fc-netconf")
+	fc.RequireEqual(t, nil, err)
+	gen, err := b.Root().Find("generate-asymmetric-key")
+	fc.RequireEqual(t, nil, err)
+	out, err := gen.Action(readJson(`{"name":"gen","algorithm":"ecdsa-p256"}`))
+	fc.RequireEqual(t, nil, err)
+	pub, err := out.GetValue("public-key")
+	fc.AssertEqual(t, nil, err)
+	fc.AssertEqual(t, true, strings.HasPrefix(pub.String(), "ecdsa-sha2-nistp256 "))
+	_, err = s.Keystore().SshSigner("gen")
+	fc.AssertEqual(t, nil, err)
+	fc.AssertEqual(t, []string{"gen", "host"}, s.Keystore().KeyNames())
+
+	out, err = gen.Action(readJson(`{"name":"dflt"}`))
+	fc.RequireEqual(t, nil, err)
+	pub, err = out.GetValue("public-key")
+	fc.AssertEqual(t, nil, err)
+	fc.AssertEqual(t, true, strings.HasPrefix(pub.String(), "ssh-ed25519 "))
+}
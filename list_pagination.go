@@ -0,0 +1,471 @@
+package netconf
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/freeconf/yang/meta"
+	"github.com/freeconf/yang/node"
+	"github.com/freeconf/yang/nodeutil"
+	"github.com/freeconf/yang/patch/xml"
+	"github.com/freeconf/yang/val"
+	"github.com/freeconf/yang/xpath"
+)
+
+// Metadata on a page of list entries
+//
+//	https://datatracker.ietf.org/doc/html/draft-ietf-netconf-list-pagination
+const ListPaginationNs = "urn:ietf:params:xml:ns:yang:ietf-list-pagination"
+
+// list-pagination input on get and get-config
+//
+//	https://datatracker.ietf.org/doc/html/draft-ietf-netconf-list-pagination-nc
+const ListPaginationNcNs = "urn:ietf:params:xml:ns:yang:ietf-list-pagination-nc"
+
+var listPaginationNsDecl = xml.Attr{Name: xml.Name{Local: "xmlns:lp"}, Value: ListPaginationNs}
+
+// remaining is allowed to be unknown when counting would mean reading the
+// rest of the list
+const remainingUnknown = -1
+
+func paginationError(reason string, msg string) *RpcError {
+	err := NewRpcError("application", "invalid-value", msg)
+	err.AppTag = "ietf-list-pagination:" + reason
+	return err
+}
+
+// pageParams are the checked list-pagination input
+type pageParams struct {
+	where     *xpath.Path
+	sortBy    string
+	backwards bool
+	cursor    string
+	offset    int
+
+	// less than zero is unbounded
+	limit int
+}
+
+func readPageParams(p *RpcListPagination) (*pageParams, error) {
+	params := &pageParams{
+		sortBy: strings.TrimSpace(p.SortBy),
+		cursor: strings.TrimSpace(p.Cursor),
+		limit:  -1,
+	}
+	if where := strings.TrimSpace(p.Where); where != "" {
+		var err error
+		if params.where, err = xpath.Parse(where); err != nil {
+			return nil, NewRpcError("protocol", "invalid-value", "where: "+err.Error())
+		}
+	}
+	switch dir := strings.TrimSpace(p.Direction); dir {
+	case "", "forwards":
+	case "backwards":
+		params.backwards = true
+	default:
+		return nil, NewRpcError("protocol", "invalid-value", fmt.Sprintf("direction '%s' not recognized", dir))
+	}
+	if offset := strings.TrimSpace(p.Offset); offset != "" {
+		n, err := strconv.ParseUint(offset, 10, 32)
+		if err != nil {
+			return nil, NewRpcError("protocol", "invalid-value", "offset: "+err.Error())
+		}
+		params.offset = int(n)
+	}
+	if limit := strings.TrimSpace(p.Limit); limit != "" && limit != "unbounded" {
+		n, err := strconv.ParseUint(limit, 10, 32)
+		if err != nil || n == 0 {
+			return nil, NewRpcError("protocol", "invalid-value", fmt.Sprintf("limit '%s' must be positive or unbounded", limit))
+		}
+		params.limit = int(n)
+	}
+	return params, nil
+}
+
+// pageEntry is just enough of a list entry to find a page w/o reading all
+// of every entry
+type pageEntry struct {
+	cursor  string
+	sortVal val.Value
+}
+
+// pageCursor is an opaque handle to a list entry from it's key
+func pageCursor(key []val.Value) string {
+	strs := make([]string, len(key))
+	for i, k := range key {
+		strs[i] = k.String()
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(strings.Join(strs, ",")))
+}
+
+// page of entries a client asked for
+type page struct {
+	entries []*pageEntry
+
+	// remainingUnknown when entries after page were not counted
+	remaining int
+
+	// cursor to entry just before and after page, empty at either end.
+	// Using previous with the opposite direction gets the previous page.
+	previous string
+	next     string
+}
+
+// handleGetPage is get or get-config of just some entries of a list
+func (ses *Session) handleGetPage(ctx context.Context, get *RpcGet, resp *RpcReply, c node.ContentConstraint) error {
+	p, err := readPageParams(get.Pagination)
+	if err != nil {
+		return err
+	}
+	if get.Filter == nil || get.Filter.Type != "xpath" {
+		return NewRpcError("protocol", "invalid-value", "list-pagination requires an xpath filter that selects a list")
+	}
+	sels, err := readFilter(ctx, ses.dev, get.Filter, c)
+	if err != nil {
+		return err
+	}
+	if err := limitDepth(get, sels); err != nil {
+		return err
+	}
+	resp.Data = &RpcData{}
+	if len(sels) == 0 {
+		return nil
+	}
+	sel := sels[0]
+	if !meta.IsList(sel.Meta()) || sel.InsideList {
+		return NewRpcError("protocol", "invalid-value", "list-pagination requires an xpath filter that selects a list")
+	}
+	var pg *page
+	if p.inListOrder() {
+		if pg, err = p.rangedPage(sel); err != nil {
+			return err
+		}
+	} else {
+		if p.where != nil {
+			if err := checkWhere(sel.Meta().(meta.HasDefinitions), p.where); err != nil {
+				return NewRpcError("protocol", "invalid-value", "where: "+err.Error())
+			}
+		}
+		entries, err := p.entries(sel)
+		if err != nil {
+			return err
+		}
+		if pg, err = p.page(entries); err != nil {
+			return err
+		}
+	}
+	items, err := encodePage(sel, pg)
+	if err != nil {
+		return err
+	}
+	data, err := xml.Marshal(pageHolder(sel, items))
+	if err != nil {
+		return err
+	}
+	resp.Data.Content = string(data)
+	return nil
+}
+
+// inListOrder is when page can be found by position in list w/o looking at
+// every entry
+func (p *pageParams) inListOrder() bool {
+	return p.where == nil && p.sortBy == "" && p.cursor == "" && !p.backwards
+}
+
+// pageRange is node.ListRange for just the list being paged so entries
+// before page are skipped w/o reading them and reading stops after page
+type pageRange struct {
+	list  *node.Selection
+	start int64
+
+	// -1 is unbounded
+	end int64
+}
+
+func (r *pageRange) CheckListPreConstraints(req *node.ListRequest) (bool, error) {
+	if req.IsNavigation() || req.Selection != r.list {
+		return true, nil
+	}
+	if req.First {
+		req.SetStartRow(r.start)
+		req.SetRow(r.start)
+	} else if r.end >= 0 && req.Row64 >= r.end {
+		return false, nil
+	}
+	return true, nil
+}
+
+// rangedPage reads keys of just the entries on page plus the entries either
+// side for the cursors. Range is left on the list for reading page.
+func (p *pageParams) rangedPage(sel *node.Selection) (*page, error) {
+	r := &pageRange{list: sel, start: int64(p.offset), end: -1}
+	if p.offset > 0 {
+		r.start--
+	}
+	if p.limit >= 0 {
+		r.end = int64(p.offset + p.limit + 1)
+	}
+	sel.Constraints.AddConstraint("list-pagination", 10, 50, r)
+	var entries []*pageEntry
+	item, err := sel.First()
+	for ; item.Selection != nil && err == nil; item, err = item.Next() {
+		entries = append(entries, &pageEntry{cursor: pageCursor(item.Key)})
+	}
+	if err != nil {
+		return nil, err
+	}
+	pg := &page{}
+	if p.offset > 0 {
+		if len(entries) == 0 {
+			return nil, paginationError("offset-out-of-range", fmt.Sprintf("offset %d is beyond last entry", p.offset))
+		}
+		pg.previous = entries[0].cursor
+		entries = entries[1:]
+	}
+	if p.limit >= 0 && len(entries) > p.limit {
+		pg.next = entries[p.limit].cursor
+		pg.remaining = remainingUnknown
+		entries = entries[:p.limit]
+	}
+	pg.entries = entries
+	return pg, nil
+}
+
+// entries are the list entries where selects in the order client asked for.
+// Only keys and the sort value are kept in memory.
+func (p *pageParams) entries(sel *node.Selection) ([]*pageEntry, error) {
+	var entries []*pageEntry
+	item, err := sel.First()
+	for ; item.Selection != nil && err == nil; item, err = item.Next() {
+		if p.where != nil {
+			found, err := whereMatches(item.Selection, p.where)
+			if err != nil {
+				return nil, NewRpcError("protocol", "invalid-value", "where: "+err.Error())
+			}
+			if !found {
+				continue
+			}
+		}
+		e := &pageEntry{cursor: pageCursor(item.Key)}
+		if p.sortBy != "" {
+			found, err := item.Selection.Find(p.sortBy)
+			if err != nil {
+				return nil, NewRpcError("protocol", "invalid-value", "sort-by: "+err.Error())
+			}
+			if found != nil {
+				if e.sortVal, err = found.Get(); err != nil {
+					return nil, err
+				}
+			}
+		}
+		entries = append(entries, e)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if p.sortBy != "" {
+		sort.SliceStable(entries, func(i, j int) bool {
+			return compareSortVals(entries[i].sortVal, entries[j].sortVal) < 0
+		})
+	}
+	if p.backwards {
+		for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+			entries[i], entries[j] = entries[j], entries[i]
+		}
+	}
+	return entries, nil
+}
+
+// checkWhere makes sure where is something XPredicate can evaluate on every
+// entry: containers down to a leaf compared to a value
+func checkWhere(list meta.HasDefinitions, where *xpath.Path) error {
+	parent := list
+	for seg := where; seg != nil; seg = seg.Next {
+		m := meta.Find(parent, seg.Ident)
+		if m == nil {
+			return fmt.Errorf("'%s' not found", seg.Ident)
+		}
+		if meta.IsContainer(m) && seg.Expr == nil {
+			parent = m.(meta.HasDefinitions)
+			continue
+		}
+		if _, isLeaf := m.(*meta.Leaf); !isLeaf || seg.Next != nil {
+			return fmt.Errorf("'%s' is not a leaf to compare", seg.Ident)
+		}
+		oper, valid := seg.Expr.(*xpath.Operator)
+		if !valid {
+			return fmt.Errorf("'%s' is not compared to a value", seg.Ident)
+		}
+		switch oper.Oper {
+		case "=", "!=", "<", ">", "<=", ">=":
+			return nil
+		}
+		return fmt.Errorf("operator '%s' not supported", oper.Oper)
+	}
+	return errors.New("no leaf to compare")
+}
+
+// whereMatches is XPredicate except entries w/o a value to compare do not
+// match, like in XPath. Where has to pass checkWhere first.
+func whereMatches(entry *node.Selection, where *xpath.Path) (bool, error) {
+	sel, seg := entry, where
+	for ; seg.Next != nil; seg = seg.Next {
+		var err error
+		if sel, err = sel.Find(seg.Ident); sel == nil || err != nil {
+			return false, err
+		}
+	}
+	v, err := sel.GetValue(seg.Ident)
+	if v == nil || err != nil {
+		return false, err
+	}
+	if oper := seg.Expr.(*xpath.Operator).Oper; oper != "=" && oper != "!=" {
+		if _, valid := v.(val.Comparable); !valid {
+			return false, fmt.Errorf("'%s' cannot be compared with %s", seg.Ident, oper)
+		}
+	}
+	return entry.XPredicate(where)
+}
+
+// compareSortVals orders entries w/o a sort value last
+func compareSortVals(a val.Value, b val.Value) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return 1
+	case b == nil:
+		return -1
+	}
+	if ca, valid := a.(val.Comparable); valid {
+		if cb, valid := b.(val.Comparable); valid {
+			return ca.Compare(cb)
+		}
+	}
+	return strings.Compare(a.String(), b.String())
+}
+
+func (p *pageParams) page(entries []*pageEntry) (*page, error) {
+	start := 0
+	if p.cursor != "" {
+		start = -1
+		for i, e := range entries {
+			if e.cursor == p.cursor {
+				start = i
+				break
+			}
+		}
+		if start < 0 {
+			return nil, paginationError("cursor-not-found", "no entry for cursor")
+		}
+	}
+	start += p.offset
+	if start > len(entries) {
+		return nil, paginationError("offset-out-of-range", fmt.Sprintf("offset %d is beyond last entry", p.offset))
+	}
+	end := len(entries)
+	if p.limit >= 0 && start+p.limit < end {
+		end = start + p.limit
+	}
+	pg := &page{entries: entries[start:end], remaining: len(entries) - end}
+	if start > 0 {
+		pg.previous = entries[start-1].cursor
+	}
+	if end < len(entries) {
+		pg.next = entries[end].cursor
+	}
+	return pg, nil
+}
+
+// encodePage reads the entries on the page, ignoring all others, with
+// pagination metadata on the first and last entry
+func encodePage(sel *node.Selection, pg *page) ([]*annotatedElem, error) {
+	pos := make(map[string]int, len(pg.entries))
+	for i, e := range pg.entries {
+		pos[e.cursor] = i
+	}
+	items := make([]*annotatedElem, len(pg.entries))
+	found := 0
+	item, err := sel.First()
+	for ; item.Selection != nil && err == nil && found < len(items); item, err = item.Next() {
+		i, onPage := pos[pageCursor(item.Key)]
+		if !onPage {
+			continue
+		}
+		w := &nodeutil.XMLWtr2{XMLName: nodeutil.XmlName(sel.Meta())}
+		if err := item.Selection.UpsertInto(w); err != nil {
+			return nil, err
+		}
+		for _, child := range w.Elem {
+			// entry's namespace is inherited like everything below
+			// children
+			if child.XMLName.Space == w.XMLName.Space {
+				child.XMLName.Space = ""
+			}
+		}
+		content, err := xml.Marshal(w.Elem)
+		if err != nil {
+			return nil, err
+		}
+		items[i] = &annotatedElem{XMLName: w.XMLName, Content: string(content)}
+		found++
+	}
+	if err != nil {
+		return nil, err
+	}
+	if found < len(items) {
+		return nil, fmt.Errorf("list changed while reading page")
+	}
+	if len(items) == 0 {
+		return items, nil
+	}
+	first, last := items[0], items[len(items)-1]
+	if pg.previous != "" {
+		first.Attr = append(first.Attr, xml.Attr{Name: xml.Name{Local: "lp:previous"}, Value: pg.previous})
+	}
+	remaining := "unknown"
+	if pg.remaining != remainingUnknown {
+		remaining = strconv.Itoa(pg.remaining)
+	}
+	last.Attr = append(last.Attr, xml.Attr{Name: xml.Name{Local: "lp:remaining"}, Value: remaining})
+	if pg.next != "" {
+		last.Attr = append(last.Attr, xml.Attr{Name: xml.Name{Local: "lp:next"}, Value: pg.next})
+	}
+	return items, nil
+}
+
+// pageHolder puts entries under the module and whatever the list is in so
+// client can tell where the page is from
+func pageHolder(sel *node.Selection, items []*annotatedElem) *annotatedElem {
+	mod := meta.OriginalModule(sel.Meta())
+	holder := &annotatedElem{
+		XMLName: xml.Name{Space: mod.Namespace(), Local: mod.Ident()},
+		Attr:    []xml.Attr{listPaginationNsDecl},
+	}
+	parent := holder
+	segs := sel.Path.Segments()
+	for i := 1; i < len(segs)-1; i++ {
+		seg := segs[i]
+		if segs[i+1].Meta == seg.Meta {
+			// list and then the item in the list
+			continue
+		}
+		e := &annotatedElem{XMLName: xml.Name{Local: seg.Meta.Ident()}}
+		if l, isList := seg.Meta.(*meta.List); isList {
+			for j, k := range l.KeyMeta() {
+				if j < len(seg.Key) {
+					e.Content += textElem(k.Ident(), seg.Key[j].String())
+				}
+			}
+		}
+		parent.Elem = append(parent.Elem, e)
+		parent = e
+	}
+	parent.Elem = append(parent.Elem, items...)
+	return holder
+}
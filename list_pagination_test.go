@@ -0,0 +1,62 @@
+package netconf
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/freeconf/yang/fc"
+	"github.com/freeconf/yang/nodeutil"
+)
+
+func TestListPagination(t *testing.T) {
+	car := &originCar{
+		Tire: []*originTire{{Pos: 0, Size: "16"}, {Pos: 1, Size: "14"}, {Pos: 2, Size: "15"}, {Pos: 3, Size: "17"}},
+	}
+	d, s := newTestServer(t, &nodeutil.Node{Object: car})
+	rt := newRpcTester(t, s, d)
+	getConfig := func(filter string, params string) {
+		t.Helper()
+		assertPageKeys(t, rt.send(`<get-config><source><running/></source>`+
+			filter+`<list-pagination xmlns="urn:ietf:params:xml:ns:yang:ietf-list-pagination-nc">`+params+`</list-pagination></get-config>`))
+	}
+	tires := `<filter type="xpath" xmlns:c="c" select="c:car/tire"/>`
+
+	// in list order
+	getConfig(tires, `<limit>2</limit>`)
+	getConfig(tires, `<offset>1</offset><limit>2</limit>`)
+	getConfig(tires, `<offset>3</offset>`)
+
+	// cursor is base64 of key
+	getConfig(tires, `<cursor>Mg</cursor><limit>2</limit>`)
+	getConfig(tires, `<direction>backwards</direction><offset>1</offset><limit>1</limit>`)
+	getConfig(tires, `<sort-by>size</sort-by>`)
+	getConfig(tires, `<where>pos&gt;1</where>`)
+
+	getConfig(tires, `<where>bogus&gt;1</where>`)
+	getConfig(tires, `<where>pos</where>`)
+	getConfig(tires, `<offset>5</offset>`)
+	getConfig(tires, `<cursor>bogus</cursor>`)
+	getConfig(`<filter><car xmlns="c"><tire/></car></filter>`, `<limit>1</limit>`)
+	rt.gold("testdata/gold/list-pagination.xml")
+}
+
+func TestListPaginationWhereMissingValue(t *testing.T) {
+	d, s := newTestServer(t, readJson(`{"tire":[{"pos":1},{"pos":2,"wear":1.5}]}`))
+	rt := newRpcTester(t, s, d)
+	reply := rt.send(`<get><filter type="xpath" xmlns:c="c" select="c:car/tire"/>` +
+		`<list-pagination xmlns="urn:ietf:params:xml:ns:yang:ietf-list-pagination-nc"><where>wear&gt;1</where></list-pagination></get>`)
+	fc.AssertEqual(t, 1, strings.Count(reply, "<tire "), reply)
+	assertPageKeys(t, reply)
+	rt.gold("testdata/gold/list-pagination-where.xml")
+}
+
+var pageEntryElem = regexp.MustCompile(`<tire(?: [^>]*)?>(<[^>]*>)?`)
+
+// assertPageKeys checks every entry on page starts with it's key
+func assertPageKeys(t *testing.T, reply string) {
+	t.Helper()
+	for _, entry := range pageEntryElem.FindAllStringSubmatch(reply, -1) {
+		fc.AssertEqual(t, "<pos>", entry[1], reply)
+	}
+}
@@ -1,6 +1,7 @@
 package netconf
 
 import (
+	"context"
 	"fmt"
 	"time"
 
@@ -30,13 +31,49 @@ type MsgLeaf struct {
 type RpcReply struct {
 	XMLName   xml.Name            `xml:"urn:ietf:params:xml:ns:netconf:base:1.0 rpc-reply"`
 	MessageId string              `xml:"message-id,attr"`
+	Errors    []*RpcError         `xml:"rpc-error,omitempty"`
 	OK        *Msg                `xml:"ok,omitempty"`
 	Data      *RpcData            `xml:"data,omitempty"`
 	Out       []*nodeutil.XMLWtr2 `xml:",any"`
 }
 
+// RpcError is both a go error and it's reporting in an rpc-reply.  Handlers
+// return this when the client should be told why an operation failed and the
+// session should stay open.
+//
+//	https://datatracker.ietf.org/doc/html/rfc6241#section-4.3
+type RpcError struct {
+	Type     string `xml:"error-type"`
+	Tag      string `xml:"error-tag"`
+	Severity string `xml:"error-severity"`
+	AppTag   string `xml:"error-app-tag,omitempty"`
+	Path     string `xml:"error-path,omitempty"`
+	Message  string `xml:"error-message,omitempty"`
+	Info     *Msg   `xml:"error-info,omitempty"`
+}
+
+func (e *RpcError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("%s: %s", e.Tag, e.Message)
+	}
+	return e.Tag
+}
+
+// NewRpcError is an error of severity "error"
+func NewRpcError(errType string, tag string, msg string) *RpcError {
+	return &RpcError{
+		Type:     errType,
+		Tag:      tag,
+		Severity: "error",
+		Message:  msg,
+	}
+}
+
 type RpcData struct {
 	Nodes []*nodeutil.XMLWtr2
+
+	// already encoded data like a page of a list with it's metadata
+	Content string `xml:",innerxml"`
 }
 
 type HelloMsg struct {
@@ -55,11 +92,15 @@ type RpcMsg struct {
 	Copy               *RpcCopy            `xml:"copy-config,omitempty"`
 	Delete             *RpcEdit            `xml:"delete-config,omitempty"`
 	Close              *Msg                `xml:"close-session,omitempty"`
-	Kill               *Msg                `xml:"kill-session,omitempty"`
+	Kill               *RpcKill            `xml:"kill-session,omitempty"`
 	CreateSubscription *CreateSubscription `xml:"create-subscription,omitempty"`
 	Action             *nodeutil.XmlNode   `xml:",any"`
 }
 
+type RpcKill struct {
+	SessionId int64 `xml:"session-id"`
+}
+
 type CreateSubscription struct {
 	StartTime *time.Time `xml:"startTime,omitempty"`
 	StopTime  *time.Time `xml:"stopTime,omitempty"`
@@ -94,8 +135,26 @@ type RpcSource struct {
 }
 
 type RpcGet struct {
-	Source *Msg       `xml:"source,omitempty"`
-	Filter *RpcFilter `xml:"filter,omitempty"`
+	Source     *Msg               `xml:"source,omitempty"`
+	Filter     *RpcFilter         `xml:"filter,omitempty"`
+	Pagination *RpcListPagination `xml:"urn:ietf:params:xml:ns:yang:ietf-list-pagination-nc list-pagination,omitempty"`
+
+	// fc-netconf max-depth extension to only read so many levels below each
+	// selection
+	MaxDepth string `xml:"org.freeconf/restconf max-depth,attr,omitempty"`
+}
+
+// RpcListPagination asks for a page of the list the filter selects.  Values
+// are checked when the page is read so client gets an rpc-error.
+//
+//	https://datatracker.ietf.org/doc/html/draft-ietf-netconf-list-pagination-nc
+type RpcListPagination struct {
+	Where     string `xml:"where,omitempty"`
+	SortBy    string `xml:"sort-by,omitempty"`
+	Direction string `xml:"direction,omitempty"`
+	Cursor    string `xml:"cursor,omitempty"`
+	Offset    string `xml:"offset,omitempty"`
+	Limit     string `xml:"limit,omitempty"`
 }
 
 type RpcFilter struct {
@@ -140,6 +199,12 @@ func deviceNamespaces(d device.Device, shortcodes map[string]string) xpath.Short
 }
 
 func (f *RpcFilter) CompileXPath(d device.Device) (*node.Selection, error) {
+	return f.CompileXPathWithContext(context.Background(), d)
+}
+
+// CompileXPathWithContext is CompileXPath with selection carrying given
+// context
+func (f *RpcFilter) CompileXPathWithContext(ctx context.Context, d device.Device) (*node.Selection, error) {
 	if f.Type == "xpath" && f.Select != "" {
 		lookup := deviceNamespaces(d, f.shortcodes)
 		top, err := xpath.Parse2(lookup, f.Select)
@@ -150,7 +215,13 @@ func (f *RpcFilter) CompileXPath(d device.Device) (*node.Selection, error) {
 		if err != nil {
 			return nil, err
 		}
-		root := b.Root()
+		if b == nil {
+			return nil, NewRpcError("protocol", "invalid-value", fmt.Sprintf("module '%s' not found", top.Ident))
+		}
+		if err := checkXPathSegments(b.Meta, top.Next); err != nil {
+			return nil, err
+		}
+		root := b.RootWithContext(ctx)
 		if top.Next == nil {
 			return root, nil
 		}
@@ -163,7 +234,9 @@ func (rf *RpcFilter) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error
 	copy := struct {
 		Type   string `xml:"type,attr"`
 		Select string `xml:"select,omitempty"`
-		Elems  []*Msg `xml:",any"`
+		// RFC 6241 Sec. 8.9.1 has select as an attribute
+		SelectAttr string `xml:"select,attr"`
+		Elems      []*Msg `xml:",any"`
 	}{}
 	if err := d.DecodeElement(&copy, &start); err != nil {
 		return err
@@ -171,5 +244,17 @@ func (rf *RpcFilter) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error
 	rf.Elems = copy.Elems
 	rf.Type = copy.Type
 	rf.Select = copy.Select
+	if copy.SelectAttr != "" {
+		rf.Select = copy.SelectAttr
+	}
+	// prefixes used in select
+	for _, a := range start.Attr {
+		if a.Name.Space == "xmlns" {
+			if rf.shortcodes == nil {
+				rf.shortcodes = make(map[string]string)
+			}
+			rf.shortcodes[a.Name.Local] = a.Value
+		}
+	}
 	return nil
 }
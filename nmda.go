@@ -0,0 +1,257 @@
+package netconf
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/freeconf/yang/meta"
+	"github.com/freeconf/yang/node"
+	"github.com/freeconf/yang/nodeutil"
+	"github.com/freeconf/yang/patch/xml"
+)
+
+// Operations on a datastore named by it's identity instead of get and
+// get-config implying one
+//
+//	https://datatracker.ietf.org/doc/html/rfc8526
+const NmdaNs = "urn:ietf:params:xml:ns:yang:ietf-netconf-nmda"
+
+// datastoreData is the part of data that is in datastore.  There are no
+// templates or inactive config so intended is the same as running.
+func datastoreData(datastore string) (node.ContentConstraint, error) {
+	switch datastore {
+	case "running", "intended":
+		return node.ContentConfig, nil
+	case "operational":
+		// config and state, freeconf's operational is only state
+		return node.ContentAll, nil
+	case "candidate", "startup":
+		return 0, NewRpcError("application", "invalid-value", fmt.Sprintf("datastore '%s' not supported", datastore))
+	}
+	return 0, NewRpcError("protocol", "invalid-value", fmt.Sprintf("unknown datastore '%s'", datastore))
+}
+
+// getDataParams are the input of get-data
+type getDataParams struct {
+	datastore    string
+	filter       *RpcFilter
+	configFilter *bool
+	// 0 is unbounded
+	maxDepth     int
+	withOrigin   bool
+	originFilter *originFilter
+	withDefaults string
+}
+
+func readGetDataParams(op *nodeutil.XmlNode) (*getDataParams, error) {
+	p := &getDataParams{}
+	for _, n := range op.Nodes {
+		content := strings.TrimSpace(string(n.Content))
+		switch n.XMLName.Local {
+		case "datastore":
+			p.datastore = identityName(content)
+		case "xpath-filter":
+			p.filter = xpathFilterParam(op, n)
+		case "subtree-filter":
+			f, _, err := subtreeFilterParam(n)
+			if err != nil {
+				return nil, err
+			}
+			p.filter = f
+		case "config-filter":
+			config, err := strconv.ParseBool(content)
+			if err != nil {
+				return nil, NewRpcError("protocol", "invalid-value", fmt.Sprintf("bad config-filter '%s'", content))
+			}
+			p.configFilter = &config
+		case "max-depth":
+			if content == "unbounded" {
+				continue
+			}
+			depth, err := strconv.ParseUint(content, 10, 16)
+			if err != nil || depth == 0 {
+				return nil, NewRpcError("protocol", "invalid-value", fmt.Sprintf("bad max-depth '%s'", content))
+			}
+			p.maxDepth = int(depth)
+		case "with-origin":
+			p.withOrigin = true
+		case "origin-filter", "negated-origin-filter":
+			negated := n.XMLName.Local == "negated-origin-filter"
+			if p.originFilter == nil {
+				p.originFilter = &originFilter{origins: make(map[Origin]bool), negated: negated}
+			} else if p.originFilter.negated != negated {
+				return nil, NewRpcError("protocol", "invalid-value", "origin-filter and negated-origin-filter cannot both be given")
+			}
+			p.originFilter.origins[Origin(identityName(content))] = true
+		case "with-defaults":
+			p.withDefaults = content
+		}
+	}
+	if p.datastore == "" {
+		return nil, NewRpcError("protocol", "missing-element", "datastore required")
+	}
+	return p, nil
+}
+
+// handleGetData reads data from any datastore
+func (ses *Session) handleGetData(ctx context.Context, req *RpcRequest, reply *RpcReply) error {
+	p, err := readGetDataParams(req.Op)
+	if err != nil {
+		return err
+	}
+	content, err := datastoreData(p.datastore)
+	if err != nil {
+		return err
+	}
+	if (p.withOrigin || p.originFilter != nil) && p.datastore != "operational" {
+		return NewRpcError("protocol", "invalid-value", "origin only applies to operational datastore")
+	}
+	data := &nodeutil.XMLWtr2{XMLName: xml.Name{Space: NmdaNs, Local: "data"}}
+	reply.Out = []*nodeutil.XMLWtr2{data}
+	if p.configFilter != nil {
+		if *p.configFilter {
+			content = node.ContentConfig
+		} else if content == node.ContentConfig {
+			// there is no state in a configuration datastore
+			return nil
+		} else {
+			content = node.ContentOperational
+		}
+	}
+	var defaults *node.WithDefaults
+	if p.withDefaults != "" {
+		wd, err := node.NewWithDefaultsConstraint(p.withDefaults)
+		if err != nil {
+			return NewRpcError("protocol", "invalid-value", fmt.Sprintf("with-defaults '%s' not supported", p.withDefaults))
+		}
+		defaults = &wd
+	}
+	sels, err := readFilter(ctx, ses.dev, p.filter, content)
+	if err != nil {
+		return err
+	}
+	for _, sel := range sels {
+		if p.maxDepth > 0 {
+			sel.Constraints.AddConstraint("depth", 10, 50, newMaxDepthStubs(sel, p.maxDepth))
+		}
+		if defaults != nil {
+			sel.Constraints.AddConstraint("with-defaults", 50, 70, *defaults)
+		}
+	}
+	if !p.withOrigin && p.originFilter == nil {
+		data.Elem, err = encodeSelections(sels)
+		return err
+	}
+	elems, err := encodeSelectionsWithOrigin(sels, p.originFilter, p.withOrigin)
+	if err != nil {
+		return err
+	}
+	annotated, err := xml.Marshal(elems)
+	if err != nil {
+		return err
+	}
+	data.Content = string(annotated)
+	return nil
+}
+
+// handleEditData edits any writable datastore
+func (ses *Session) handleEditData(ctx context.Context, req *RpcRequest, reply *RpcReply) error {
+	var datastore string
+	var config *nodeutil.XmlNode
+	defaultOp := "merge"
+	for _, n := range req.Op.Nodes {
+		content := strings.TrimSpace(string(n.Content))
+		switch n.XMLName.Local {
+		case "datastore":
+			datastore = identityName(content)
+		case "default-operation":
+			defaultOp = content
+		case "config":
+			config = n
+		case "url":
+			return NewRpcError("application", "operation-not-supported", "url not supported")
+		}
+	}
+	if datastore == "" {
+		return NewRpcError("protocol", "missing-element", "datastore required")
+	}
+	if _, err := datastoreData(datastore); err != nil {
+		return err
+	}
+	if datastore != "running" {
+		return NewRpcError("protocol", "invalid-value", fmt.Sprintf("datastore '%s' is not writable", datastore))
+	}
+	switch defaultOp {
+	case "merge", "replace", "none":
+	default:
+		return NewRpcError("protocol", "invalid-value", fmt.Sprintf("bad default-operation '%s'", defaultOp))
+	}
+	if config == nil {
+		return NewRpcError("protocol", "missing-element", "config required")
+	}
+	if err := ses.editDatastore(ctx, defaultOp, config); err != nil {
+		return err
+	}
+	reply.OK = &Msg{}
+	return nil
+}
+
+// maxDepth is node.MaxDepth counted like NMDA max-depth where selected node
+// is level 1 unless it is a module, then it's top-level data nodes are.
+type maxDepth struct {
+	node.MaxDepth
+
+	// node.MaxDepth always allows children of selected node
+	none bool
+}
+
+func newMaxDepth(sel *node.Selection, depth int) maxDepth {
+	if _, isModule := sel.Meta().(*meta.Module); isModule {
+		return maxDepth{MaxDepth: node.MaxDepth{MaxDepth: depth}}
+	}
+	return maxDepth{MaxDepth: node.MaxDepth{MaxDepth: depth - 1}, none: depth <= 1}
+}
+
+func (md maxDepth) CheckContainerPreConstraints(r *node.ChildRequest) (bool, error) {
+	if md.none && !r.IsNavigation() {
+		return false, nil
+	}
+	return md.MaxDepth.CheckContainerPreConstraints(r)
+}
+
+func (md maxDepth) CheckFieldPreConstraints(r *node.FieldRequest, hnd *node.ValueHandle) (bool, error) {
+	if md.none && !r.IsNavigation() {
+		return false, nil
+	}
+	return md.MaxDepth.CheckFieldPreConstraints(r, hnd)
+}
+
+// maxDepthStubs limits depth for get-data and for max-depth on get and
+// get-config.  It is like maxDepth but containers one level deeper are still
+// there, just empty, and list entries one level deeper only have their keys
+// so client knows there is more to explore and how to get to it
+type maxDepthStubs struct {
+	fields     maxDepth
+	containers maxDepth
+}
+
+func newMaxDepthStubs(sel *node.Selection, depth int) maxDepthStubs {
+	return maxDepthStubs{
+		fields:     newMaxDepth(sel, depth),
+		containers: newMaxDepth(sel, depth+1),
+	}
+}
+
+func (md maxDepthStubs) CheckContainerPreConstraints(r *node.ChildRequest) (bool, error) {
+	return md.containers.CheckContainerPreConstraints(r)
+}
+
+func (md maxDepthStubs) CheckFieldPreConstraints(r *node.FieldRequest, hnd *node.ValueHandle) (bool, error) {
+	if !r.IsNavigation() && r.Selection.InsideList && isKey(r.Selection.Meta(), r.Meta.Ident()) {
+		// list entries are not identifiable w/o their keys
+		return true, nil
+	}
+	return md.fields.CheckFieldPreConstraints(r, hnd)
+}
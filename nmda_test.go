@@ -0,0 +1,38 @@
+package netconf
+
+import (
+	"testing"
+
+	"github.com/freeconf/restconf/testdata"
+)
+
+func TestNmda(t *testing.T) {
+	d, s := newTestServer(t, testdata.Manage(testdata.New()))
+	rt := newRpcTester(t, s, d)
+	getData := func(params string) {
+		t.Helper()
+		rt.send(`<get-data xmlns="urn:ietf:params:xml:ns:yang:ietf-netconf-nmda" xmlns:ds="urn:ietf:params:xml:ns:yang:ietf-datastores">` + params + `</get-data>`)
+	}
+	editData := func(params string) {
+		t.Helper()
+		rt.send(`<edit-data xmlns="urn:ietf:params:xml:ns:yang:ietf-netconf-nmda" xmlns:ds="urn:ietf:params:xml:ns:yang:ietf-datastores">` + params + `</edit-data>`)
+	}
+
+	editData(`<datastore>ds:running</datastore><config><car xmlns="c"><speed>10</speed><tire><pos>1</pos><size>15</size></tire></car></config>`)
+	editData(`<datastore>ds:operational</datastore><config><car xmlns="c"><speed>20</speed></car></config>`)
+	editData(`<datastore>ds:running</datastore><default-operation>none</default-operation><config><car xmlns="c"><speed>20</speed></car></config>`)
+
+	getData(`<datastore>ds:running</datastore><subtree-filter><car xmlns="c"><speed/><miles/><tire/></car></subtree-filter>`)
+	getData(`<datastore>ds:operational</datastore><subtree-filter><car xmlns="c"><speed/><miles/><tire/></car></subtree-filter><config-filter>false</config-filter>`)
+	getData(`<datastore>ds:running</datastore><config-filter>false</config-filter>`)
+	getData(`<datastore>ds:intended</datastore><xpath-filter xmlns:c="c">c:car/tire</xpath-filter><with-defaults>trim</with-defaults>`)
+
+	getData(`<datastore>ds:running</datastore><subtree-filter><car xmlns="c"><speed/><miles/><tire/></car></subtree-filter><max-depth>1</max-depth>`)
+	getData(`<datastore>ds:running</datastore><xpath-filter xmlns:c="c">c:car/tire</xpath-filter><max-depth>1</max-depth>`)
+	getData(`<datastore>ds:running</datastore><xpath-filter xmlns:c="c">c:car/tire</xpath-filter><max-depth>2</max-depth>`)
+
+	getData(`<datastore>ds:candidate</datastore>`)
+	getData(`<datastore>ds:running</datastore><with-origin/>`)
+	getData(`<subtree-filter><car xmlns="c"><speed/><miles/><tire/></car></subtree-filter>`)
+	rt.gold("testdata/gold/nmda.xml")
+}
@@ -0,0 +1,369 @@
+package netconf
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/freeconf/restconf/device"
+	"github.com/freeconf/yang/fc"
+	"github.com/freeconf/yang/meta"
+	"github.com/freeconf/yang/node"
+	"github.com/freeconf/yang/nodeutil"
+	"github.com/freeconf/yang/patch/xml"
+)
+
+// namespace of yang-patch in push-change-update
+//
+//	https://datatracker.ietf.org/doc/html/rfc8072
+const YangPatchNs = "urn:ietf:params:xml:ns:yang:ietf-yang-patch"
+
+// configChanges tells on-change subscriptions data was edited.  Triggers are
+// installed on a module's browser the first time there is a subscription so
+// edits from any source are seen, not just edit-config.
+type configChanges struct {
+	mu        sync.Mutex
+	installed map[*node.Browser]bool
+	listeners map[int]func()
+	last      int
+}
+
+// watch calls l after any edit to any module in dev until returned function
+// is called
+func (c *configChanges) watch(dev device.Device, l func()) (func(), error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.installed == nil {
+		c.installed = make(map[*node.Browser]bool)
+		c.listeners = make(map[int]func())
+	}
+	for name := range dev.Modules() {
+		b, err := dev.Browser(name)
+		if err != nil {
+			return nil, err
+		}
+		if b == nil || c.installed[b] {
+			continue
+		}
+		b.Triggers.Install(&node.Trigger{
+			OnEnd: func(*node.Trigger, node.NodeRequest) error {
+				c.changed()
+				return nil
+			},
+		})
+		c.installed[b] = true
+	}
+	c.last++
+	id := c.last
+	c.listeners[id] = l
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		delete(c.listeners, id)
+	}, nil
+}
+
+func (c *configChanges) changed() {
+	c.mu.Lock()
+	listeners := make([]func(), 0, len(c.listeners))
+	for _, l := range c.listeners {
+		listeners = append(listeners, l)
+	}
+	c.mu.Unlock()
+	for _, l := range listeners {
+		l()
+	}
+}
+
+func readOnChange(n *nodeutil.XmlNode, p *subscriptionParams) error {
+	p.onChange = true
+	p.syncOnStart = true
+	for _, c := range n.Nodes {
+		content := strings.TrimSpace(string(c.Content))
+		switch c.XMLName.Local {
+		case "dampening-period":
+			// centiseconds
+			cs, err := strconv.ParseUint(content, 10, 32)
+			if err != nil {
+				return NewRpcError("protocol", "invalid-value", fmt.Sprintf("bad dampening-period '%s'", content))
+			}
+			p.dampening = time.Duration(cs) * 10 * time.Millisecond
+		case "sync-on-start":
+			sync, err := strconv.ParseBool(content)
+			if err != nil {
+				return NewRpcError("protocol", "invalid-value", fmt.Sprintf("bad sync-on-start '%s'", content))
+			}
+			p.syncOnStart = sync
+		case "excluded-change":
+			p.excluded = append(p.excluded, content)
+		}
+	}
+	return nil
+}
+
+func onChangeElem(dampening time.Duration, syncOnStart bool) string {
+	content := textElem("dampening-period", strconv.FormatInt(int64(dampening/(10*time.Millisecond)), 10))
+	if !syncOnStart {
+		content += textElem("sync-on-start", "false")
+	}
+	return fmt.Sprintf(`<on-change xmlns="%s">%s</on-change>`, YangPushNs, content)
+}
+
+// snapshotNode is one data node in a snapshot of the selected data
+type snapshotNode struct {
+	elem   *nodeutil.XMLWtr2
+	parent string
+	leaf   bool
+	// definition elem is in
+	within meta.HasDefinitions
+}
+
+// snapshot is selected data by the path a yang-patch would use to target it
+type snapshot map[string]snapshotNode
+
+func (sub *Subscription) snapshot(content node.ContentConstraint) (snapshot, []*nodeutil.XMLWtr2, error) {
+	sub.mu.Lock()
+	selection := sub.selection
+	sub.mu.Unlock()
+	sels, err := readFilter(sub.ctx, sub.dev, selection, content)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := encodeSelections(sels)
+	if err != nil {
+		return nil, nil, err
+	}
+	return newSnapshot(sels, data), data, nil
+}
+
+// newSnapshot is data of each selection by path
+func newSnapshot(sels []*node.Selection, data []*nodeutil.XMLWtr2) snapshot {
+	snap := make(snapshot)
+	for i, sel := range sels {
+		if mod, isModule := sel.Meta().(*meta.Module); isModule {
+			snap.add("", mod.Ident()+":", mod, data[i].Elem)
+		} else {
+			base := instancePath(sel.Path)
+			snap[base] = snapshotNode{elem: data[i], within: sel.Meta().Parent().(meta.HasDefinitions)}
+			snap.add(base, "", sel.Meta().(meta.HasDefinitions), data[i].Elem)
+		}
+	}
+	return snap
+}
+
+func (snap snapshot) add(parentPath string, prefix string, parent meta.HasDefinitions, elems []*nodeutil.XMLWtr2) {
+	for _, e := range elems {
+		def := meta.Find(parent, e.XMLName.Local)
+		if def == nil {
+			continue
+		}
+		path := parentPath + "/" + prefix + def.Ident()
+		switch x := def.(type) {
+		case *meta.List:
+			var keys []string
+			for _, k := range x.KeyMeta() {
+				for _, child := range e.Elem {
+					if child.XMLName.Local == k.Ident() {
+						keys = append(keys, child.Content)
+					}
+				}
+			}
+			path += "=" + strings.Join(keys, ",")
+			snap[path] = snapshotNode{elem: e, parent: parentPath, within: parent}
+			snap.add(path, "", x, e.Elem)
+		case *meta.LeafList:
+			snap[path+"="+e.Content] = snapshotNode{elem: e, parent: parentPath, leaf: true, within: parent}
+		case meta.HasDefinitions:
+			snap[path] = snapshotNode{elem: e, parent: parentPath, within: parent}
+			snap.add(path, "", x, e.Elem)
+		default:
+			snap[path] = snapshotNode{elem: e, parent: parentPath, leaf: true, within: parent}
+		}
+	}
+}
+
+// instancePath is path of selection as a yang-patch target
+func instancePath(p *node.Path) string {
+	var buf strings.Builder
+	for i, seg := range p.Segments()[1:] {
+		buf.WriteString("/")
+		if i == 0 {
+			buf.WriteString(meta.OriginalModule(seg.Meta).Ident())
+			buf.WriteString(":")
+		}
+		buf.WriteString(seg.Meta.Ident())
+		if len(seg.Key) > 0 {
+			keys := make([]string, len(seg.Key))
+			for j, k := range seg.Key {
+				keys[j] = k.String()
+			}
+			buf.WriteString("=")
+			buf.WriteString(strings.Join(keys, ","))
+		}
+	}
+	return buf.String()
+}
+
+type patchEdit struct {
+	operation string
+	target    string
+	value     any
+	// data being replaced or deleted, only compare reports it
+	source any
+}
+
+// diff is edits that turn a into b.  Created or deleted data is a single
+// edit of the top-most node.
+func diff(a, b snapshot) []patchEdit {
+	var edits []patchEdit
+	for path, was := range a {
+		if _, found := b[path]; found {
+			continue
+		}
+		// deleting parent deletes this too
+		if _, parentFound := b[was.parent]; was.parent != "" && !parentFound {
+			continue
+		}
+		edits = append(edits, patchEdit{operation: "delete", target: path})
+	}
+	for path, is := range b {
+		was, found := a[path]
+		if !found {
+			// creating parent creates this too
+			if _, parentFound := a[is.parent]; is.parent != "" && !parentFound {
+				continue
+			}
+			edits = append(edits, patchEdit{operation: "create", target: path, value: is.elem})
+		} else if is.leaf && was.elem.Content != is.elem.Content {
+			edits = append(edits, patchEdit{operation: "replace", target: path, value: is.elem})
+		}
+	}
+	sort.Slice(edits, func(i, j int) bool {
+		return edits[i].target < edits[j].target
+	})
+	return edits
+}
+
+// yangPatch is edits as an RFC 8072 yang-patch
+func yangPatch(patchId string, edits []patchEdit) (string, error) {
+	var buf strings.Builder
+	fmt.Fprintf(&buf, `<yang-patch xmlns="%s">`, YangPatchNs)
+	buf.WriteString(textElem("patch-id", patchId))
+	for i, e := range edits {
+		buf.WriteString("<edit>")
+		buf.WriteString(textElem("edit-id", fmt.Sprintf("edit%d", i+1)))
+		buf.WriteString(textElem("operation", e.operation))
+		buf.WriteString(textElem("target", e.target))
+		if e.value != nil {
+			value, err := xml.Marshal(e.value)
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(&buf, "<value>%s</value>", value)
+		}
+		if e.source != nil {
+			source, err := xml.Marshal(e.source)
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(&buf, `<source-value xmlns="%s">%s</source-value>`, CompareNs, source)
+		}
+		buf.WriteString("</edit>")
+	}
+	buf.WriteString("</yang-patch>")
+	return buf.String(), nil
+}
+
+// startOnChange sends what changed in selected data after each edit but
+// no more often than dampening period
+func (sub *Subscription) startOnChange() error {
+	content, err := datastoreContent(sub.Datastore)
+	if err != nil {
+		return err
+	}
+	sub.mu.Lock()
+	dampening, syncOnStart := sub.dampening, sub.syncOnStart
+	excluded := make(map[string]bool)
+	for _, change := range sub.excluded {
+		excluded[change] = true
+	}
+	sub.mu.Unlock()
+	last, data, err := sub.snapshot(content)
+	if err != nil {
+		return err
+	}
+	var (
+		mu       sync.Mutex
+		checkMu  sync.Mutex
+		pending  bool
+		stopped  bool
+		timer    *time.Timer
+		lastSent time.Time
+		patches  int
+	)
+	check := func() {
+		checkMu.Lock()
+		defer checkMu.Unlock()
+		mu.Lock()
+		pending = false
+		mu.Unlock()
+		snap, _, err := sub.snapshot(content)
+		if err != nil {
+			fc.Debug.Printf("could not read datastore for subscription %d. %s", sub.Id, err)
+			return
+		}
+		var edits []patchEdit
+		for _, e := range diff(last, snap) {
+			if !excluded[e.operation] {
+				edits = append(edits, e)
+			}
+		}
+		last = snap
+		if len(edits) == 0 {
+			return
+		}
+		patches++
+		patch, err := yangPatch(strconv.Itoa(patches), edits)
+		if err != nil {
+			fc.Debug.Printf("could not encode changes for subscription %d. %s", sub.Id, err)
+			return
+		}
+		mu.Lock()
+		lastSent = time.Now()
+		mu.Unlock()
+		update := &nodeutil.XMLWtr2{
+			XMLName: xml.Name{Space: YangPushNs, Local: "push-change-update"},
+			Content: textElem("id", strconv.FormatUint(uint64(sub.Id), 10)) +
+				"<datastore-changes>" + patch + "</datastore-changes>",
+		}
+		sub.deliver(&Notification{EventTime: time.Now(), Elems: []*nodeutil.XMLWtr2{update}})
+	}
+	unwatch, err := sub.mgr.Subscriptions().changes.watch(sub.dev, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if pending || stopped {
+			return
+		}
+		pending = true
+		timer = time.AfterFunc(time.Until(lastSent.Add(dampening)), check)
+	})
+	if err != nil {
+		return err
+	}
+	if syncOnStart {
+		sub.deliver(sub.pushUpdateMsg(data))
+	}
+	sub.setStop(func() {
+		unwatch()
+		mu.Lock()
+		defer mu.Unlock()
+		stopped = true
+		if timer != nil {
+			timer.Stop()
+		}
+	})
+	return nil
+}
@@ -0,0 +1,292 @@
+package netconf
+
+import (
+	"context"
+
+	"github.com/freeconf/yang/meta"
+	"github.com/freeconf/yang/node"
+	"github.com/freeconf/yang/nodeutil"
+	"github.com/freeconf/yang/patch/xml"
+	"github.com/freeconf/yang/val"
+)
+
+// namespace of origin annotation on data in operational datastore
+//
+//	https://datatracker.ietf.org/doc/html/rfc8342#section-7.4
+const OriginNs = "urn:ietf:params:xml:ns:yang:ietf-origin"
+
+// Origin is where data in operational datastore came from
+type Origin string
+
+const (
+	// configured and in effect
+	OriginIntended = Origin("intended")
+
+	// from a protocol like dhcp or a routing protocol
+	OriginLearned = Origin("learned")
+
+	// created by system itself like a loopback interface
+	OriginSystem = Origin("system")
+
+	// value used in absence of configuration
+	OriginDefault = Origin("default")
+
+	// origin could not be determined
+	OriginUnknown = Origin("unknown")
+)
+
+// OriginReporter tells where data came from.  Either a node can implement
+// this or the object a node peeks at like the struct behind a nodeutil.Node.
+// Data w/o an origin has the origin of it's parent.
+type OriginReporter interface {
+	// Origin of leaf m or of the data node itself when m is nil.  Empty
+	// origin is same as parent.
+	Origin(m meta.Leafable) Origin
+}
+
+func originReporter(sel *node.Selection) OriginReporter {
+	if r, valid := sel.Node.(OriginReporter); valid {
+		return r
+	}
+	if r, valid := sel.Peek(nil).(OriginReporter); valid {
+		return r
+	}
+	return nil
+}
+
+// originWtr writes data like XMLWtr2 and notes the origin of each element
+// that reported one
+type originWtr struct {
+	elem    *nodeutil.XMLWtr2
+	origins map[*nodeutil.XMLWtr2]Origin
+}
+
+func (w *originWtr) child(elem *nodeutil.XMLWtr2) *originWtr {
+	return &originWtr{elem: elem, origins: w.origins}
+}
+
+func (w *originWtr) report(elem *nodeutil.XMLWtr2, from *node.Selection, m meta.Leafable) {
+	if from == nil {
+		return
+	}
+	if r := originReporter(from); r != nil {
+		if origin := r.Origin(m); origin != "" {
+			w.origins[elem] = origin
+		}
+	}
+}
+
+func (w *originWtr) Child(r node.ChildRequest) (node.Node, error) {
+	child, err := w.elem.Child(r)
+	if child == nil || err != nil {
+		return child, err
+	}
+	return w.child(child.(*nodeutil.XMLWtr2)), nil
+}
+
+func (w *originWtr) Next(r node.ListRequest) (node.Node, []val.Value, error) {
+	child, key, err := w.elem.Next(r)
+	if child == nil || err != nil {
+		return child, key, err
+	}
+	elem := child.(*nodeutil.XMLWtr2)
+	w.report(elem, r.From, nil)
+	return w.child(elem), key, nil
+}
+
+func (w *originWtr) Field(r node.FieldRequest, hnd *node.ValueHandle) error {
+	existing := len(w.elem.Elem)
+	if err := w.elem.Field(r, hnd); err != nil {
+		return err
+	}
+	if _, reported := w.origins[w.elem]; !reported {
+		// only way to learn what is behind a container
+		w.report(w.elem, r.From, nil)
+	}
+	for _, elem := range w.elem.Elem[existing:] {
+		w.report(elem, r.From, r.Meta)
+	}
+	return nil
+}
+
+func (w *originWtr) Choose(sel *node.Selection, choice *meta.Choice) (*meta.ChoiceCase, error) {
+	return w.elem.Choose(sel, choice)
+}
+
+func (w *originWtr) BeginEdit(r node.NodeRequest) error {
+	return nil
+}
+
+func (w *originWtr) EndEdit(r node.NodeRequest) error {
+	return nil
+}
+
+func (w *originWtr) Action(r node.ActionRequest) (node.Node, error) {
+	return w.elem.Action(r)
+}
+
+func (w *originWtr) Notify(r node.NotifyRequest) (node.NotifyCloser, error) {
+	return w.elem.Notify(r)
+}
+
+func (w *originWtr) Peek(sel *node.Selection, consumer interface{}) interface{} {
+	return w.elem
+}
+
+func (w *originWtr) Context(sel *node.Selection) context.Context {
+	return sel.Context
+}
+
+func (w *originWtr) Release(sel *node.Selection) {
+}
+
+var originNsDecl = xml.Attr{Name: xml.Name{Local: "xmlns:or"}, Value: OriginNs}
+
+// annotatedElem is data with RFC 7952 metadata as attributes
+type annotatedElem struct {
+	XMLName xml.Name
+	Attr    []xml.Attr `xml:",any,attr"`
+	Content string     `xml:",innerxml"`
+	Elem    []*annotatedElem
+}
+
+// originFilter selects data by origin.  Nil selects everything.
+type originFilter struct {
+	origins map[Origin]bool
+	negated bool
+}
+
+type originAnnotator struct {
+	origins    map[*nodeutil.XMLWtr2]Origin
+	filter     *originFilter
+	withOrigin bool
+}
+
+func (f *originFilter) match(origin Origin) bool {
+	return f == nil || f.origins[origin] != f.negated
+}
+
+// encodeSelectionsOrigins is like encodeSelections but also has origin of
+// data that reported one
+func encodeSelectionsOrigins(sels []*node.Selection) ([]*nodeutil.XMLWtr2, map[*nodeutil.XMLWtr2]Origin, error) {
+	origins := make(map[*nodeutil.XMLWtr2]Origin)
+	var data []*nodeutil.XMLWtr2
+	for _, sel := range sels {
+		mod := meta.OriginalModule(sel.Meta())
+		w := &originWtr{
+			elem: &nodeutil.XMLWtr2{
+				XMLName: xml.Name{
+					Local: sel.Meta().Ident(),
+					Space: mod.Namespace(),
+				},
+			},
+			origins: origins,
+		}
+		if err := sel.UpsertInto(w); err != nil {
+			return nil, nil, err
+		}
+		data = append(data, w.elem)
+	}
+	return data, origins, nil
+}
+
+// encodeSelectionsWithOrigin is like encodeSelections but only data filter
+// selects by origin.  When withOrigin is set each element has an origin
+// annotation unless it's the same as it's parent.
+func encodeSelectionsWithOrigin(sels []*node.Selection, filter *originFilter, withOrigin bool) ([]*annotatedElem, error) {
+	data, origins, err := encodeSelectionsOrigins(sels)
+	if err != nil {
+		return nil, err
+	}
+	an := originAnnotator{origins: origins, filter: filter, withOrigin: withOrigin}
+	var elems []*annotatedElem
+	for i, sel := range sels {
+		elem := data[i]
+		parent, isModule := sel.Meta().(*meta.Module)
+		if !isModule && !(meta.IsList(sel.Meta()) && !sel.InsideList) {
+			a := an.annotate(elem, sel.Meta().Parent().(meta.HasDefinitions), "")
+			if a != nil {
+				if withOrigin {
+					a.Attr = append(a.Attr, originNsDecl)
+				}
+				elems = append(elems, a)
+			}
+			continue
+		}
+		// element only holds the data, modules are not data and a list's
+		// items are written under the list
+		holder := &annotatedElem{XMLName: elem.XMLName}
+		if withOrigin {
+			holder.Attr = []xml.Attr{originNsDecl}
+		}
+		var within meta.HasDefinitions = parent
+		if !isModule {
+			within = sel.Meta().Parent().(meta.HasDefinitions)
+		}
+		for _, e := range elem.Elem {
+			if a := an.annotate(e, within, ""); a != nil {
+				holder.Elem = append(holder.Elem, a)
+			}
+		}
+		if len(holder.Elem) > 0 {
+			elems = append(elems, holder)
+		}
+	}
+	return elems, nil
+}
+
+// annotate copies elem adding origin when it's not the same as parent's.
+// Returns nil if filter does not select elem or anything under it.
+func (an originAnnotator) annotate(elem *nodeutil.XMLWtr2, parent meta.HasDefinitions, parentOrigin Origin) *annotatedElem {
+	def := meta.Find(parent, elem.XMLName.Local)
+	origin, reported := an.origins[elem]
+	if !reported {
+		origin = parentOrigin
+		config := true
+		if d, valid := def.(meta.HasDetails); valid {
+			config = d.Config()
+		}
+		if origin == "" {
+			origin = OriginIntended
+		}
+		if !config && origin == OriginIntended {
+			// state cannot be configured
+			origin = OriginUnknown
+		}
+	}
+	a := &annotatedElem{XMLName: elem.XMLName, Content: elem.Content}
+	if an.withOrigin && origin != parentOrigin {
+		a.Attr = []xml.Attr{{Name: xml.Name{Local: "or:origin"}, Value: "or:" + string(origin)}}
+	}
+	selected := an.filter.match(origin)
+	if container, valid := def.(meta.HasDefinitions); valid {
+		var keys []*annotatedElem
+		for _, child := range elem.Elem {
+			if c := an.annotate(child, container, origin); c != nil {
+				a.Elem = append(a.Elem, c)
+				selected = true
+			} else if isKey(def, child.XMLName.Local) {
+				// list items are not identifiable w/o their keys
+				all := an
+				all.filter = nil
+				keys = append(keys, all.annotate(child, container, origin))
+			}
+		}
+		a.Elem = append(keys, a.Elem...)
+	}
+	if !selected {
+		return nil
+	}
+	return a
+}
+
+func isKey(def meta.Definition, ident string) bool {
+	if l, isList := def.(*meta.List); isList {
+		for _, k := range l.KeyMeta() {
+			if k.Ident() == ident {
+				return true
+			}
+		}
+	}
+	return false
+}
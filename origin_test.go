@@ -0,0 +1,58 @@
+package netconf
+
+import (
+	"testing"
+
+	"github.com/freeconf/yang/meta"
+	"github.com/freeconf/yang/nodeutil"
+)
+
+type originCar struct {
+	Speed        int
+	Miles        int64
+	LastRotation int64
+	Running      bool
+	Tire         []*originTire
+}
+
+func (c *originCar) Origin(m meta.Leafable) Origin {
+	if m != nil && m.Ident() == "speed" {
+		return OriginLearned
+	}
+	return ""
+}
+
+type originTire struct {
+	Pos  int
+	Size string
+	Worn bool
+	Wear float64
+	Flat bool
+}
+
+func (t *originTire) Origin(m meta.Leafable) Origin {
+	if m == nil && t.Pos == 9 {
+		return OriginSystem
+	}
+	return ""
+}
+
+func TestOrigin(t *testing.T) {
+	car := &originCar{
+		Speed: 10,
+		Tire:  []*originTire{{Pos: 1, Size: "15"}, {Pos: 9, Size: "16"}},
+	}
+	d, s := newTestServer(t, &nodeutil.Node{Object: car})
+	rt := newRpcTester(t, s, d)
+	getData := func(params string) {
+		t.Helper()
+		rt.send(`<get-data xmlns="urn:ietf:params:xml:ns:yang:ietf-netconf-nmda" xmlns:ds="urn:ietf:params:xml:ns:yang:ietf-datastores" xmlns:or="urn:ietf:params:xml:ns:yang:ietf-origin">` +
+			`<datastore>ds:operational</datastore><subtree-filter><car xmlns="c"><speed/><miles/><tire/></car></subtree-filter>` +
+			params + `</get-data>`)
+	}
+
+	getData(`<with-origin/>`)
+	getData(`<origin-filter>or:learned</origin-filter>`)
+	getData(`<negated-origin-filter>or:system</negated-origin-filter>`)
+	rt.gold("testdata/gold/origin.xml")
+}
@@ -0,0 +1,189 @@
+package netconf
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/freeconf/restconf/device"
+	"github.com/freeconf/yang/fc"
+	"github.com/freeconf/yang/node"
+	"github.com/freeconf/yang/nodeutil"
+	"github.com/freeconf/yang/patch/xml"
+	"github.com/freeconf/yang/xpath"
+)
+
+// Subscriptions to datastore contents instead of a stream of events
+//
+//	https://datatracker.ietf.org/doc/html/rfc8641
+const YangPushNs = "urn:ietf:params:xml:ns:yang:ietf-yang-push"
+
+// namespace of datastore identities
+const DatastoresNs = "urn:ietf:params:xml:ns:yang:ietf-datastores"
+
+// pushError is an rpc-error with the RFC 8641 identity of the reason in
+// error-app-tag
+func pushError(reason string, msg string) *RpcError {
+	err := NewRpcError("application", "invalid-value", msg)
+	err.AppTag = "ietf-yang-push:" + reason
+	return err
+}
+
+// datastoreContent is the part of data that is in datastore
+func datastoreContent(datastore string) (node.ContentConstraint, error) {
+	content, err := datastoreData(datastore)
+	if err != nil {
+		return 0, pushError("datastore-not-subscribable", fmt.Sprintf("datastore '%s' not supported", datastore))
+	}
+	return content, nil
+}
+
+func readPeriodic(n *nodeutil.XmlNode, p *subscriptionParams) error {
+	p.periodic = true
+	for _, c := range n.Nodes {
+		content := strings.TrimSpace(string(c.Content))
+		switch c.XMLName.Local {
+		case "period":
+			// centiseconds
+			cs, err := strconv.ParseUint(content, 10, 32)
+			if err != nil {
+				return NewRpcError("protocol", "invalid-value", fmt.Sprintf("bad period '%s'", content))
+			}
+			p.period = time.Duration(cs) * 10 * time.Millisecond
+		case "anchor-time":
+			t, err := time.Parse(time.RFC3339, content)
+			if err != nil {
+				return NewRpcError("protocol", "invalid-value", fmt.Sprintf("bad anchor-time '%s'", content))
+			}
+			p.anchor = &t
+		}
+	}
+	return nil
+}
+
+func periodicElem(period time.Duration, anchor time.Time) string {
+	content := textElem("period", strconv.FormatInt(int64(period/(10*time.Millisecond)), 10))
+	if !anchor.IsZero() {
+		content += textElem("anchor-time", anchor.Format(time.RFC3339Nano))
+	}
+	return fmt.Sprintf(`<periodic xmlns="%s">%s</periodic>`, YangPushNs, content)
+}
+
+// checkPush validates parameters of a datastore subscription.  Modify only
+// has to have the parameters that are changing.
+func checkPush(dev device.Device, p *subscriptionParams, modify bool) error {
+	if p.replayStart != nil {
+		return subscriptionError("replay-unsupported", "replay of datastore subscriptions not supported")
+	}
+	if !modify {
+		if _, err := datastoreContent(p.datastore); err != nil {
+			return err
+		}
+		if p.periodic == p.onChange {
+			return NewRpcError("protocol", "missing-element", "either periodic or on-change required")
+		}
+	}
+	if p.periodic && p.period <= 0 {
+		return pushError("period-unsupported", "period must be at least one centisecond")
+	}
+	if p.filter != nil && p.filter.Type == "xpath" {
+		top, err := xpath.Parse2(deviceNamespaces(dev, p.filter.shortcodes), p.filter.Select)
+		if err != nil {
+			return filterError(NewRpcError("protocol", "invalid-value", fmt.Sprintf("bad filter select. %s", err)))
+		}
+		b, err := dev.Browser(top.Ident)
+		if err != nil || b == nil {
+			return filterError(NewRpcError("protocol", "invalid-value", fmt.Sprintf("module '%s' not found", top.Ident)))
+		}
+		return filterError(checkXPathSegments(b.Meta, top.Next))
+	}
+	return nil
+}
+
+// startPeriodic sends datastore contents every period starting from anchor
+// time
+func (sub *Subscription) startPeriodic() error {
+	content, err := datastoreContent(sub.Datastore)
+	if err != nil {
+		return err
+	}
+	sub.mu.Lock()
+	period, anchor := sub.period, sub.anchor
+	sub.mu.Unlock()
+	if anchor.IsZero() {
+		anchor = time.Now()
+	}
+	done := make(chan struct{})
+	go func() {
+		next := nextPeriod(anchor, period, time.Now())
+		timer := time.NewTimer(time.Until(next))
+		defer timer.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-timer.C:
+			}
+			sub.pushUpdate(content)
+			// skip updates that could not be made in time
+			next = nextPeriod(next.Add(period), period, time.Now())
+			timer.Reset(time.Until(next))
+		}
+	}()
+	var once sync.Once
+	sub.setStop(func() {
+		once.Do(func() {
+			close(done)
+		})
+	})
+	return nil
+}
+
+// nextPeriod is first time on or after now that is a whole number of periods
+// from anchor
+func nextPeriod(anchor time.Time, period time.Duration, now time.Time) time.Time {
+	if !anchor.Before(now) {
+		return anchor
+	}
+	n := (now.Sub(anchor) + period - 1) / period
+	return anchor.Add(n * period)
+}
+
+// pushUpdate sends the selected datastore contents
+func (sub *Subscription) pushUpdate(content node.ContentConstraint) {
+	update, err := sub.update(content)
+	if err != nil {
+		fc.Debug.Printf("could not read datastore for subscription %d. %s", sub.Id, err)
+		return
+	}
+	sub.deliver(update)
+}
+
+// update is the selected datastore contents as a push-update
+func (sub *Subscription) update(content node.ContentConstraint) (*Notification, error) {
+	sub.mu.Lock()
+	selection := sub.selection
+	sub.mu.Unlock()
+	sels, err := readFilter(sub.ctx, sub.dev, selection, content)
+	if err != nil {
+		return nil, err
+	}
+	data, err := encodeSelections(sels)
+	if err != nil {
+		return nil, err
+	}
+	return sub.pushUpdateMsg(data), nil
+}
+
+func (sub *Subscription) pushUpdateMsg(data []*nodeutil.XMLWtr2) *Notification {
+	update := &nodeutil.XMLWtr2{
+		XMLName: xml.Name{Space: YangPushNs, Local: "push-update"},
+		Content: textElem("id", strconv.FormatUint(uint64(sub.Id), 10)),
+		Elem: []*nodeutil.XMLWtr2{
+			{XMLName: xml.Name{Space: YangPushNs, Local: "datastore-contents"}, Elem: data},
+		},
+	}
+	return &Notification{EventTime: time.Now(), Elems: []*nodeutil.XMLWtr2{update}}
+}
@@ -0,0 +1,101 @@
+package netconf
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/freeconf/restconf/testdata"
+	"github.com/freeconf/yang/fc"
+)
+
+func TestNextPeriod(t *testing.T) {
+	anchor := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		now      time.Duration
+		expected time.Duration
+	}{
+		{now: -time.Hour, expected: 0},
+		{now: 0, expected: 0},
+		{now: time.Second, expected: 10 * time.Second},
+		{now: 10 * time.Second, expected: 10 * time.Second},
+		{now: 11 * time.Second, expected: 20 * time.Second},
+	}
+	for _, test := range tests {
+		actual := nextPeriod(anchor, 10*time.Second, anchor.Add(test.now))
+		fc.AssertEqual(t, test.expected, actual.Sub(anchor))
+	}
+}
+
+func TestPeriodicPush(t *testing.T) {
+	d, s := newTestServer(t, testdata.Manage(testdata.New()))
+
+	c := newTestConn(t, s, d)
+	c.start()
+
+	c.send(1, `<establish-subscription xmlns="urn:ietf:params:xml:ns:yang:ietf-subscribed-notifications" xmlns:yp="urn:ietf:params:xml:ns:yang:ietf-yang-push" xmlns:ds="urn:ietf:params:xml:ns:yang:ietf-datastores"><yp:datastore>ds:operational</yp:datastore></establish-subscription>`)
+	c.expect("either periodic or on-change required")
+	c.send(2, `<establish-subscription xmlns="urn:ietf:params:xml:ns:yang:ietf-subscribed-notifications" xmlns:yp="urn:ietf:params:xml:ns:yang:ietf-yang-push" xmlns:ds="urn:ietf:params:xml:ns:yang:ietf-datastores"><yp:datastore>ds:operational</yp:datastore><yp:datastore-xpath-filter>car/speed</yp:datastore-xpath-filter><yp:periodic><yp:period>5</yp:period></yp:periodic></establish-subscription>`)
+	c.expect("ietf-subscribed-notifications:filter-unsupported")
+
+	c.send(3, `<establish-subscription xmlns="urn:ietf:params:xml:ns:yang:ietf-subscribed-notifications" xmlns:yp="urn:ietf:params:xml:ns:yang:ietf-yang-push" xmlns:ds="urn:ietf:params:xml:ns:yang:ietf-datastores">
+		<yp:datastore>ds:operational</yp:datastore>
+		<yp:datastore-subtree-filter><car xmlns="c"><speed/></car></yp:datastore-subtree-filter>
+		<yp:periodic><yp:period>5</yp:period></yp:periodic>
+	</establish-subscription>`)
+	c.expect("<id")
+	c.expect("subscription-started", "ds:operational", "<period>5</period>")
+	for i := 0; i < 2; i++ {
+		update := c.expect("push-update", "datastore-contents", "</speed>")
+		fc.AssertEqual(t, false, strings.Contains(update, "tire"), update)
+	}
+
+	c.kill()
+	fc.AssertEqual(t, 0, len(s.Subscriptions().List()))
+}
+
+func TestOnChangePush(t *testing.T) {
+	d, s := newTestServer(t, testdata.Manage(testdata.New()))
+
+	c := newTestConn(t, s, d)
+	// reply and notification are interleaved in either order
+	edit := func(id int, config string) string {
+		t.Helper()
+		c.send(id, fmt.Sprintf(`<edit-config><target><running/></target><config>%s</config></edit-config>`, config))
+		reply, notification := c.recv(), c.recv()
+		if strings.Contains(reply, "<notification") {
+			reply, notification = notification, reply
+		}
+		fc.AssertEqual(t, true, strings.Contains(reply, "<ok"), reply)
+		return notification
+	}
+	c.start()
+
+	c.send(1, `<establish-subscription xmlns="urn:ietf:params:xml:ns:yang:ietf-subscribed-notifications" xmlns:yp="urn:ietf:params:xml:ns:yang:ietf-yang-push" xmlns:ds="urn:ietf:params:xml:ns:yang:ietf-datastores">
+		<yp:datastore>ds:running</yp:datastore>
+		<yp:datastore-subtree-filter><car xmlns="c"><speed/><tire/></car></yp:datastore-subtree-filter>
+		<yp:on-change/>
+	</establish-subscription>`)
+	first := c.recv()
+	fc.AssertEqual(t, true, strings.Contains(first, "<id"), first)
+	started := c.recv()
+	fc.AssertEqual(t, true, strings.Contains(started, "<dampening-period>0</dampening-period>"), started)
+	sync := c.recv()
+	fc.AssertEqual(t, true, strings.Contains(sync, "push-update"), sync)
+
+	update := edit(2, `<car xmlns="c"><speed>10</speed></car>`)
+	fc.AssertEqual(t, true, strings.Contains(update, "push-change-update"), update)
+	fc.AssertEqual(t, true, strings.Contains(update, "<operation>replace</operation><target>/car:speed</target>"), update)
+	fc.AssertEqual(t, true, strings.Contains(update, ">10</speed></value>"), update)
+
+	update = edit(3, `<car xmlns="c"><tire><pos>9</pos><size>17</size></tire></car>`)
+	fc.AssertEqual(t, true, strings.Contains(update, "<operation>create</operation><target>/car:tire=9</target>"), update)
+	fc.AssertEqual(t, 1, strings.Count(update, "<edit>"), update)
+
+	update = edit(4, `<car xmlns="c" xmlns:nc="urn:ietf:params:netconf:base:1.1"><tire nc:operation="delete"><pos>9</pos></tire></car>`)
+	fc.AssertEqual(t, true, strings.Contains(update, "<operation>delete</operation><target>/car:tire=9</target>"), update)
+	fc.AssertEqual(t, 1, strings.Count(update, "<edit>"), update)
+
+	c.kill()
+}
@@ -0,0 +1,583 @@
+package netconf
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/freeconf/restconf/estream"
+	"github.com/freeconf/yang/fc"
+	"github.com/freeconf/yang/node"
+	"github.com/freeconf/yang/nodeutil"
+	"github.com/freeconf/yang/patch/xml"
+)
+
+// ReplayOptions limit how many past events of a stream are kept for clients
+// that subscribe with a startTime.
+//
+//	https://datatracker.ietf.org/doc/html/rfc5277#section-2.1.1
+type ReplayOptions struct {
+	// Most events kept, oldest are dropped first. Default is 1000
+	MaxEvents int
+
+	// Events older than this are dropped. Zero keeps events until there are
+	// more than MaxEvents
+	MaxAge time.Duration
+
+	// If set, events are also written to this file and read back when replay
+	// is enabled so events survive a restart.
+	File string
+}
+
+const defaultReplayMaxEvents = 1000
+
+var errReplayTooOld = errors.New("start time is before replay log")
+
+// errReplayEnded is when subscription ended while replay was being sent
+var errReplayEnded = errors.New("subscription ended")
+
+type loggedEvent struct {
+	eventTime time.Time
+	event     *nodeutil.XMLWtr2
+}
+
+func (e loggedEvent) notification() *Notification {
+	return &Notification{
+		EventTime: e.eventTime,
+		Elems:     []*nodeutil.XMLWtr2{e.event},
+	}
+}
+
+// ReplayLog keeps recent events of one stream in a ring buffer
+type ReplayLog struct {
+	opts      ReplayOptions
+	mu        sync.Mutex
+	ring      []loggedEvent
+	head      int
+	count     int
+	created   time.Time
+	aged      time.Time
+	listeners *list.List
+	file      *os.File
+	written   int
+	stop      func()
+}
+
+func newReplayLog(opts ReplayOptions) (*ReplayLog, error) {
+	if opts.MaxEvents <= 0 {
+		opts.MaxEvents = defaultReplayMaxEvents
+	}
+	l := &ReplayLog{
+		opts:      opts,
+		ring:      make([]loggedEvent, opts.MaxEvents),
+		created:   time.Now(),
+		listeners: list.New(),
+	}
+	l.aged = l.created
+	if opts.File != "" {
+		if err := l.load(); err != nil {
+			return nil, err
+		}
+		if err := l.compact(); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// CreationTime is when log started, or was first started if log is kept
+// in a file
+func (l *ReplayLog) CreationTime() time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.created
+}
+
+// Start is the earliest time replay can begin without missing events.  This
+// is the creation time until events are dropped to stay in limits.
+func (l *ReplayLog) Start() time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.trim(time.Now())
+	return l.aged
+}
+
+func (l *ReplayLog) push(e loggedEvent) {
+	if l.count == len(l.ring) {
+		l.drop()
+	}
+	l.ring[(l.head+l.count)%len(l.ring)] = e
+	l.count++
+}
+
+func (l *ReplayLog) drop() {
+	l.aged = l.ring[l.head].eventTime
+	l.ring[l.head] = loggedEvent{}
+	l.head = (l.head + 1) % len(l.ring)
+	l.count--
+}
+
+func (l *ReplayLog) trim(now time.Time) {
+	if l.opts.MaxAge <= 0 {
+		return
+	}
+	cutoff := now.Add(-l.opts.MaxAge)
+	for l.count > 0 && l.ring[l.head].eventTime.Before(cutoff) {
+		l.drop()
+	}
+}
+
+func (l *ReplayLog) events() []loggedEvent {
+	events := make([]loggedEvent, l.count)
+	for i := 0; i < l.count; i++ {
+		events[i] = l.ring[(l.head+i)%len(l.ring)]
+	}
+	return events
+}
+
+// record adds event to log and sends it to listeners subscribed before it
+// was added. Later subscribers get it in their replay instead.
+func (l *ReplayLog) record(eventTime time.Time, event *nodeutil.XMLWtr2) {
+	l.mu.Lock()
+	e := loggedEvent{eventTime: eventTime, event: event}
+	l.push(e)
+	l.trim(time.Now())
+	if l.file != nil {
+		if err := l.write(e); err != nil {
+			fc.Err.Printf("could not write replay log %s. %s", l.opts.File, err)
+		}
+	}
+	var listeners []func(loggedEvent)
+	for p := l.listeners.Front(); p != nil; p = p.Next() {
+		listeners = append(listeners, p.Value.(func(loggedEvent)))
+	}
+	l.mu.Unlock()
+	for _, listener := range listeners {
+		listener(e)
+	}
+}
+
+// subscribe returns the events since start and calls listener with every
+// event after that until returned function is called.
+func (l *ReplayLog) subscribe(start time.Time, listener func(loggedEvent)) ([]loggedEvent, func(), error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.trim(time.Now())
+	if start.Before(l.aged) {
+		return nil, nil, errReplayTooOld
+	}
+	var replay []loggedEvent
+	for _, e := range l.events() {
+		if !e.eventTime.Before(start) {
+			replay = append(replay, e)
+		}
+	}
+	p := l.listeners.PushBack(listener)
+	return replay, func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.listeners.Remove(p)
+	}, nil
+}
+
+func (l *ReplayLog) close() {
+	if l.stop != nil {
+		l.stop()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+}
+
+// replayRecord is one line in replay log file, first line has the times of
+// the log and the rest are events
+type replayRecord struct {
+	Created   *time.Time `json:"created,omitempty"`
+	Aged      *time.Time `json:"aged,omitempty"`
+	EventTime *time.Time `json:"eventTime,omitempty"`
+	Event     string     `json:"event,omitempty"`
+}
+
+func (l *ReplayLog) load() error {
+	f, err := os.Open(l.opts.File)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	lines := bufio.NewScanner(f)
+	lines.Buffer(nil, maxEomMessageSize)
+	for lines.Scan() {
+		var r replayRecord
+		if err := json.Unmarshal(lines.Bytes(), &r); err != nil {
+			return fmt.Errorf("bad replay log %s. %w", l.opts.File, err)
+		}
+		if r.Created != nil {
+			if r.Aged == nil {
+				return fmt.Errorf("bad replay log %s. header missing aged", l.opts.File)
+			}
+			l.created = *r.Created
+			l.aged = *r.Aged
+		}
+		if r.EventTime == nil {
+			continue
+		}
+		var event nodeutil.XMLWtr2
+		if err := xml.Unmarshal([]byte(r.Event), &event); err != nil {
+			return fmt.Errorf("bad event in replay log %s. %w", l.opts.File, err)
+		}
+		l.push(loggedEvent{eventTime: *r.EventTime, event: &event})
+	}
+	if err := lines.Err(); err != nil {
+		return err
+	}
+	l.trim(time.Now())
+	return nil
+}
+
+// compact rewrites file with only the events still in log
+func (l *ReplayLog) compact() error {
+	if l.file != nil {
+		l.file.Close()
+	}
+	tmp := l.opts.File + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	l.file = f
+	l.written = 0
+	header, err := json.Marshal(replayRecord{Created: &l.created, Aged: &l.aged})
+	if err != nil {
+		return err
+	}
+	if _, err = fmt.Fprintf(f, "%s\n", header); err != nil {
+		return err
+	}
+	for _, e := range l.events() {
+		if err = l.write(e); err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmp, l.opts.File)
+}
+
+func (l *ReplayLog) write(e loggedEvent) error {
+	if l.written >= 2*l.opts.MaxEvents {
+		return l.compact()
+	}
+	event, err := xml.Marshal(e.event)
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(replayRecord{EventTime: &e.eventTime, Event: string(event)})
+	if err != nil {
+		return err
+	}
+	if _, err = fmt.Fprintf(l.file, "%s\n", line); err != nil {
+		return err
+	}
+	l.written++
+	return nil
+}
+
+// EnableReplay starts keeping recent events of stream so clients can
+// subscribe with a startTime and get the events they missed. For the NETCONF
+// stream only notifications of modules already added to device are kept.
+func (s *Server) EnableReplay(stream string, opts ReplayOptions) error {
+	log, err := newReplayLog(opts)
+	if err != nil {
+		return err
+	}
+	record := func(event *node.Selection, eventTime time.Time) {
+		payload, err := encodeEvent(event)
+		if err != nil {
+			fc.Err.Printf("could not record %s event. %s", stream, err)
+			return
+		}
+		log.record(eventTime, payload)
+	}
+	if stream == NetconfStream {
+		log.stop, err = subscribeNetconfEvents(s.main, func(n node.Notification) {
+			record(n.Event, n.EventTime)
+		})
+		if err != nil {
+			log.close()
+			return err
+		}
+	} else {
+		sub, err := s.streams.EstablishSubscription(estream.EstablishRequest{Stream: stream})
+		if err != nil {
+			log.close()
+			return err
+		}
+		name := "replay-log"
+		err = sub.AddReceiver(name, func(e estream.ReceiverEvent) error {
+			record(e.Event, e.EventTime)
+			return nil
+		})
+		if err != nil {
+			log.close()
+			return err
+		}
+		log.stop = func() {
+			sub.RemoveReceiver(name)
+		}
+	}
+	s.streamInfoMu.Lock()
+	defer s.streamInfoMu.Unlock()
+	if s.replayLogs == nil {
+		s.replayLogs = make(map[string]*ReplayLog)
+	}
+	if existing := s.replayLogs[stream]; existing != nil {
+		existing.close()
+	}
+	s.replayLogs[stream] = log
+	return nil
+}
+
+// ReplayLog is the log of past events of stream or nil if replay is not
+// enabled for stream
+func (s *Server) ReplayLog(stream string) *ReplayLog {
+	s.streamInfoMu.RLock()
+	defer s.streamInfoMu.RUnlock()
+	return s.replayLogs[stream]
+}
+
+func (s *Server) closeReplayLogs() {
+	s.streamInfoMu.Lock()
+	defer s.streamInfoMu.Unlock()
+	for _, log := range s.replayLogs {
+		log.close()
+	}
+	s.replayLogs = nil
+}
+
+// replaySub sends past events of a subscription with a start time, then a
+// marker that replay is complete and then live events.  Live events that
+// happen while replay is being sent are held until replay is complete.
+type replaySub struct {
+	ses      *Session
+	filter   *eventFilter
+	stopTime time.Time
+
+	// sends live events
+	notify func(*Notification) error
+
+	// sent when replay is done and when stopTime is reached
+	replayComplete func() *Notification
+	complete       func() *Notification
+
+	// optional, called once stopTime is reached
+	onEnd func()
+
+	unsubscribe func()
+
+	// held while replay sends so close can wait for a send under way
+	sending sync.Mutex
+
+	mu        sync.Mutex
+	replaying bool
+	pending   []loggedEvent
+	ended     bool
+	timer     *time.Timer
+}
+
+func (ses *Session) subscribeReplay(create *CreateSubscription, filter *eventFilter) error {
+	if create.StartTime == nil {
+		return NewRpcError("protocol", "missing-element", "stopTime requires startTime")
+	}
+	start := *create.StartTime
+	if start.After(time.Now()) {
+		return NewRpcError("protocol", "bad-element", "startTime is in the future")
+	}
+	sub := &replaySub{
+		ses:    ses,
+		filter: filter,
+		notify: ses.notify,
+		replayComplete: func() *Notification {
+			return subscriptionMarker("replayComplete")
+		},
+		complete: func() *Notification {
+			return subscriptionMarker("notificationComplete")
+		},
+	}
+	if create.StopTime != nil {
+		sub.stopTime = *create.StopTime
+		if sub.stopTime.Before(start) {
+			return NewRpcError("protocol", "bad-element", "stopTime is before startTime")
+		}
+	}
+	log := ses.mgr.ReplayLog(create.Stream)
+	if log == nil {
+		return NewRpcError("protocol", "operation-not-supported", fmt.Sprintf("stream %s does not support replay", create.Stream))
+	}
+	// subscription no longer keeps session alive once stopTime is reached
+	sub.onEnd = ses.addSub(sub.close)
+	err := sub.start(log, start)
+	if err != nil {
+		sub.onEnd()
+	}
+	if err == errReplayTooOld {
+		msg := fmt.Sprintf("startTime is before replay log start of %s", log.Start().Format(time.RFC3339))
+		return NewRpcError("protocol", "bad-element", msg)
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// start replay once client has reply to the rpc that created subscription
+func (sub *replaySub) start(log *ReplayLog, start time.Time) error {
+	sub.replaying = true
+	replay, unsubscribe, err := log.subscribe(start, sub.live)
+	if err != nil {
+		return err
+	}
+	sub.unsubscribe = unsubscribe
+	sub.ses.afterReply = append(sub.ses.afterReply, func() {
+		go sub.replay(replay)
+	})
+	return nil
+}
+
+func (sub *replaySub) after(e loggedEvent) bool {
+	return !sub.stopTime.IsZero() && e.eventTime.After(sub.stopTime)
+}
+
+func (sub *replaySub) live(e loggedEvent) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if sub.ended || sub.after(e) {
+		return
+	}
+	if sub.replaying {
+		sub.pending = append(sub.pending, e)
+		return
+	}
+	e, selected, err := sub.filter.applyLogged(sub.ses.dev, e)
+	if err != nil || !selected {
+		return
+	}
+	if err := sub.notify(e.notification()); err != nil {
+		fc.Debug.Printf("could not send notification ses=%d. %s", sub.ses.Id, err)
+	}
+}
+
+func (sub *replaySub) replay(events []loggedEvent) {
+	for _, e := range events {
+		if sub.after(e) {
+			break
+		}
+		if err := sub.send(e); err != nil {
+			fc.Debug.Printf("replay ended ses=%d. %s", sub.ses.Id, err)
+			return
+		}
+	}
+	if err := sub.sendWait(sub.replayComplete()); err != nil {
+		return
+	}
+	for {
+		sub.mu.Lock()
+		pending := sub.pending
+		sub.pending = nil
+		if len(pending) == 0 {
+			sub.replaying = false
+			sub.mu.Unlock()
+			break
+		}
+		sub.mu.Unlock()
+		for _, e := range pending {
+			if err := sub.send(e); err != nil {
+				return
+			}
+		}
+	}
+	if sub.stopTime.IsZero() {
+		return
+	}
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if !sub.ended {
+		sub.timer = time.AfterFunc(time.Until(sub.stopTime), sub.end)
+	}
+}
+
+// send waits to send event if filter selects it
+func (sub *replaySub) send(e loggedEvent) error {
+	e, selected, err := sub.filter.applyLogged(sub.ses.dev, e)
+	if err != nil {
+		fc.Debug.Printf("could not filter event ses=%d. %s", sub.ses.Id, err)
+		return nil
+	}
+	if !selected {
+		return nil
+	}
+	return sub.sendWait(e.notification())
+}
+
+// sendWait waits to send n unless subscription has ended
+func (sub *replaySub) sendWait(n *Notification) error {
+	sub.sending.Lock()
+	defer sub.sending.Unlock()
+	sub.mu.Lock()
+	ended := sub.ended
+	sub.mu.Unlock()
+	if ended {
+		return errReplayEnded
+	}
+	return sub.ses.notifyWait(n)
+}
+
+// end is when stopTime is reached
+func (sub *replaySub) end() {
+	sub.mu.Lock()
+	if sub.ended {
+		sub.mu.Unlock()
+		return
+	}
+	sub.ended = true
+	sub.mu.Unlock()
+	sub.unsubscribe()
+	if sub.onEnd != nil {
+		sub.onEnd()
+	}
+	if err := sub.ses.notifyWait(sub.complete()); err != nil {
+		fc.Debug.Printf("could not send end of subscription ses=%d. %s", sub.ses.Id, err)
+	}
+}
+
+// close stops replay and live events. Nothing is sent once close returns
+func (sub *replaySub) close() {
+	sub.mu.Lock()
+	sub.ended = true
+	if sub.timer != nil {
+		sub.timer.Stop()
+	}
+	sub.mu.Unlock()
+	// wait for replay send already under way
+	sub.sending.Lock()
+	sub.sending.Unlock()
+	sub.unsubscribe()
+}
+
+// subscriptionMarker is a notification that marks progress of subscription
+// as opposed to an event.
+func subscriptionMarker(name string) *Notification {
+	return &Notification{
+		EventTime: time.Now(),
+		Elems: []*nodeutil.XMLWtr2{
+			{XMLName: xml.Name{Space: NotificationCompleteNs, Local: name}},
+		},
+	}
+}
@@ -0,0 +1,136 @@
+package netconf
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/freeconf/restconf/testdata"
+	"github.com/freeconf/yang/fc"
+	"github.com/freeconf/yang/nodeutil"
+	"github.com/freeconf/yang/patch/xml"
+)
+
+func TestReplayLog(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "replay.log")
+	opts := ReplayOptions{MaxEvents: 3, File: fname}
+	l, err := newReplayLog(opts)
+	fc.RequireEqual(t, nil, err)
+	created := l.CreationTime()
+	t0 := time.Now()
+	for i := 0; i < 5; i++ {
+		event := &nodeutil.XMLWtr2{XMLName: xml.Name{Local: fmt.Sprintf("e%d", i)}}
+		l.record(t0.Add(time.Duration(i)*time.Second), event)
+	}
+
+	_, _, err = l.subscribe(created, func(loggedEvent) {})
+	fc.AssertEqual(t, errReplayTooOld, err)
+
+	eventNames := func(events []loggedEvent) string {
+		var names []string
+		for _, e := range events {
+			names = append(names, e.event.XMLName.Local)
+		}
+		return strings.Join(names, ",")
+	}
+	replay, unsubscribe, err := l.subscribe(t0.Add(2*time.Second), func(loggedEvent) {})
+	fc.RequireEqual(t, nil, err)
+	unsubscribe()
+	fc.AssertEqual(t, "e2,e3,e4", eventNames(replay))
+	l.close()
+
+	// read back from file
+	l, err = newReplayLog(opts)
+	fc.RequireEqual(t, nil, err)
+	defer l.close()
+	fc.AssertEqual(t, true, created.Equal(l.CreationTime()))
+	replay, _, err = l.subscribe(t0.Add(3*time.Second), func(loggedEvent) {})
+	fc.RequireEqual(t, nil, err)
+	fc.AssertEqual(t, "e3,e4", eventNames(replay))
+}
+
+func TestReplayLogBadHeader(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "replay.log")
+	fc.RequireEqual(t, nil, os.WriteFile(fname, []byte(`{"created":"2024-01-01T00:00:00Z"}`+"\n"), 0600))
+	_, err := newReplayLog(ReplayOptions{File: fname})
+	fc.AssertEqual(t, true, err != nil && strings.Contains(err.Error(), "bad replay log"))
+}
+
+func TestReplayLogListenerCanUnsubscribe(t *testing.T) {
+	l, err := newReplayLog(ReplayOptions{})
+	fc.RequireEqual(t, nil, err)
+	var unsubscribe func()
+	var got int
+	_, unsubscribe, err = l.subscribe(l.Start(), func(loggedEvent) {
+		got++
+		// would deadlock if listeners were called with lock held
+		unsubscribe()
+	})
+	fc.RequireEqual(t, nil, err)
+	l.record(time.Now(), &nodeutil.XMLWtr2{XMLName: xml.Name{Local: "e"}})
+	l.record(time.Now(), &nodeutil.XMLWtr2{XMLName: xml.Name{Local: "e"}})
+	fc.AssertEqual(t, 1, got)
+}
+
+func TestReplaySubscription(t *testing.T) {
+	d, s := newTestServer(t, testdata.Manage(testdata.New()))
+	fc.RequireEqual(t, nil, s.EnableReplay(NetconfStream, ReplayOptions{}))
+	defer s.closeReplayLogs()
+	fc.AssertEqual(t, true, s.Streams()[0].ReplaySupport)
+	start := time.Now()
+	s.PublishEvent(NetconfEvent{
+		Type:            EventCapabilityChange,
+		ChangedBy:       &ChangedBy{Server: true},
+		AddedCapability: []string{"urn:x"},
+	})
+
+	c := newTestConn(t, s, d)
+	c.start()
+	subscribe := func(id int, startTime time.Time, stopTime time.Time) string {
+		return c.call(id, fmt.Sprintf(`<create-subscription xmlns="urn:ietf:params:xml:ns:netconf:notification:1.0"><startTime>%s</startTime><stopTime>%s</stopTime></create-subscription>`,
+			startTime.Format(time.RFC3339Nano), stopTime.Format(time.RFC3339Nano)))
+	}
+
+	reply := subscribe(1, start.Add(-time.Hour), time.Now())
+	fc.AssertEqual(t, true, strings.Contains(reply, "bad-element"), reply)
+	fc.AssertEqual(t, false, c.ses.hasSubs())
+
+	reply = subscribe(2, start, time.Now())
+	fc.AssertEqual(t, true, strings.Contains(reply, "<ok"), reply)
+	for _, expected := range []string{"netconf-capability-change", "netconf-session-start", "replayComplete", "notificationComplete"} {
+		notification := c.recv()
+		fc.AssertEqual(t, true, strings.Contains(notification, expected), notification)
+	}
+	// completed subscription does not keep session alive
+	fc.AssertEqual(t, false, c.ses.hasSubs())
+
+	c.kill()
+}
+
+func TestReplayEndsWithSubscription(t *testing.T) {
+	d, s := newTestServer(t, nil)
+	fc.RequireEqual(t, nil, s.EnableReplay(NetconfStream, ReplayOptions{}))
+	defer s.closeReplayLogs()
+	for i := 0; i < 20; i++ {
+		s.PublishEvent(NetconfEvent{Type: EventSessionStart, Username: "joe", SessionId: int64(100 + i)})
+	}
+	c := newTestConn(t, s, d)
+	c.start()
+	reply := c.call(1, fmt.Sprintf(`<establish-subscription xmlns="urn:ietf:params:xml:ns:yang:ietf-subscribed-notifications"><stream>NETCONF</stream><replay-start-time>%s</replay-start-time></establish-subscription>`,
+		time.Now().Add(-time.Hour).Format(time.RFC3339)))
+	id := regexp.MustCompile(`<id[^>]*>(\d+)</id>`).FindStringSubmatch(reply)[1]
+	c.expect("subscription-started")
+	// replay waits on client to read each event
+	c.expect(">100</session-id>")
+
+	c.send(2, fmt.Sprintf(`<delete-subscription xmlns="urn:ietf:params:xml:ns:yang:ietf-subscribed-notifications"><id>%s</id></delete-subscription>`, id))
+	for !strings.Contains(c.recv(), "<rpc-reply") {
+	}
+	c.expectNone(100 * time.Millisecond)
+	fc.AssertEqual(t, false, c.ses.hasSubs())
+	c.kill()
+}
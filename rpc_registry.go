@@ -0,0 +1,165 @@
+package netconf
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/freeconf/yang/fc"
+	"github.com/freeconf/yang/node"
+	"github.com/freeconf/yang/nodeutil"
+	"github.com/freeconf/yang/patch/xml"
+)
+
+const (
+	BaseNs         = "urn:ietf:params:xml:ns:netconf:base:1.0"
+	NotificationNs = "urn:ietf:params:xml:ns:netconf:notification:1.0"
+)
+
+// RpcRequest is an operation to be handled.
+type RpcRequest struct {
+	Session *Session
+
+	// Whole decoded message. Built-in operations are decoded into their
+	// respective fields
+	Rpc *RpcMsg
+
+	// Name of operation element inside <rpc>
+	Operation xml.Name
+
+	// Operation element inside <rpc> when it is not a built-in operation.
+	Op *nodeutil.XmlNode
+}
+
+// RpcHandler implements an operation.  Reply already has the message-id, set
+// OK, Data or Out.  Return an *RpcError to report failure to client and keep
+// session open, any other error ends the session.  Returning ErrEOS sends
+// reply and then closes session.
+type RpcHandler func(ctx context.Context, req *RpcRequest, reply *RpcReply) error
+
+// RpcRegistry maps operation element to it's handler.  Operations not found
+// in registry are dispatched to YANG rpcs and actions in device.
+type RpcRegistry struct {
+	mu       sync.RWMutex
+	handlers map[xml.Name]RpcHandler
+}
+
+// NewRpcRegistry has handlers for built-in operations
+func NewRpcRegistry() *RpcRegistry {
+	r := &RpcRegistry{
+		handlers: make(map[xml.Name]RpcHandler),
+	}
+	r.Register(BaseNs, "get-config", func(ctx context.Context, req *RpcRequest, reply *RpcReply) error {
+		return req.Session.handleGet(ctx, req.Rpc.GetConfig, reply, node.ContentConfig)
+	})
+	r.Register(BaseNs, "get", func(ctx context.Context, req *RpcRequest, reply *RpcReply) error {
+		return req.Session.handleGet(ctx, req.Rpc.Get, reply, node.ContentOperational)
+	})
+	r.Register(BaseNs, "edit-config", func(ctx context.Context, req *RpcRequest, reply *RpcReply) error {
+		return req.Session.handleEdit(ctx, req.Rpc.EditConfig, reply)
+	})
+	r.Register(BaseNs, "kill-session", func(ctx context.Context, req *RpcRequest, reply *RpcReply) error {
+		return req.Session.handleKill(req.Rpc.Kill, reply)
+	})
+	r.Register(BaseNs, "close-session", func(ctx context.Context, req *RpcRequest, reply *RpcReply) error {
+		reply.OK = &Msg{}
+		req.Session.setEndReason(TerminationClosed)
+		return ErrEOS
+	})
+	r.Register(NotificationNs, "create-subscription", func(ctx context.Context, req *RpcRequest, reply *RpcReply) error {
+		if err := req.Session.handleCreateSubscription(req.Rpc.CreateSubscription); err != nil {
+			return err
+		}
+		reply.OK = &Msg{}
+		return nil
+	})
+	r.Register(NmdaNs, "get-data", func(ctx context.Context, req *RpcRequest, reply *RpcReply) error {
+		return req.Session.handleGetData(ctx, req, reply)
+	})
+	r.Register(NmdaNs, "edit-data", func(ctx context.Context, req *RpcRequest, reply *RpcReply) error {
+		return req.Session.handleEditData(ctx, req, reply)
+	})
+	r.Register(CompareNs, "compare", func(ctx context.Context, req *RpcRequest, reply *RpcReply) error {
+		return req.Session.handleCompare(ctx, req, reply)
+	})
+	r.Register(SubscribedNotificationsNs, "establish-subscription", establishSubscription)
+	r.Register(SubscribedNotificationsNs, "modify-subscription", modifySubscription)
+	r.Register(SubscribedNotificationsNs, "delete-subscription", deleteSubscription)
+	r.Register(SubscribedNotificationsNs, "kill-subscription", killSubscription)
+	return r
+}
+
+// Register adds or replaces handler for operation element
+func (r *RpcRegistry) Register(ns string, name string, h RpcHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handlers[xml.Name{Space: ns, Local: name}] = h
+}
+
+func (r *RpcRegistry) Unregister(ns string, name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.handlers, xml.Name{Space: ns, Local: name})
+}
+
+func (r *RpcRegistry) Handler(ns string, name string) RpcHandler {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.handlers[xml.Name{Space: ns, Local: name}]
+}
+
+// operation finds the element name of the operation in message
+func (rpc *RpcMsg) operation() (xml.Name, error) {
+	switch {
+	case rpc.GetConfig != nil:
+		return xml.Name{Space: BaseNs, Local: "get-config"}, nil
+	case rpc.Get != nil:
+		return xml.Name{Space: BaseNs, Local: "get"}, nil
+	case rpc.EditConfig != nil:
+		return xml.Name{Space: BaseNs, Local: "edit-config"}, nil
+	case rpc.Copy != nil:
+		return xml.Name{Space: BaseNs, Local: "copy-config"}, nil
+	case rpc.Delete != nil:
+		return xml.Name{Space: BaseNs, Local: "delete-config"}, nil
+	case rpc.Kill != nil:
+		return xml.Name{Space: BaseNs, Local: "kill-session"}, nil
+	case rpc.Close != nil:
+		return xml.Name{Space: BaseNs, Local: "close-session"}, nil
+	case rpc.CreateSubscription != nil:
+		return xml.Name{Space: NotificationNs, Local: "create-subscription"}, nil
+	case rpc.Action != nil:
+		return rpc.Action.XMLName, nil
+	}
+	return xml.Name{}, NewRpcError("protocol", "missing-element", "no operation in rpc")
+}
+
+func (ses *Session) dispatchRpc(ctx context.Context, rpc *RpcMsg, reply *RpcReply) error {
+	op, err := rpc.operation()
+	if err != nil {
+		return err
+	}
+	fc.Debug.Printf("%s message ses=%d", op.Local, ses.Id)
+	h := ses.mgr.Rpcs().Handler(op.Space, op.Local)
+	if h == nil {
+		h = ses.handleYangRpc
+	}
+	req := &RpcRequest{Session: ses, Rpc: rpc, Operation: op, Op: rpc.Action}
+	return chainRpc(ses.mgr.RpcInterceptors(), h)(ctx, req, reply)
+}
+
+// handleYangRpc handles operations not in registry as YANG rpcs and actions
+func (ses *Session) handleYangRpc(ctx context.Context, req *RpcRequest, reply *RpcReply) error {
+	if req.Op == nil {
+		return NewRpcError("protocol", "operation-not-supported", fmt.Sprintf("'%s' not supported", req.Operation.Local))
+	}
+	out, err := ses.handleAction(ctx, req.Op)
+	if err != nil {
+		return err
+	}
+	if out == nil {
+		reply.OK = &Msg{}
+	} else {
+		reply.Out = out.Elem
+	}
+	return nil
+}
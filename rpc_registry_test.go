@@ -0,0 +1,28 @@
+package netconf
+
+import (
+	"context"
+	"testing"
+
+	"github.com/freeconf/yang/fc"
+)
+
+func TestRpcRegistry(t *testing.T) {
+	srv := &Server{}
+	var saved string
+	srv.Rpcs().Register("urn:example", "save-config", func(ctx context.Context, req *RpcRequest, reply *RpcReply) error {
+		saved = req.Session.User()
+		reply.OK = &Msg{}
+		return nil
+	})
+	srv.Rpcs().Register(BaseNs, "get-config", func(ctx context.Context, req *RpcRequest, reply *RpcReply) error {
+		return NewRpcError("application", "access-denied", "no peeking")
+	})
+	rt := newRpcTester(t, srv, nil)
+
+	rt.send(`<save-config xmlns="urn:example"/>`)
+	fc.AssertEqual(t, "joe", saved)
+	rt.send(`<get-config><source><running/></source></get-config>`)
+	rt.send(`<copy-config><target><startup/></target><source><running/></source></copy-config>`)
+	rt.gold("testdata/gold/rpc-registry.xml")
+}
@@ -1,50 +1,327 @@
 package netconf
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
 	"github.com/freeconf/restconf/device"
 	"github.com/freeconf/restconf/estream"
 	"github.com/freeconf/yang/fc"
+	"github.com/freeconf/yang/node"
 )
 
 type Server struct {
 	Ver        string
 	main       device.Device
 	sessNum    int64
+	sessions   map[int64]*Session
+	sessionsMu sync.Mutex
 	sshHandler *SshHandler
 	streams    *estream.Service
+	keystore   *Keystore
+	truststore *Truststore
+	authGuard  *AuthGuard
+	onErr      func(error)
+	rpcs       *RpcRegistry
+	rpcsInit   sync.Once
+	subs       *Subscriptions
+	subsInit   sync.Once
+	configured *ConfiguredSubscriptions
+
+	interceptors interceptors
+	events       netconfEvents
+	streamInfo   map[string]*StreamInfo
+	replayLogs   map[string]*ReplayLog
+	streamInfoMu sync.RWMutex
+	inShutdown   atomic.Bool
+}
+
+// ErrServerClosed is returned when configuring a server after Shutdown
+var ErrServerClosed = errors.New("netconf: server closed")
+
+// ServerOption customizes a server created with New
+type ServerOption func(*Server) error
+
+// WithKeystore shares a keystore with other parts of an application
+func WithKeystore(ks *Keystore) ServerOption {
+	return func(s *Server) error {
+		if ks == nil {
+			return errors.New("nil keystore")
+		}
+		s.keystore = ks
+		return nil
+	}
+}
+
+// WithTruststore shares a truststore with other parts of an application
+func WithTruststore(ts *Truststore) ServerOption {
+	return func(s *Server) error {
+		if ts == nil {
+			return errors.New("nil truststore")
+		}
+		s.truststore = ts
+		return nil
+	}
+}
+
+// WithAuthGuard shares brute force protection with other transports of an
+// application
+func WithAuthGuard(g *AuthGuard) ServerOption {
+	return func(s *Server) error {
+		if g == nil {
+			return errors.New("nil auth guard")
+		}
+		s.authGuard = g
+		return nil
+	}
+}
+
+// WithErrorHandler receives errors that cannot be returned to a caller such
+// as failed connections.  Default is to log them.
+func WithErrorHandler(h func(error)) ServerOption {
+	return func(s *Server) error {
+		s.onErr = h
+		return nil
+	}
 }
 
 type SessionManager interface {
 	NextSessionId() int64
+	AddSession(ses *Session)
+	RemoveSession(ses *Session)
+	FindSession(id int64) *Session
 	StreamService() *estream.Service
+	Keystore() *Keystore
+	Truststore() *Truststore
+	AuthGuard() *AuthGuard
+	Rpcs() *RpcRegistry
+	RpcInterceptors() []RpcInterceptor
+	NotifyInterceptors() []NotifyInterceptor
+	PublishEvent(e NetconfEvent)
+	ReplayLog(stream string) *ReplayLog
+	Subscriptions() *Subscriptions
 	HandleErr(err error)
 }
 
+// NewServer is New w/o options that panics on error
 func NewServer(d *device.Local, streams *estream.Service) *Server {
+	s, err := New(d, streams)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// New registers NETCONF server management api and event streams with
+// device.  Configure server thru device's fc-netconf module and call
+// Shutdown when done.
+func New(d *device.Local, streams *estream.Service, opts ...ServerOption) (*Server, error) {
 	s := &Server{
-		main:    d,
-		streams: streams,
+		main:       d,
+		streams:    streams,
+		keystore:   NewKeystore(),
+		truststore: NewTruststore(),
+		authGuard:  NewAuthGuard(),
+	}
+	for _, opt := range opts {
+		if err := opt(s); err != nil {
+			return nil, err
+		}
 	}
 	s.sshHandler = NewSshHandler(s, d)
+	s.configured = NewConfiguredSubscriptions(s, d, s.sshHandler)
 
 	if err := d.Add("fc-netconf", Api(s)); err != nil {
-		panic(err)
+		return nil, fmt.Errorf("could not register fc-netconf. %w", err)
+	}
+	if err := d.Add("ietf-keystore", keystoreApi(s.keystore)); err != nil {
+		return nil, fmt.Errorf("could not register ietf-keystore. %w", err)
+	}
+	if err := d.Add("ietf-truststore", truststoreApi(s.truststore)); err != nil {
+		return nil, fmt.Errorf("could not register ietf-truststore. %w", err)
 	}
 	if err := d.Add("ietf-subscribed-notifications", estream.Manage(streams)); err != nil {
-		panic(err)
+		return nil, fmt.Errorf("could not register ietf-subscribed-notifications. %w", err)
+	}
+	if err := d.Add("ietf-netconf-notifications", baseEvents(s)); err != nil {
+		return nil, fmt.Errorf("could not register ietf-netconf-notifications. %w", err)
+	}
+	if b, err := d.Browser("ietf-netconf-notifications"); err != nil {
+		return nil, err
+	} else if err = useBaseEventsWhen(b.Meta); err != nil {
+		return nil, err
+	}
+	if err := d.Add("nc-notifications", ncNotifications(s)); err != nil {
+		return nil, fmt.Errorf("could not register nc-notifications. %w", err)
+	}
+	s.describeStream(StreamInfo{
+		Name:        NetconfStream,
+		Description: "Default NETCONF event stream with all notifications from every module",
+	})
+	err := s.AddStream(estream.Stream{
+		Name: "fc-netconf:auth-event",
+		Open: func() (*node.Selection, error) {
+			b, err := d.Browser("fc-netconf")
+			if err != nil {
+				return nil, err
+			}
+			return b.Root().Find("auth-event")
+		},
+	}, "Successful and failed authentication attempts")
+	if err != nil {
+		return nil, err
+	}
+	// each base event is also available on it's own for subscriptions
+	// through ietf-subscribed-notifications
+	for _, name := range []string{EventConfigChange, EventCapabilityChange, EventSessionStart, EventSessionEnd, EventConfirmedCommit} {
+		event := name
+		err := s.AddStream(estream.Stream{
+			Name: "ietf-netconf-notifications:" + event,
+			Open: func() (*node.Selection, error) {
+				b, err := d.Browser("ietf-netconf-notifications")
+				if err != nil {
+					return nil, err
+				}
+				return b.Root().Find(event)
+			},
+		}, "RFC 6470 "+event+" base notification")
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// how often Shutdown checks if all sessions have ended
+const shutdownPollInterval = 50 * time.Millisecond
+
+// Shutdown stops accepting connections and asks every session to end once
+// it's rpc in progress is answered. Subscribers receive a final
+// notificationComplete.  If ctx is done before all sessions end, remaining
+// sessions are killed and ctx's error is returned. Server cannot be
+// restarted.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.inShutdown.Store(true)
+	defer s.closeReplayLogs()
+	s.configured.stop()
+	s.sshHandler.Stop()
+	for _, ses := range s.Sessions() {
+		ses.Shutdown()
+	}
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		remaining := s.Sessions()
+		if len(remaining) == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			for _, ses := range remaining {
+				fc.Info.Printf("shutdown deadline, aborting ses=%d", ses.Id)
+				ses.abort()
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
 	}
-	return s
 }
 
 func (s *Server) StreamService() *estream.Service {
 	return s.streams
 }
 
+func (s *Server) Keystore() *Keystore {
+	return s.keystore
+}
+
+func (s *Server) Truststore() *Truststore {
+	return s.truststore
+}
+
+func (s *Server) AuthGuard() *AuthGuard {
+	return s.authGuard
+}
+
+// Rpcs is where to register handlers for operations that are not YANG rpcs
+// or to replace built-in operations
+func (s *Server) Rpcs() *RpcRegistry {
+	s.rpcsInit.Do(func() {
+		s.rpcs = NewRpcRegistry()
+	})
+	return s.rpcs
+}
+
+// Subscriptions are the dynamic subscriptions of all sessions
+func (s *Server) Subscriptions() *Subscriptions {
+	s.subsInit.Do(func() {
+		s.subs = NewSubscriptions()
+	})
+	return s.subs
+}
+
+// ConfiguredSubscriptions are subscriptions in server's configuration that
+// are sent to receivers server connects to
+func (s *Server) ConfiguredSubscriptions() *ConfiguredSubscriptions {
+	return s.configured
+}
+
 func (s *Server) HandleErr(err error) {
+	if s.onErr != nil {
+		s.onErr(err)
+		return
+	}
 	fc.Err.Print(err)
 }
 
 func (s *Server) NextSessionId() int64 {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
 	s.sessNum++
 	return s.sessNum
 }
+
+// AddSession registers a live session so it can be found by other sessions
+func (s *Server) AddSession(ses *Session) {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	if s.sessions == nil {
+		s.sessions = make(map[int64]*Session)
+	}
+	s.sessions[ses.Id] = ses
+	if s.inShutdown.Load() {
+		// connection was accepted just before shutdown
+		ses.Shutdown()
+	}
+}
+
+func (s *Server) RemoveSession(ses *Session) {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	delete(s.sessions, ses.Id)
+}
+
+func (s *Server) FindSession(id int64) *Session {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	return s.sessions[id]
+}
+
+// Sessions are all live sessions ordered by id
+func (s *Server) Sessions() []*Session {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	sessions := make([]*Session, 0, len(s.sessions))
+	for _, ses := range s.sessions {
+		sessions = append(sessions, ses)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Id < sessions[j].Id
+	})
+	return sessions
+}
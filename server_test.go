@@ -1,7 +1,15 @@
 package netconf
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/freeconf/restconf"
 	"github.com/freeconf/restconf/device"
@@ -10,6 +18,7 @@ import (
 	"github.com/freeconf/yang/node"
 	"github.com/freeconf/yang/nodeutil"
 	"github.com/freeconf/yang/source"
+	"golang.org/x/crypto/ssh"
 )
 
 func TestServer(t *testing.T) {
@@ -21,6 +30,7 @@ func TestServer(t *testing.T) {
 	streams := estream.NewService()
 	d := device.New(ypath)
 	s := NewServer(d, streams)
+	defer s.Shutdown(context.Background())
 	d.Add("fc-netconf", Api(s))
 	b, err := d.Browser("fc-netconf")
 	fc.RequireEqual(t, nil, err)
@@ -58,3 +68,200 @@ func readJson(s string) node.Node {
 	}
 	return n
 }
+
+func TestHostKeyGeneration(t *testing.T) {
+	dir := t.TempDir()
+	start := func(port string) (*Server, *node.Browser) {
+		d := device.New(testYPath)
+		s := NewServer(d, estream.NewService())
+		t.Cleanup(func() { s.Shutdown(context.Background()) })
+		b, err := d.Browser("fc-netconf")
+		fc.RequireEqual(t, nil, err)
+		err = b.Root().UpdateFrom(readJson(fmt.Sprintf(`
+		{
+			"ssh": {
+				"options" : {
+					"port" : "%s",
+					"hostKeyDir" : "%s",
+					"hostKeyTypes" : ["ed25519", "ecdsa-p256"]
+				}
+			}
+		}
+		`, port, dir)))
+		fc.RequireEqual(t, nil, err)
+		return s, b
+	}
+	s, b := start("127.0.0.1:9002")
+	generated := s.sshHandler.Status().HostKeyFingerprints
+	fc.AssertEqual(t, 2, len(generated))
+	_, err := os.Stat(filepath.Join(dir, "ssh_host_ed25519_key"))
+	fc.AssertEqual(t, nil, err)
+
+	// keys are reused on next start
+	s, b = start("127.0.0.1:9003")
+	fc.AssertEqual(t, generated, s.sshHandler.Status().HostKeyFingerprints)
+
+	sel, err := b.Root().Find("ssh/rotate-host-key")
+	fc.RequireEqual(t, nil, err)
+	out, err := sel.Action(readJson(`{"algorithm":"ed25519"}`))
+	fc.RequireEqual(t, nil, err)
+	pub, err := out.GetValue("public-key")
+	fc.AssertEqual(t, nil, err)
+	fc.AssertEqual(t, true, strings.HasPrefix(pub.String(), "ssh-ed25519 "))
+
+	// old key still in use until retired
+	status := s.sshHandler.Status()
+	fc.AssertEqual(t, generated, status.HostKeyFingerprints)
+	fc.AssertEqual(t, 1, len(status.NextHostKeyFingerprints))
+	next := status.NextHostKeyFingerprints[0]
+	_, err = os.Stat(filepath.Join(dir, "ssh_host_ed25519_key.next"))
+	fc.AssertEqual(t, nil, err)
+
+	// both keys can be proven to clients
+	var payload []byte
+	for _, k := range append(s.sshHandler.hostKeys, s.sshHandler.nextHostKeys...) {
+		payload = append(payload, sshString(k.PublicKey().Marshal())...)
+	}
+	sigs, err := s.sshHandler.proveHostKeys([]byte("session"), payload)
+	fc.RequireEqual(t, nil, err)
+	for _, k := range append(s.sshHandler.hostKeys, s.sshHandler.nextHostKeys...) {
+		var blob []byte
+		blob, sigs, err = parseSshString(sigs)
+		fc.RequireEqual(t, nil, err)
+		var sig ssh.Signature
+		fc.RequireEqual(t, nil, ssh.Unmarshal(blob, &sig))
+		var data []byte
+		data = append(data, sshString([]byte(hostKeysProveRequest))...)
+		data = append(data, sshString([]byte("session"))...)
+		data = append(data, sshString(k.PublicKey().Marshal())...)
+		fc.AssertEqual(t, nil, k.PublicKey().Verify(data, &sig))
+	}
+
+	// rotation survives restart
+	s, b = start("127.0.0.1:9006")
+	fc.AssertEqual(t, []string{next}, s.sshHandler.Status().NextHostKeyFingerprints)
+
+	sel, err = b.Root().Find("ssh/retire-host-key")
+	fc.RequireEqual(t, nil, err)
+	_, err = sel.Action(readJson(`{"algorithm":"ed25519"}`))
+	fc.RequireEqual(t, nil, err)
+	status = s.sshHandler.Status()
+	fc.AssertEqual(t, next, status.HostKeyFingerprints[0])
+	fc.AssertEqual(t, generated[1], status.HostKeyFingerprints[1])
+	fc.AssertEqual(t, 0, len(status.NextHostKeyFingerprints))
+	_, err = os.Stat(filepath.Join(dir, "ssh_host_ed25519_key.next"))
+	fc.AssertEqual(t, true, os.IsNotExist(err))
+
+	// nothing left to retire
+	_, err = sel.Action(readJson(`{"algorithm":"ed25519"}`))
+	fc.AssertEqual(t, true, err != nil)
+}
+
+func TestSshLoginTimeout(t *testing.T) {
+	d := device.New(testYPath)
+	s := NewServer(d, estream.NewService())
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+	err := s.sshHandler.Apply(SshOptions{
+		Port:         "127.0.0.1:9007",
+		HostKeyFile:  "testdata/host.key",
+		HelloTimeout: 1,
+	})
+	fc.RequireEqual(t, nil, err)
+	c, err := net.Dial("tcp", "127.0.0.1:9007")
+	fc.RequireEqual(t, nil, err)
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// client that never handshakes is dropped
+	_, err = io.ReadAll(c)
+	fc.AssertEqual(t, nil, err)
+	fc.AssertEqual(t, int32(0), s.sshHandler.unauthenticated.Load())
+}
+
+func TestBadHostKeyFile(t *testing.T) {
+	bad := filepath.Join(t.TempDir(), "bad.key")
+	fc.RequireEqual(t, nil, os.WriteFile(bad, []byte("not a key"), 0600))
+	h := NewSshHandler(nil, nil)
+	err := h.Apply(SshOptions{Port: "127.0.0.1:9004", HostKeyFile: bad})
+	fc.AssertEqual(t, true, err != nil)
+	fc.AssertEqual(t, false, h.Status().Running)
+}
+
+func TestRestrictHostKeyAlgorithms(t *testing.T) {
+	ks := NewKeystore()
+	var signers []ssh.Signer
+	for _, alg := range []string{AlgEd25519, AlgRsa2048} {
+		_, err := ks.GenerateKey(alg, alg)
+		fc.RequireEqual(t, nil, err)
+		signer, err := ks.SshSigner(alg)
+		fc.RequireEqual(t, nil, err)
+		signers = append(signers, signer)
+	}
+	restricted, err := restrictHostKeyAlgorithms(signers, []string{ssh.KeyAlgoRSASHA512})
+	fc.RequireEqual(t, nil, err)
+	fc.RequireEqual(t, 1, len(restricted))
+	multi := restricted[0].(ssh.MultiAlgorithmSigner)
+	fc.AssertEqual(t, []string{ssh.KeyAlgoRSASHA512}, multi.Algorithms())
+
+	restricted, err = restrictHostKeyAlgorithms(signers, []string{ssh.KeyAlgoED25519, ssh.KeyAlgoRSASHA256})
+	fc.RequireEqual(t, nil, err)
+	fc.AssertEqual(t, 2, len(restricted))
+}
+
+func TestServerShutdown(t *testing.T) {
+	var errs []error
+	d, s := newTestServer(t, nil, WithErrorHandler(func(err error) {
+		errs = append(errs, err)
+	}))
+	_, err := New(d, estream.NewService(), WithKeystore(nil))
+	fc.AssertEqual(t, true, err != nil)
+
+	// transport would normally do this
+	connect := func() (*Session, chan error, *io.PipeWriter) {
+		rdr, wtr := io.Pipe()
+		ses := NewSession(s, "joe", d, rdr, io.Discard)
+		s.AddSession(ses)
+		done := make(chan error, 1)
+		go func() {
+			err := ses.readMessages(ses.Context())
+			ses.close()
+			s.RemoveSession(ses)
+			done <- err
+		}()
+		return ses, done, wtr
+	}
+	_, polite, wtr := connect()
+	go wtr.Write([]byte(testClientHello))
+	_, rude, _ := connect()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	err = s.Shutdown(ctx)
+	fc.AssertEqual(t, context.DeadlineExceeded, err)
+	fc.AssertEqual(t, ErrEOS, <-polite)
+	// never sent hello so had to be aborted
+	fc.AssertEqual(t, io.ErrClosedPipe, <-rude)
+	fc.AssertEqual(t, 0, len(s.Sessions()))
+	fc.AssertEqual(t, 0, len(errs))
+
+	fc.AssertEqual(t, ErrServerClosed, s.sshHandler.Apply(SshOptions{Port: "127.0.0.1:9004"}))
+}
+
+func TestSshStopDuringApply(t *testing.T) {
+	_, s := newTestServer(t, nil)
+	h := s.sshHandler
+	stopped := make(chan struct{})
+	go func() {
+		h.Stop()
+		close(stopped)
+	}()
+	err := h.Apply(SshOptions{Port: "127.0.0.1:0", HostKeyFile: "testdata/host.key"})
+	<-stopped
+	if err != nil {
+		fc.AssertEqual(t, ErrServerClosed, err)
+	}
+	// not listening no matter which came first
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fc.AssertEqual(t, true, h.listener == nil)
+}
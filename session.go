@@ -1,12 +1,19 @@
 package netconf
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
+	"net"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/freeconf/restconf/device"
 	"github.com/freeconf/restconf/estream"
@@ -18,28 +25,58 @@ import (
 )
 
 type Session struct {
-	dev   device.Device
-	mgr   SessionManager
-	out   io.Writer
-	inRaw io.Reader
-	in    <-chan io.Reader
-	Id    int64
-	user  string
-	subs  []func()
+	dev          device.Device
+	mgr          SessionManager
+	wtr          *msgWriter
+	inRaw        io.Reader
+	in           <-chan io.Reader
+	depth        int
+	Id           int64
+	user         string
+	subsMu       sync.Mutex
+	subs         map[int]func()
+	lastSub      int
+	afterReply   []func()
+	helloTimeout time.Duration
+	idleTimeout  time.Duration
+	transport    string
+	remoteAddr   string
+	started      time.Time
+	ctx          context.Context
+	cancel       context.CancelFunc
+	killedBy     atomic.Int64
+	closing      chan struct{}
+	closingOnce  sync.Once
+	endReason    atomic.Pointer[string]
+
+	// session-start was published so session-end is too
+	startPublished atomic.Bool
+
+	// optional, called once hello is exchanged
+	onStart func(*Session)
 }
 
+// default number of requests decoded while another request is executing
+const defaultPipelineDepth = 16
+
 // ErrEOS signals the session should be closed gracefully.
 var ErrEOS = errors.New("end of session") // not really an error but linter wants "Err" prefix
 
 func NewSession(mgr SessionManager, user string, dev device.Device, in io.Reader, out io.Writer) *Session {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Session{
-		mgr:   mgr,
-		dev:   dev,
-		Id:    mgr.NextSessionId(),
-		inRaw: in,
-		in:    NewChunkedRdr(in),
-		out:   out,
-		user:  user,
+		ctx:     ctx,
+		cancel:  cancel,
+		mgr:     mgr,
+		dev:     dev,
+		Id:      mgr.NextSessionId(),
+		inRaw:   in,
+		depth:   defaultPipelineDepth,
+		wtr:     newMsgWriter(out, defaultOutQueueLen),
+		user:    user,
+		started: time.Now(),
+		closing: make(chan struct{}),
+		subs:    make(map[int]func()),
 	}
 }
 
@@ -47,58 +84,299 @@ func (ses *Session) User() string {
 	return ses.user
 }
 
+// Transport is the ietf-netconf-monitoring identity of the transport
+// (e.g. netconf-ssh)
+func (ses *Session) Transport() string {
+	return ses.transport
+}
+
+func (ses *Session) RemoteAddress() string {
+	return ses.remoteAddr
+}
+
+// sourceHost is remote address w/o port
+func (ses *Session) sourceHost() string {
+	host, _, err := net.SplitHostPort(ses.remoteAddr)
+	if err != nil {
+		return ses.remoteAddr
+	}
+	return host
+}
+
+// setEndReason records why session is ending. First reason wins as that is
+// the cause and the rest are consequences.
+func (ses *Session) setEndReason(reason string) {
+	ses.endReason.CompareAndSwap(nil, &reason)
+}
+
+func (ses *Session) StartTime() time.Time {
+	return ses.started
+}
+
+// Kill aborts the session on behalf of another session. Operation in progress
+// is cancelled and transport is closed.  Subscriptions and locks are released
+// as the session ends.
+func (ses *Session) Kill(killedBy int64) {
+	fc.Info.Printf("ses=%d killed by ses=%d", ses.Id, killedBy)
+	ses.killedBy.Store(killedBy)
+	ses.setEndReason(TerminationKilled)
+	ses.abort()
+}
+
+func (ses *Session) abort() {
+	ses.cancel()
+	ses.closeTransport()
+}
+
+// Shutdown asks session to end once rpc in progress, if any, is answered.
+// Requests not yet started are discarded and subscribers are told no more
+// notifications are coming.
+func (ses *Session) Shutdown() {
+	ses.closingOnce.Do(func() {
+		close(ses.closing)
+	})
+}
+
+// Context is cancelled when session ends for any reason
+func (ses *Session) Context() context.Context {
+	return ses.ctx
+}
+
+// KilledBy is the session id that killed this session or zero
+func (ses *Session) KilledBy() int64 {
+	return ses.killedBy.Load()
+}
+
+// DroppedNotifications is the number of notifications not sent because
+// client was not keeping up
+func (ses *Session) DroppedNotifications() int64 {
+	return ses.wtr.Dropped()
+}
+
+// closeTransport unblocks any reads so session ends
+func (ses *Session) closeTransport() {
+	if c, valid := ses.inRaw.(io.Closer); valid {
+		c.Close()
+	}
+}
+
+// addSub keeps closer to call when session ends. Call returned function when
+// subscription ends on its own so it no longer keeps session alive.
+func (ses *Session) addSub(closer func()) func() {
+	ses.subsMu.Lock()
+	defer ses.subsMu.Unlock()
+	ses.lastSub++
+	id := ses.lastSub
+	ses.subs[id] = closer
+	return func() {
+		ses.subsMu.Lock()
+		defer ses.subsMu.Unlock()
+		delete(ses.subs, id)
+	}
+}
+
+// hasSubs is true while session has any active subscription
+func (ses *Session) hasSubs() bool {
+	ses.subsMu.Lock()
+	defer ses.subsMu.Unlock()
+	return len(ses.subs) > 0
+}
+
+func (ses *Session) closeSubs() {
+	ses.subsMu.Lock()
+	subs := ses.subs
+	ses.subs = make(map[int]func())
+	ses.subsMu.Unlock()
+	for _, closer := range subs {
+		closer()
+	}
+}
+
 func (ses *Session) close() {
-	for _, sub := range ses.subs {
-		sub()
+	// writer first so subscriptions waiting to send give up
+	ses.wtr.Close()
+	ses.closeSubs()
+	ses.cancel()
+	ses.setEndReason(TerminationDropped)
+	reason := *ses.endReason.Load()
+	if !ses.startPublished.Load() && reason != TerminationBadHello {
+		// never a session as far as clients are concerned, e.g. no hello
+		// before timeout
+		return
 	}
+	e := NetconfEvent{
+		Type:              EventSessionEnd,
+		Username:          ses.user,
+		SessionId:         ses.Id,
+		SourceHost:        ses.sourceHost(),
+		TerminationReason: reason,
+	}
+	if e.TerminationReason == TerminationKilled {
+		e.KilledBy = ses.KilledBy()
+	}
+	ses.mgr.PublishEvent(e)
 }
 
 func (ses *Session) readMessages(ctx context.Context) error {
-	hello, err := DecodeRequest(ses.inRaw)
+	var helloTimer *time.Timer
+	if ses.helloTimeout > 0 {
+		helloTimer = time.AfterFunc(ses.helloTimeout, func() {
+			fc.Info.Printf("no hello received, closing ses=%d", ses.Id)
+			ses.closeTransport()
+		})
+	}
+	// hello uses end-of-message framing, everything after is chunked so hello
+	// is read precisely w/o consuming what follows
+	raw := bufio.NewReader(ses.inRaw)
+	helloMsg, err := readEomMessage(raw)
+	if helloTimer != nil {
+		helloTimer.Stop()
+	}
 	if err != nil {
 		return err
 	}
-	if hello.Hello == nil {
-		return errors.New("expected initial hello message")
+	hello, err := DecodeRequest(bytes.NewReader(helloMsg))
+	if err == nil && hello.Hello == nil {
+		err = errors.New("expected initial hello message")
 	}
-	fc.Debug.Printf("got hello request ses=%d", ses.Id)
-	if err = ses.handleHello(hello.Hello); err != nil {
+	if err == nil {
+		fc.Debug.Printf("got hello request ses=%d", ses.Id)
+		err = ses.handleHello(hello.Hello)
+	}
+	if err != nil {
+		ses.setEndReason(TerminationBadHello)
 		return err
 	}
+	ses.startPublished.Store(true)
+	ses.mgr.PublishEvent(NetconfEvent{
+		Type:       EventSessionStart,
+		Username:   ses.user,
+		SessionId:  ses.Id,
+		SourceHost: ses.sourceHost(),
+	})
+	if ses.onStart != nil {
+		ses.onStart(ses)
+	}
+	ses.in = NewChunkedRdr(raw)
+
+	// stops read ahead and discards any requests still queued when session
+	// ends from close-session, kill-session or otherwise
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	reqs := ses.readAhead(ctx)
 	for {
-		err := ses.readRequest(ctx)
-		if err != nil {
+		if err := ses.readRequest(ctx, reqs); err != nil {
+			if n := len(reqs); n > 0 {
+				fc.Debug.Printf("discarding %d pipelined requests ses=%d", n, ses.Id)
+			}
 			return err
 		}
 	}
 }
 
-func (ses *Session) readRequest(ctx context.Context) error {
-	select {
-	case <-ctx.Done():
-		return ErrEOS
-	case in := <-ses.in:
-		req, err := DecodeRequest(in)
-		if err != nil || req == nil {
-			return err
+type pipelinedReq struct {
+	req *Request
+	err error
+}
+
+// readAhead decodes requests while the current request executes so clients
+// can send many requests w/o waiting on each reply.  Requests are still
+// executed and answered strictly in the order received.  Once depth requests
+// are waiting, reading stops which holds back the client thru transport flow
+// control.
+func (ses *Session) readAhead(ctx context.Context) <-chan pipelinedReq {
+	reqs := make(chan pipelinedReq, ses.depth)
+	go func() {
+		defer close(reqs)
+		for {
+			var in io.Reader
+			select {
+			case <-ctx.Done():
+				return
+			case next, valid := <-ses.in:
+				if !valid {
+					return
+				}
+				in = next
+			}
+			req, err := DecodeRequest(in)
+			// drain anything trailing the message so chunk reader is not blocked
+			io.Copy(io.Discard, in)
+			select {
+			case <-ctx.Done():
+				return
+			case reqs <- pipelinedReq{req: req, err: err}:
+			}
+			if err != nil {
+				return
+			}
 		}
-		if req.Rpc != nil {
-			return ses.handleRpc(req.Rpc)
+	}()
+	return reqs
+}
+
+func (ses *Session) readRequest(ctx context.Context, reqs <-chan pipelinedReq) error {
+	var idle <-chan time.Time
+	if ses.idleTimeout > 0 {
+		t := time.NewTimer(ses.idleTimeout)
+		defer t.Stop()
+		idle = t.C
+	}
+	for {
+		// shutdown takes priority over any requests waiting
+		select {
+		case <-ses.closing:
+			return ses.shutdown()
+		default:
 		}
-		if req.Hello != nil {
-			return ses.handleHello(req.Hello)
+		select {
+		case <-ctx.Done():
+			return ErrEOS
+		case <-ses.closing:
+			return ses.shutdown()
+		case <-idle:
+			if ses.hasSubs() {
+				// subscriptions keep session alive
+				idle = time.After(ses.idleTimeout)
+				continue
+			}
+			fc.Info.Printf("idle timeout, closing ses=%d", ses.Id)
+			ses.setEndReason(TerminationTimeout)
+			return ErrEOS
+		case p, valid := <-reqs:
+			if !valid {
+				return ErrEOS
+			}
+			if p.err != nil || p.req == nil {
+				return p.err
+			}
+			req := p.req
+			if req.Rpc != nil {
+				return ses.handleRpc(ctx, req.Rpc)
+			}
+			if req.Hello != nil {
+				return ses.handleHello(req.Hello)
+			}
+			return fmt.Errorf("unsupported message %s", req.Other.XMLName.Local)
 		}
-		return fmt.Errorf("unsupported message %s", req.Other.XMLName.Local)
 	}
 }
 
-func (ses *Session) readFilter(f *RpcFilter, c node.ContentConstraint) ([]*node.Selection, error) {
+// readFilter selects data in dev that filter selects
+func readFilter(ctx context.Context, dev device.Device, f *RpcFilter, c node.ContentConstraint) ([]*node.Selection, error) {
 	if f == nil {
 		// Sec 6.4.1 - no filter returns all data
 		f = &RpcFilter{}
-		for name := range ses.dev.Modules() {
+		for name := range dev.Modules() {
 			f.Elems = append(f.Elems, &Msg{XMLName: xml.Name{Local: name}})
 		}
+	} else if f.Type == "xpath" {
+		sel, err := f.CompileXPathWithContext(ctx, dev)
+		if err != nil || sel == nil {
+			return nil, err
+		}
+		sel.Constraints.AddConstraint("content", 0, 0, contentKeys{c})
+		return []*node.Selection{sel}, nil
 	} else if len(f.Elems) == 0 {
 		// Sec 6.4.1 - empty filter returns nothing
 		return nil, nil
@@ -106,27 +384,21 @@ func (ses *Session) readFilter(f *RpcFilter, c node.ContentConstraint) ([]*node.
 
 	var sels = make([]*node.Selection, 0)
 	for _, e := range f.Elems {
-		b, err := ses.dev.Browser(e.XMLName.Local)
+		b, err := dev.Browser(e.XMLName.Local)
 		if err != nil {
 			return nil, err
 		}
 		if b == nil {
-			return nil, fmt.Errorf("browser for '%s' not found", e.XMLName.Local)
+			return nil, NewRpcError("application", "unknown-element", fmt.Sprintf("module '%s' not found", e.XMLName.Local))
 		}
 		if e.XMLName.Space != "" {
 			if b.Meta.Namespace() != e.XMLName.Space {
 				continue
 			}
 		}
-		sel := b.Root()
-		sel.Constraints.AddConstraint("content", 0, 0, c)
-		if f.Type == "xpath" {
-			sel, err := f.CompileXPath(ses.dev)
-			if err != nil {
-				return nil, err
-			}
-			sels = append(sels, sel)
-		} else if f.Type == "subtree" || f.Type == "" {
+		sel := b.RootWithContext(ctx)
+		sel.Constraints.AddConstraint("content", 0, 0, contentKeys{c})
+		if f.Type == "subtree" || f.Type == "" {
 			var f subtreeFilter
 			if err := compileSubtree(e, &f); err != nil {
 				return nil, err
@@ -139,17 +411,39 @@ func (ses *Session) readFilter(f *RpcFilter, c node.ContentConstraint) ([]*node.
 	return sels, nil
 }
 
+// contentKeys is content constraint except list entries always have their
+// keys, otherwise entries of state data could not be told apart
+type contentKeys struct {
+	node.ContentConstraint
+}
+
+func (c contentKeys) CheckFieldPreConstraints(r *node.FieldRequest, hnd *node.ValueHandle) (bool, error) {
+	// selection is the leaf itself when reading one value so go by leaf's
+	// parent
+	if parent, valid := r.Meta.Parent().(meta.Definition); valid && isKey(parent, r.Meta.Ident()) {
+		return true, nil
+	}
+	return c.ContentConstraint.CheckFieldPreConstraints(r, hnd)
+}
+
 func (ses *Session) findBrowserByNs(ns string) (*node.Browser, error) {
 	for _, mod := range ses.dev.Modules() {
 		if mod.Namespace() == ns {
 			return ses.dev.Browser(mod.Ident())
 		}
 	}
-	return nil, fmt.Errorf("browser for namespace '%s' not found", ns)
+	return nil, NewRpcError("protocol", "unknown-namespace", fmt.Sprintf("module with namespace '%s' not found", ns))
 }
 
 const (
 	Base_1_1 = "urn:ietf:params:netconf:base:1.1"
+
+	// namespace of replayComplete and notificationComplete
+	NotificationCompleteNs = "urn:ietf:params:xml:ns:netmod:notification"
+
+	// namespace of fc-netconf module and of freeconf extension attributes
+	// like max-depth on get
+	FreeconfNs = "org.freeconf/restconf"
 )
 
 func (ses *Session) Hello() *HelloMsg {
@@ -160,16 +454,61 @@ func (ses *Session) Hello() *HelloMsg {
 		Capabilities: []*Msg{
 			{Content: Base_1_1},
 			{Content: "urn:ietf:params:netconf:capability:notification:1.0"},
+			// replies and notifications are whole messages on a shared queue
+			{Content: "urn:ietf:params:netconf:capability:interleave:1.0"},
+			// establish-subscription and friends, RFC 8640 Sec. 2
+			{Content: SubscribedNotificationsNs + "?module=ietf-subscribed-notifications&revision=2019-09-09"},
+			// get-data and edit-data, RFC 8526 Sec. 2
+			{Content: NmdaNs + "?module=ietf-netconf-nmda&revision=2019-01-07&features=origin,with-defaults"},
+			// compare, RFC 9144 Sec. 3, of running, intended and operational
+			// only
+			{Content: CompareNs + "?module=ietf-nmda-compare&revision=2021-12-10"},
+			// list-pagination on get and get-config
+			{Content: ListPaginationNcNs + "?module=ietf-list-pagination-nc&revision=2024-07-08"},
+			// fc:max-depth attribute on get and get-config
+			{Content: FreeconfNs + "?module=fc-netconf&features=max-depth"},
 		},
 	}
 }
 
-func (ses *Session) handleGet(get *RpcGet, resp *RpcReply, c node.ContentConstraint) error {
-	sels, err := ses.readFilter(get.Filter, c)
+func (ses *Session) handleGet(ctx context.Context, get *RpcGet, resp *RpcReply, c node.ContentConstraint) error {
+	if get.Pagination != nil {
+		return ses.handleGetPage(ctx, get, resp, c)
+	}
+	sels, err := readFilter(ctx, ses.dev, get.Filter, c)
 	if err != nil {
 		return err
 	}
-	resp.Data = &RpcData{}
+	if err := limitDepth(get, sels); err != nil {
+		return err
+	}
+	nodes, err := encodeSelections(sels)
+	if err != nil {
+		return err
+	}
+	resp.Data = &RpcData{Nodes: nodes}
+	return nil
+}
+
+// limitDepth applies freeconf's max-depth extension on get and get-config
+func limitDepth(get *RpcGet, sels []*node.Selection) error {
+	depth := strings.TrimSpace(get.MaxDepth)
+	if depth == "" || depth == "unbounded" {
+		return nil
+	}
+	n, err := strconv.ParseUint(depth, 10, 16)
+	if err != nil || n == 0 {
+		return NewRpcError("protocol", "invalid-value", fmt.Sprintf("bad max-depth '%s'", depth))
+	}
+	for _, sel := range sels {
+		sel.Constraints.AddConstraint("depth", 10, 50, newMaxDepthStubs(sel, int(n)))
+	}
+	return nil
+}
+
+// encodeSelections writes data of each selection as an element
+func encodeSelections(sels []*node.Selection) ([]*nodeutil.XMLWtr2, error) {
+	var nodes []*nodeutil.XMLWtr2
 	for _, sel := range sels {
 		mod := meta.OriginalModule(sel.Meta())
 		cfg := &nodeutil.XMLWtr2{
@@ -179,37 +518,64 @@ func (ses *Session) handleGet(get *RpcGet, resp *RpcReply, c node.ContentConstra
 			},
 		}
 		if err := sel.UpsertInto(cfg); err != nil {
-			return err
+			return nil, err
 		}
-		resp.Data.Nodes = append(resp.Data.Nodes, cfg)
+		nodes = append(nodes, cfg)
 	}
-	return nil
+	return nodes, nil
 }
 
-func (ses *Session) handleEdit(edit *RpcEdit, resp *RpcReply) error {
+func (ses *Session) handleEdit(ctx context.Context, edit *RpcEdit, resp *RpcReply) error {
 	defaultOp := edit.DefaultOperation
 	if defaultOp == "" {
 		defaultOp = "merge"
 	}
 	if edit.Config == nil {
-		return fmt.Errorf("edit config with no config specified")
+		return NewRpcError("protocol", "missing-element", "edit config with no config specified")
 	}
-	for _, n := range edit.Config.Nodes {
+	if err := ses.editDatastore(ctx, defaultOp, edit.Config); err != nil {
+		return err
+	}
+	resp.OK = &Msg{}
+	return nil
+}
+
+// editDatastore applies config to running datastore and tells everyone
+// what changed
+func (ses *Session) editDatastore(ctx context.Context, defaultOp string, config *nodeutil.XmlNode) error {
+	change := NetconfEvent{
+		Type:      EventConfigChange,
+		ChangedBy: sessionChangedBy(ses),
+		Datastore: "running",
+	}
+	defer func() {
+		// edits made before one fails are not undone so they are still
+		// changes
+		if len(change.Edit) > 0 {
+			ses.mgr.PublishEvent(change)
+		}
+	}()
+	for _, n := range config.Nodes {
 		b, err := ses.dev.Browser(n.XMLName.Local)
 		if err != nil {
 			return err
 		}
+		if b == nil {
+			return NewRpcError("application", "unknown-element", fmt.Sprintf("module '%s' not found", n.XMLName.Local))
+		}
 		edits, err := buildEdits(defaultOp, n, b.Meta)
 		if err != nil {
 			return err
 		}
-		root := b.Root()
+		root := b.RootWithContext(ctx)
 		for _, e := range edits {
 			sel, err := root.Find(e.path)
 			if err != nil {
 				return err
 			}
 			switch e.op {
+			case "none":
+				continue
 			case "merge":
 				err = sel.UpsertFrom(e.n)
 			case "replace":
@@ -222,27 +588,41 @@ func (ses *Session) handleEdit(edit *RpcEdit, resp *RpcReply) error {
 				}
 			case "delete":
 				if sel == nil {
-					err = fmt.Errorf("node with path '%s' does not exist.  try remove operation to ignore this error", e.path)
+					err = NewRpcError("application", "data-missing", fmt.Sprintf("node with path '%s' does not exist.  try remove operation to ignore this error", e.path))
 				} else {
 					err = sel.Delete()
 				}
 			default:
-				return fmt.Errorf("edit config operation '%s' not implemented or recognized", e.op)
+				return NewRpcError("protocol", "invalid-value", fmt.Sprintf("edit config operation '%s' not implemented or recognized", e.op))
 			}
-			if err == nil {
+			if err != nil {
 				return err
 			}
+			targets := []string{e.path}
+			if e.path == "" {
+				// edit of whole module, top-most nodes are the children
+				targets = targets[:0]
+				for _, child := range e.n.Nodes {
+					targets = append(targets, child.XMLName.Local)
+				}
+			}
+			for _, target := range targets {
+				change.Edit = append(change.Edit, &ConfigEdit{
+					Target:    instanceIdentifier(b.Meta, target),
+					Operation: e.op,
+				})
+			}
 		}
 	}
 	return nil
 }
 
-func (ses *Session) handleAction(rpc *nodeutil.XmlNode) (*nodeutil.XMLWtr2, error) {
+func (ses *Session) handleAction(ctx context.Context, rpc *nodeutil.XmlNode) (*nodeutil.XMLWtr2, error) {
 	b, err := ses.findBrowserByNs(rpc.XMLName.Space)
 	if err != nil {
 		return nil, err
 	}
-	sel, err := b.Root().Find(rpc.XMLName.Local)
+	sel, err := b.RootWithContext(ctx).Find(rpc.XMLName.Local)
 	if err != nil {
 		return nil, err
 	}
@@ -260,52 +640,32 @@ func (ses *Session) handleAction(rpc *nodeutil.XmlNode) (*nodeutil.XMLWtr2, erro
 	return nil, nil
 }
 
-func (ses *Session) handleRpc(rpc *RpcMsg) error {
+func (ses *Session) handleRpc(ctx context.Context, rpc *RpcMsg) error {
+	ctx = WithRpcContext(ctx, &RpcContext{
+		SessionId: ses.Id,
+		User:      ses.user,
+		MessageId: rpc.MessageId,
+	})
 	close := false
-	var err error
 	resp := &RpcReply{MessageId: rpc.MessageId}
-	if rpc.GetConfig != nil {
-		fc.Debug.Printf("get config message ses=%d", ses.Id)
-		err = ses.handleGet(rpc.GetConfig, resp, node.ContentConfig)
-	} else if rpc.Get != nil {
-		fc.Debug.Printf("get metrics message ses=%d", ses.Id)
-		err = ses.handleGet(rpc.Get, resp, node.ContentOperational)
-	} else if rpc.EditConfig != nil {
-		fc.Debug.Printf("edit message ses=%d", ses.Id)
-		err = ses.handleEdit(rpc.EditConfig, resp)
-	} else if rpc.Kill != nil {
-		fc.Debug.Printf("kill message ses=%d", ses.Id)
-		// abort, unlock, rollback
-		resp.OK = &Msg{}
-		close = true
-	} else if rpc.Close != nil {
-		fc.Debug.Printf("close message ses=%d", ses.Id)
-		resp.OK = &Msg{}
+	err := ses.dispatchRpc(ctx, rpc, resp)
+	afterReply := ses.afterReply
+	ses.afterReply = nil
+	if err == ErrEOS {
 		close = true
-	} else if rpc.CreateSubscription != nil {
-		fc.Debug.Printf("create subscription message ses=%d", ses.Id)
-		err = ses.handleCreateSubscription(rpc.CreateSubscription)
-	} else if rpc.Action != nil {
-		fc.Debug.Printf("rpc/action ses=%d", ses.Id)
-		var out *nodeutil.XMLWtr2
-		out, err = ses.handleAction(rpc.Action)
-		if err == nil {
-			if out == nil {
-				resp.OK = &Msg{}
-			} else {
-				resp.Out = out.Elem
-			}
+	} else if err != nil {
+		var rpcErr *RpcError
+		if !errors.As(err, &rpcErr) {
+			return err
 		}
-	} else {
-		err = fmt.Errorf("unrecognized rpc command")
+		resp = &RpcReply{MessageId: rpc.MessageId, Errors: []*RpcError{rpcErr}}
+		afterReply = nil
 	}
-	if err != nil {
+	if err = ses.wtr.Send(resp); err != nil {
 		return err
 	}
-	out := NewChunkedWtr(ses.out)
-	defer out.Close()
-	if err = WriteResponse(resp, out); err != nil {
-		return err
+	for _, f := range afterReply {
+		f()
 	}
 	if close {
 		return ErrEOS
@@ -313,41 +673,211 @@ func (ses *Session) handleRpc(rpc *RpcMsg) error {
 	return nil
 }
 
+func (ses *Session) handleKill(kill *RpcKill, resp *RpcReply) error {
+	if kill.SessionId == ses.Id {
+		return NewRpcError("protocol", "invalid-value", "cannot kill own session, use close-session")
+	}
+	target := ses.mgr.FindSession(kill.SessionId)
+	if target == nil {
+		return NewRpcError("protocol", "invalid-value", fmt.Sprintf("session %d not found", kill.SessionId))
+	}
+	target.Kill(ses.Id)
+	resp.OK = &Msg{}
+	return nil
+}
+
 func (ses *Session) handleCreateSubscription(create *CreateSubscription) error {
-	req := estream.EstablishRequest{
-		Stream: create.Stream,
-		// pass along possible filter
+	if create.Stream == "" {
+		create.Stream = NetconfStream
 	}
-	sub, err := ses.mgr.StreamService().EstablishSubscription(req)
+	filter, err := compileEventFilter(ses.dev, create.Filter)
 	if err != nil {
 		return err
 	}
-	name := fmt.Sprintf("sub-%s", sub.Id)
-	err = sub.AddReceiver(name, func(e estream.ReceiverEvent) error {
-		var buf bytes.Buffer
+	if create.StartTime != nil || create.StopTime != nil {
+		return ses.subscribeReplay(create, filter)
+	}
+	closer, err := subscribeStream(ses.mgr, ses.dev, create.Stream, func(event *node.Selection, eventTime time.Time) error {
+		return ses.sendEvent(filter, event, eventTime)
+	})
+	if err != nil {
+		return err
+	}
+	ses.addSub(closer)
+	return nil
+}
 
-		var payload nodeutil.XMLWtr2
-		if err := e.Event.UpsertInto(&payload); err != nil {
-			return fmt.Errorf("error encoding event %w", err)
-		}
-		resp := Notification{
-			EventTime: e.EventTime,
-			Elems:     payload.Elem,
+// subscribeStream calls l with every event on stream until returned function
+// is called.  Streams in estream carry a single notification type so the
+// NETCONF stream cannot be one of them and subscribes directly to every
+// notification.  Any notification can also be subscribed to as
+// "module:notification" w/o being registered as a stream.
+func subscribeStream(mgr SessionManager, dev device.Device, stream string, l func(event *node.Selection, eventTime time.Time) error) (func(), error) {
+	if stream == NetconfStream {
+		closeAll, err := subscribeNetconfEvents(dev, func(n node.Notification) {
+			if err := l(n.Event, n.EventTime); err != nil {
+				fc.Debug.Printf("could not send notification. %s", err)
+			}
+		})
+		if err != nil {
+			return nil, err
 		}
-		WriteResponse(resp, &buf)
-		fmt.Println(buf.String())
-		out := NewChunkedWtr(ses.out)
-		defer out.Close()
-		if err = WriteResponse(resp, out); err != nil {
-			return fmt.Errorf("error encoding notification %w", err)
+		return func() {
+			fc.Debug.Printf("closing %s subscription", NetconfStream)
+			closeAll()
+		}, nil
+	}
+	sub, err := mgr.StreamService().EstablishSubscription(estream.EstablishRequest{
+		Stream: stream,
+	})
+	if err != nil {
+		// streams do not have to be registered to be subscribed to by
+		// module:notification
+		if _, _, splitErr := splitQualified(stream); splitErr == nil {
+			return subscribeNotification(dev, stream, l)
 		}
-		return nil
+		return nil, NewRpcError("protocol", "invalid-value", err.Error())
+	}
+	name := fmt.Sprintf("sub-%s", sub.Id)
+	err = sub.AddReceiver(name, func(e estream.ReceiverEvent) error {
+		return l(e.Event, e.EventTime)
 	})
-	ses.subs = append(ses.subs, func() {
+	if err != nil {
+		return nil, err
+	}
+	return func() {
 		fc.Debug.Printf("closing subscription %s", name)
 		sub.RemoveReceiver(name)
+	}, nil
+}
+
+// subscribeNotification calls l with every event of notification named as
+// "module:notification" until returned function is called
+func subscribeNotification(dev device.Device, qualified string, l func(event *node.Selection, eventTime time.Time) error) (func(), error) {
+	sel, err := findNotification(dev, qualified)
+	if err != nil {
+		return nil, NewRpcError("protocol", "invalid-value", err.Error())
+	}
+	closer, err := sel.Notifications(func(n node.Notification) {
+		if err := l(n.Event, n.EventTime); err != nil {
+			fc.Debug.Printf("could not send notification. %s", err)
+		}
 	})
-	return err
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		fc.Debug.Printf("closing %s subscription", qualified)
+		closer()
+	}, nil
+}
+
+// subscribeNetconfEvents calls l for every event on the NETCONF stream until
+// returned function is called
+func subscribeNetconfEvents(dev device.Device, l func(node.Notification)) (func(), error) {
+	sels, err := netconfStreamEvents(dev)
+	if err != nil {
+		return nil, err
+	}
+	var closers []node.NotifyCloser
+	for _, sel := range sels {
+		closer, err := sel.Notifications(l)
+		if err != nil {
+			// not every module implements all it's notifications, that
+			// should not keep client from getting the rest
+			fc.Debug.Printf("%s not on %s stream. %s", sel.Path, NetconfStream, err)
+			continue
+		}
+		closers = append(closers, closer)
+	}
+	return func() {
+		for _, closer := range closers {
+			closer()
+		}
+	}, nil
+}
+
+// netconfStreamEvents are the notifications carried on the NETCONF stream,
+// every notification in every module except the ones that only mark the
+// progress of a subscription.
+func netconfStreamEvents(dev device.Device) ([]*node.Selection, error) {
+	var modNames []string
+	for name := range dev.Modules() {
+		if name != "nc-notifications" {
+			modNames = append(modNames, name)
+		}
+	}
+	sort.Strings(modNames)
+	var sels []*node.Selection
+	for _, modName := range modNames {
+		b, err := dev.Browser(modName)
+		if err != nil {
+			return nil, err
+		}
+		if b == nil {
+			return nil, fmt.Errorf("%s not found", modName)
+		}
+		var events []string
+		for ident := range b.Meta.Notifications() {
+			events = append(events, ident)
+		}
+		sort.Strings(events)
+		for _, ident := range events {
+			sel, err := b.Root().Find(ident)
+			if err != nil {
+				return nil, err
+			}
+			sels = append(sels, sel)
+		}
+	}
+	return sels, nil
+}
+
+// encodeEvent is the element for the notification inside <notification>
+func encodeEvent(event *node.Selection) (*nodeutil.XMLWtr2, error) {
+	mod := meta.OriginalModule(event.Meta())
+	payload := &nodeutil.XMLWtr2{
+		XMLName: xml.Name{
+			Local: event.Meta().Ident(),
+			Space: mod.Namespace(),
+		},
+	}
+	if err := event.UpsertInto(payload); err != nil {
+		return nil, fmt.Errorf("error encoding event %w", err)
+	}
+	return payload, nil
+}
+
+// sendEvent sends event unless filter does not select it
+func (ses *Session) sendEvent(filter *eventFilter, event *node.Selection, eventTime time.Time) error {
+	event, err := filter.apply(event)
+	if err != nil || event == nil {
+		return err
+	}
+	payload, err := encodeEvent(event)
+	if err != nil {
+		return err
+	}
+	msg := &Notification{
+		EventTime: eventTime,
+		Elems:     []*nodeutil.XMLWtr2{payload},
+	}
+	if err := ses.notify(msg); err != nil {
+		return fmt.Errorf("error sending notification %w", err)
+	}
+	return nil
+}
+
+func (ses *Session) shutdown() error {
+	fc.Info.Printf("server shutdown, closing ses=%d", ses.Id)
+	ses.setEndReason(TerminationOther)
+	if ses.hasSubs() {
+		// RFC 5277 Sec. 2.2.1
+		if err := ses.notifyWait(subscriptionMarker("notificationComplete")); err != nil {
+			return err
+		}
+	}
+	return ErrEOS
 }
 
 func (ses *Session) handleHello(h *HelloMsg) error {
@@ -0,0 +1,177 @@
+package netconf
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/freeconf/restconf/device"
+	"github.com/freeconf/restconf/testdata"
+	"github.com/freeconf/yang/fc"
+	"github.com/freeconf/yang/node"
+	"github.com/freeconf/yang/nodeutil"
+	"github.com/freeconf/yang/source"
+)
+
+const testClientHello = `<hello xmlns="urn:ietf:params:xml:ns:netconf:base:1.0">
+	<capabilities>
+		<capability>urn:ietf:params:netconf:base:1.1</capability>
+	</capabilities>
+</hello>]]>]]>`
+
+func TestSessionHelloTimeout(t *testing.T) {
+	rdr, _ := io.Pipe()
+	var out bytes.Buffer
+	ses := NewSession(&Server{}, "joe", nil, rdr, &out)
+	ses.helloTimeout = 10 * time.Millisecond
+	err := ses.readMessages(context.Background())
+	fc.AssertEqual(t, io.ErrClosedPipe, err)
+}
+
+func TestSessionIdleTimeout(t *testing.T) {
+	rdr, wtr := io.Pipe()
+	var out bytes.Buffer
+	ses := NewSession(&Server{}, "joe", nil, rdr, &out)
+	ses.idleTimeout = 10 * time.Millisecond
+	go wtr.Write([]byte(testClientHello))
+	err := ses.readMessages(context.Background())
+	fc.AssertEqual(t, ErrEOS, err)
+}
+
+func TestKillSession(t *testing.T) {
+	srv := &Server{}
+	rt := newRpcTester(t, srv, nil)
+	ses := rt.ses
+	srv.AddSession(ses)
+	target := newRpcTester(t, srv, nil).ses
+	srv.AddSession(target)
+	fc.AssertEqual(t, 2, len(srv.Sessions()))
+
+	kill := func(id int64) string {
+		t.Helper()
+		return rt.send(`<kill-session><session-id>` + strconv.FormatInt(id, 10) + `</session-id></kill-session>`)
+	}
+	actual := kill(ses.Id)
+	fc.AssertEqual(t, true, strings.Contains(actual, "<error-tag>invalid-value</error-tag>"), actual)
+	actual = kill(99)
+	fc.AssertEqual(t, true, strings.Contains(actual, "<error-tag>invalid-value</error-tag>"), actual)
+	actual = kill(target.Id)
+	fc.AssertEqual(t, true, strings.Contains(actual, "<ok"), actual)
+	fc.AssertEqual(t, ses.Id, target.KilledBy())
+	err := target.readMessages(context.Background())
+	fc.AssertEqual(t, io.ErrClosedPipe, err)
+}
+
+func TestSessionPipelining(t *testing.T) {
+	chunk := func(msg string) string {
+		return fmt.Sprintf("\n#%d\n%s\n##\n", len(msg), msg)
+	}
+	rpc := `<rpc xmlns="urn:ietf:params:xml:ns:netconf:base:1.0" message-id="%d">%s</rpc>`
+	kill := `<kill-session><session-id>99</session-id></kill-session>`
+	in := testClientHello
+	for i := 1; i <= 3; i++ {
+		in += chunk(fmt.Sprintf(rpc, i, kill))
+	}
+	in += chunk(fmt.Sprintf(rpc, 4, `<close-session/>`))
+	// never executed, session is closed
+	in += chunk(fmt.Sprintf(rpc, 5, kill))
+	var out bytes.Buffer
+	ses := NewSession(&Server{}, "joe", nil, strings.NewReader(in), &out)
+	ses.depth = 2
+	err := ses.readMessages(context.Background())
+	fc.AssertEqual(t, ErrEOS, err)
+	var ids []string
+	for _, m := range strings.Split(out.String(), `message-id="`)[1:] {
+		ids = append(ids, m[:1])
+	}
+	fc.AssertEqual(t, "1,2,3,4", strings.Join(ids, ","))
+}
+
+func TestRpcContext(t *testing.T) {
+	d := device.New(source.Dir("./testdata/yang"))
+	var actual *RpcContext
+	d.Add("car", &nodeutil.Basic{
+		OnAction: func(r node.ActionRequest) (node.Node, error) {
+			actual, _ = RpcContextFrom(r.Selection.Context)
+			return nil, nil
+		},
+	})
+	rdr, _ := io.Pipe()
+	var out bytes.Buffer
+	ses := NewSession(&Server{}, "joe", d, rdr, &out)
+	req, err := DecodeRequest(strings.NewReader(`<rpc xmlns="urn:ietf:params:xml:ns:netconf:base:1.0" message-id="m1">
+		<rotateTires xmlns="c"/>
+	</rpc>`))
+	fc.RequireEqual(t, nil, err)
+	fc.RequireEqual(t, nil, ses.handleRpc(ses.Context(), req.Rpc))
+	fc.RequireEqual(t, true, actual != nil, out.String())
+	fc.AssertEqual(t, RpcContext{SessionId: ses.Id, User: "joe", MessageId: "m1"}, *actual)
+
+	ses.Kill(99)
+	fc.AssertEqual(t, context.Canceled, ses.Context().Err())
+}
+
+func TestGetMaxDepth(t *testing.T) {
+	d, s := newTestServer(t, readJson(`{
+		"speed": 10,
+		"engine": {"specs": {"horsepower": 200}},
+		"tire": [{"pos": 1, "size": "15"}]
+	}`))
+	rt := newRpcTester(t, s, d)
+	getConfig := func(depth string, filter string) {
+		t.Helper()
+		rt.send(`<get-config xmlns:fc="org.freeconf/restconf" fc:max-depth="` + depth + `"><source><running/></source>` + filter + `</get-config>`)
+	}
+	car := `<filter><car xmlns="c"><speed/><engine/><tire/></car></filter>`
+
+	getConfig("1", car)
+	getConfig("2", car)
+	getConfig("1", `<filter type="xpath" xmlns:c="c" select="c:car/tire"/>`)
+	getConfig("unbounded", car)
+	getConfig("0", car)
+	rt.gold("testdata/gold/max-depth.xml")
+
+	// advertised w/fc-netconf's namespace
+	hello := rt.ses.Hello()
+	hello.SessionId = "1"
+	var buf bytes.Buffer
+	fc.RequireEqual(t, nil, WriteResponseWithOptions(hello, &buf, false, true))
+	fc.Gold(t, *updateFlag, buf.Bytes(), "testdata/gold/server-hello.xml")
+	b, err := d.Browser("fc-netconf")
+	fc.RequireEqual(t, nil, err)
+	fc.AssertEqual(t, true, b.Meta.ExtensionDefs()["max-depth"] != nil)
+}
+
+func TestClientErrorsKeepSession(t *testing.T) {
+	d, s := newTestServer(t, testdata.Manage(testdata.New()))
+	c := newTestConn(t, s, d)
+	c.start()
+	edit := func(config string) string {
+		return `<edit-config><target><running/></target>` + config + `</edit-config>`
+	}
+	tests := []struct {
+		op  string
+		tag string
+	}{
+		{op: `<get><filter><bogus xmlns="b"/></filter></get>`, tag: "unknown-element"},
+		{op: edit(``), tag: "missing-element"},
+		{op: edit(`<config><bogus xmlns="b"/></config>`), tag: "unknown-element"},
+		{op: edit(`<config><car xmlns="c" xmlns:nc="urn:ietf:params:netconf:base:1.1"><tire nc:operation="delete"><pos>99</pos></tire></car></config>`), tag: "data-missing"},
+		{op: edit(`<config><car xmlns="c" xmlns:nc="urn:ietf:params:netconf:base:1.1"><speed nc:operation="bogus">10</speed></car></config>`), tag: "invalid-value"},
+		{op: `<create-subscription xmlns="urn:ietf:params:xml:ns:netconf:notification:1.0"><stream>bogus</stream></create-subscription>`, tag: "invalid-value"},
+		{op: `<bogus xmlns="b"/>`, tag: "unknown-namespace"},
+	}
+	for i, test := range tests {
+		c.send(i+1, test.op)
+		c.expect("<rpc-error>", "<error-tag>"+test.tag+"</error-tag>")
+	}
+	// session is still usable
+	c.send(len(tests)+1, `<get><filter><car xmlns="c"><speed/></car></filter></get>`)
+	c.expect("<data><car")
+	c.kill()
+}
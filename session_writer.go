@@ -0,0 +1,177 @@
+package netconf
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// how long to wait for queued messages to be written when session closes
+const closeFlushTimeout = 5 * time.Second
+
+// default number of whole messages that can be waiting to be written to a
+// session before notifications are dropped
+const defaultOutQueueLen = 64
+
+// msgWriter is the only writer to a session's transport.  Replies from the
+// reader goroutine and notifications from event goroutines are queued as
+// whole messages so framing of one message is never interleaved with another.
+//
+// Replies wait for room in the queue which applies back-pressure to the
+// client's own requests. Notifications never wait, if the client has fallen
+// behind they are dropped and counted.
+type msgWriter struct {
+	out     io.Writer
+	queue   chan *outMsg
+	done    chan struct{}
+	stopped chan struct{}
+	stop    sync.Once
+	dropped atomic.Int64
+}
+
+type outMsg struct {
+	data    []byte
+	written chan error
+
+	// eom frames message with end-of-message marker instead of chunks
+	eom bool
+}
+
+func newMsgWriter(out io.Writer, queueLen int) *msgWriter {
+	w := &msgWriter{
+		out:     out,
+		queue:   make(chan *outMsg, queueLen),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *msgWriter) run() {
+	defer close(w.stopped)
+	var err error
+	send := func(m *outMsg) {
+		// once transport fails, nothing more can be written
+		if err == nil {
+			err = w.write(m)
+		}
+		if m.written != nil {
+			m.written <- err
+		}
+	}
+	for {
+		select {
+		case <-w.done:
+			// flush what was queued before close
+			for {
+				select {
+				case m := <-w.queue:
+					send(m)
+				default:
+					return
+				}
+			}
+		case m := <-w.queue:
+			send(m)
+		}
+	}
+}
+
+func (w *msgWriter) write(m *outMsg) error {
+	if m.eom {
+		_, err := w.out.Write(append(m.data, msgDelim...))
+		return err
+	}
+	out := NewChunkedWtr(w.out)
+	if _, err := out.Write(m.data); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+func encodeMsg(msg any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := WriteResponse(msg, &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Send queues message, waiting for room if nec., and returns once message is
+// written to transport.
+func (w *msgWriter) Send(msg any) error {
+	data, err := encodeMsg(msg)
+	if err != nil {
+		return err
+	}
+	m := &outMsg{data: data, written: make(chan error, 1)}
+	select {
+	case w.queue <- m:
+	case <-w.done:
+		return io.ErrClosedPipe
+	}
+	select {
+	case err = <-m.written:
+		return err
+	case <-w.done:
+		return io.ErrClosedPipe
+	}
+}
+
+// SendHello queues hello framed with end-of-message marker as chunked framing
+// only starts after hellos are exchanged, RFC 6242 section 4.1. Does not wait
+// for hello to be written so client's hello can be read at the same time.
+func (w *msgWriter) SendHello(msg any) error {
+	data, err := encodeMsg(msg)
+	if err != nil {
+		return err
+	}
+	select {
+	case w.queue <- &outMsg{data: data, eom: true}:
+		return nil
+	case <-w.done:
+		return io.ErrClosedPipe
+	}
+}
+
+// Notify queues message w/o waiting.  If the queue is full, message is
+// dropped and false is returned.
+func (w *msgWriter) Notify(msg any) (bool, error) {
+	data, err := encodeMsg(msg)
+	if err != nil {
+		return false, err
+	}
+	select {
+	case <-w.done:
+		return false, io.ErrClosedPipe
+	default:
+	}
+	select {
+	case w.queue <- &outMsg{data: data}:
+		return true, nil
+	default:
+		w.dropped.Add(1)
+		return false, nil
+	}
+}
+
+// Dropped is the number of notifications dropped because client was not
+// reading fast enough
+func (w *msgWriter) Dropped() int64 {
+	return w.dropped.Load()
+}
+
+// Close stops accepting messages and waits a limited time for messages
+// already queued to be written
+func (w *msgWriter) Close() {
+	w.stop.Do(func() {
+		close(w.done)
+	})
+	select {
+	case <-w.stopped:
+	case <-time.After(closeFlushTimeout):
+	}
+}
@@ -0,0 +1,73 @@
+package netconf
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/freeconf/yang/fc"
+	"github.com/freeconf/yang/patch/xml"
+)
+
+func TestMsgWriterWholeMessages(t *testing.T) {
+	rdr, wtr := io.Pipe()
+	w := newMsgWriter(wtr, defaultOutQueueLen)
+	defer w.Close()
+	const n = 20
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < n; i++ {
+			fc.AssertEqual(t, nil, w.Send(&RpcReply{MessageId: "x", OK: &Msg{}}))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < n; i++ {
+			// large enough queue that nothing should be dropped
+			sent, err := w.Notify(&Notification{})
+			fc.AssertEqual(t, nil, err)
+			fc.AssertEqual(t, true, sent)
+		}
+	}()
+	msgs := NewChunkedRdr(rdr)
+	for i := 0; i < 2*n; i++ {
+		msg, err := io.ReadAll(<-msgs)
+		fc.RequireEqual(t, nil, err)
+		var any struct{}
+		fc.AssertEqual(t, nil, xml.Unmarshal(msg, &any), string(msg))
+	}
+	wg.Wait()
+	fc.AssertEqual(t, int64(0), w.Dropped())
+}
+
+func TestMsgWriterDropsNotifications(t *testing.T) {
+	rdr, wtr := io.Pipe()
+	w := newMsgWriter(wtr, 2)
+	// nothing reading so first message blocks writer and rest fill queue
+	for i := 0; i < 5; i++ {
+		_, err := w.Notify(&Notification{})
+		fc.AssertEqual(t, nil, err)
+	}
+	fc.AssertEqual(t, true, w.Dropped() >= 2)
+	// client goes away so queued messages cannot be flushed
+	rdr.Close()
+	w.Close()
+	_, err := w.Notify(&Notification{})
+	fc.AssertEqual(t, io.ErrClosedPipe, err)
+}
+
+func TestMsgWriterHelloFirst(t *testing.T) {
+	var out bytes.Buffer
+	w := newMsgWriter(&out, defaultOutQueueLen)
+	defer w.Close()
+	fc.RequireEqual(t, nil, w.SendHello(&HelloMsg{}))
+	fc.RequireEqual(t, nil, w.Send(&RpcReply{MessageId: "x", OK: &Msg{}}))
+	hello, reply, found := strings.Cut(out.String(), msgDelim)
+	fc.AssertEqual(t, true, found, out.String())
+	fc.AssertEqual(t, true, strings.HasPrefix(hello, "<hello"), hello)
+	fc.AssertEqual(t, true, strings.HasPrefix(reply, "\n#"), reply)
+}
@@ -3,10 +3,18 @@ package netconf
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"net"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/freeconf/restconf/device"
 	"github.com/freeconf/restconf/secure"
@@ -15,20 +23,80 @@ import (
 )
 
 type SshHandler struct {
-	opts                 SshOptions
-	Auth                 secure.Auth
-	listener             net.Listener
-	hostPrivateKeySigner ssh.Signer
-	host                 SessionManager
-	dev                  device.Device
+	opts      SshOptions
+	Auth      secure.Auth
+	listener  net.Listener
+	stopped   bool
+	hostKeys  []ssh.Signer
+	adminKeys []ssh.PublicKey
+	host      SessionManager
+	dev       device.Device
+	mu        sync.Mutex
+	config    *ssh.ServerConfig
+
+	// nextHostKeys are rotated keys not yet retired. Clients only learn of
+	// them thru hostkeys-00@openssh.com as a connection can only be offered
+	// one key of each type.
+	nextHostKeys []ssh.Signer
+
+	// connections still in handshake or authentication
+	unauthenticated atomic.Int32
 }
 
 type SshOptions struct {
-	Port          string
-	HostKeyFile   string
+	Port        string
+	HostKeyFile string
+
+	// HostKeys are names of keys in keystore
+	HostKeys []string
+
+	// HostKeyDir is where a host key for each of HostKeyTypes is kept.  Missing
+	// keys are generated and saved here on start.
+	HostKeyDir string
+
+	// HostKeyTypes default is ed25519, ecdsa-p256 and rsa3072
+	HostKeyTypes []string
+
 	AdminUsername string
 	AdminPassword string
 	AdminKey      string
+
+	// AdminKeyBag is name of public key bag in truststore
+	AdminKeyBag string
+
+	// Allowed algorithms in order of preference. Empty uses library defaults
+	KeyExchanges      []string
+	Ciphers           []string
+	MACs              []string `yang:"macs"`
+	HostKeyAlgorithms []string
+
+	// Banner is sent to clients before authentication
+	Banner string
+
+	// MaxAuthTries per connection. Zero is library default of 6, negative is
+	// unlimited
+	MaxAuthTries int
+
+	// KeepaliveInterval in seconds between keepalive requests to client. Zero
+	// disables keepalives
+	KeepaliveInterval int
+
+	// KeepaliveCountMax is number of unanswered keepalives before connection
+	// is considered dead and closed
+	KeepaliveCountMax int
+
+	// HelloTimeout in seconds to wait for client hello message. Also limits
+	// ssh handshake and authentication, which is otherwise limited to
+	// defaultLoginTimeout.  Zero waits forever for hello
+	HelloTimeout int
+
+	// IdleTimeout in seconds to wait for next rpc when session has no active
+	// subscriptions. Zero waits forever
+	IdleTimeout int
+
+	// MaxUnauthenticated is the number of connections allowed in handshake or
+	// authentication at once. Zero is unlimited
+	MaxUnauthenticated int
 }
 
 func NewSshHandler(h SessionManager, dev device.Device) *SshHandler {
@@ -39,74 +107,367 @@ func NewSshHandler(h SessionManager, dev device.Device) *SshHandler {
 }
 
 func (s *SshHandler) Options() SshOptions {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	return s.opts
 }
 
 func (s *SshHandler) Apply(opts SshOptions) error {
-	if s.opts == opts {
+	s.mu.Lock()
+	stopped := s.stopped
+	s.mu.Unlock()
+	if stopped {
+		return ErrServerClosed
+	}
+	if reflect.DeepEqual(s.Options(), opts) {
 		return nil
 	}
 	if opts.Port == "" {
 		return fmt.Errorf("missing port")
 	}
-	if opts.HostKeyFile == "" {
-		return fmt.Errorf("invalid hosts key file")
+	hostKeys, err := s.loadHostKeys(opts)
+	if err != nil {
+		return err
 	}
-	hostPrivateKey, err := os.ReadFile(opts.HostKeyFile)
+	nextHostKeys, err := s.loadNextHostKeys(opts)
 	if err != nil {
-		return fmt.Errorf("could not read hosts key file %s. %w", opts.HostKeyFile, err)
+		return err
 	}
-	s.hostPrivateKeySigner, err = ssh.ParsePrivateKey(hostPrivateKey)
+	adminKeys, err := s.loadAdminKeys(opts)
 	if err != nil {
-		panic(err)
+		return err
 	}
+	s.mu.Lock()
+	s.hostKeys = hostKeys
+	s.nextHostKeys = nextHostKeys
+	s.adminKeys = adminKeys
 	s.opts = opts
 	if s.listener != nil {
 		s.listener.Close()
 	}
+	s.mu.Unlock()
 	return s.start()
 }
 
+var defaultHostKeyTypes = []string{AlgEd25519, AlgEcdsaP256, AlgRsa3072}
+
+func (opts SshOptions) hostKeyTypes() []string {
+	if len(opts.HostKeyTypes) == 0 {
+		return defaultHostKeyTypes
+	}
+	return opts.HostKeyTypes
+}
+
+func hostKeyName(algorithm string) string {
+	return "ssh-host-" + algorithm
+}
+
+func hostKeyFile(dir string, algorithm string) string {
+	return filepath.Join(dir, fmt.Sprintf("ssh_host_%s_key", algorithm))
+}
+
+// next host key is the rotated key waiting to replace the current key
+func nextHostKeyName(algorithm string) string {
+	return hostKeyName(algorithm) + "-next"
+}
+
+func nextHostKeyFile(dir string, algorithm string) string {
+	return hostKeyFile(dir, algorithm) + ".next"
+}
+
+func (s *SshHandler) loadHostKeys(opts SshOptions) ([]ssh.Signer, error) {
+	var signers []ssh.Signer
+	if opts.HostKeyFile != "" {
+		hostPrivateKey, err := os.ReadFile(opts.HostKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read hosts key file %s. %w", opts.HostKeyFile, err)
+		}
+		signer, err := ssh.ParsePrivateKey(hostPrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse hosts key file %s. %w", opts.HostKeyFile, err)
+		}
+		signers = append(signers, signer)
+	}
+	if opts.HostKeyDir != "" {
+		for _, alg := range opts.hostKeyTypes() {
+			if err := s.loadOrGenerateHostKey(opts.HostKeyDir, alg); err != nil {
+				return nil, err
+			}
+			signer, err := s.host.Keystore().SshSigner(hostKeyName(alg))
+			if err != nil {
+				return nil, err
+			}
+			signers = append(signers, signer)
+		}
+	}
+	for _, name := range opts.HostKeys {
+		signer, err := s.host.Keystore().SshSigner(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid host key. %w", err)
+		}
+		signers = append(signers, signer)
+	}
+	if len(opts.HostKeyAlgorithms) > 0 {
+		var err error
+		if signers, err = restrictHostKeyAlgorithms(signers, opts.HostKeyAlgorithms); err != nil {
+			return nil, err
+		}
+	}
+	if len(signers) == 0 {
+		return nil, fmt.Errorf("no host keys configured")
+	}
+	return signers, nil
+}
+
+// restrictHostKeyAlgorithms drops keys that cannot sign with any of the allowed
+// algorithms and limits rsa keys to the allowed signature hashes
+func restrictHostKeyAlgorithms(signers []ssh.Signer, allowed []string) ([]ssh.Signer, error) {
+	var restricted []ssh.Signer
+	for _, signer := range signers {
+		format := signer.PublicKey().Type()
+		candidates := []string{format}
+		if format == ssh.KeyAlgoRSA {
+			candidates = []string{ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSA}
+		}
+		var algs []string
+		for _, alg := range allowed {
+			for _, candidate := range candidates {
+				if alg == candidate {
+					algs = append(algs, alg)
+				}
+			}
+		}
+		if len(algs) == 0 {
+			continue
+		}
+		if algSigner, valid := signer.(ssh.AlgorithmSigner); valid {
+			multi, err := ssh.NewSignerWithAlgorithms(algSigner, algs)
+			if err != nil {
+				return nil, err
+			}
+			signer = multi
+		}
+		restricted = append(restricted, signer)
+	}
+	return restricted, nil
+}
+
+func (s *SshHandler) loadOrGenerateHostKey(dir string, alg string) error {
+	ks := s.host.Keystore()
+	fname := hostKeyFile(dir, alg)
+	_, err := ks.LoadKeyFile(hostKeyName(alg), fname)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("could not load host key %s. %w", fname, err)
+	}
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	k, err := ks.GenerateKey(hostKeyName(alg), alg)
+	if err != nil {
+		return err
+	}
+	if err = k.WriteKeyFile(fname); err != nil {
+		return fmt.Errorf("could not save host key %s. %w", fname, err)
+	}
+	fc.Info.Printf("generated new host key %s", fname)
+	return nil
+}
+
+// loadNextHostKeys finds keys from a rotation that was not retired
+func (s *SshHandler) loadNextHostKeys(opts SshOptions) ([]ssh.Signer, error) {
+	if opts.HostKeyDir == "" {
+		return nil, nil
+	}
+	ks := s.host.Keystore()
+	var signers []ssh.Signer
+	for _, alg := range opts.hostKeyTypes() {
+		fname := nextHostKeyFile(opts.HostKeyDir, alg)
+		if _, err := ks.LoadKeyFile(nextHostKeyName(alg), fname); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, fmt.Errorf("could not load host key %s. %w", fname, err)
+		}
+		signer, err := ks.SshSigner(nextHostKeyName(alg))
+		if err != nil {
+			return nil, err
+		}
+		signers = append(signers, signer)
+	}
+	if len(opts.HostKeyAlgorithms) > 0 {
+		return restrictHostKeyAlgorithms(signers, opts.HostKeyAlgorithms)
+	}
+	return signers, nil
+}
+
+func (opts SshOptions) checkRotatable(alg string) error {
+	if opts.HostKeyDir == "" {
+		return errors.New("host key rotation requires host key dir")
+	}
+	for _, candidate := range opts.hostKeyTypes() {
+		if candidate == alg {
+			return nil
+		}
+	}
+	return fmt.Errorf("'%s' is not a configured host key type", alg)
+}
+
+// RotateHostKey adds a new generated host key of the given type along side
+// the current key.  Current key is still used for new connections, new key is
+// announced to clients that support hostkeys-00@openssh.com so they can learn
+// it before RetireHostKey switches to it.  Rotating again before retiring
+// replaces the new key.
+func (s *SshHandler) RotateHostKey(alg string) (*AsymmetricKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.opts.checkRotatable(alg); err != nil {
+		return nil, err
+	}
+	k, err := newAsymmetricKey(nextHostKeyName(alg), alg)
+	if err != nil {
+		return nil, err
+	}
+	if err = k.WriteKeyFile(nextHostKeyFile(s.opts.HostKeyDir, alg)); err != nil {
+		return nil, err
+	}
+	s.host.Keystore().SetKey(k)
+	nextHostKeys, err := s.loadNextHostKeys(s.opts)
+	if err != nil {
+		return nil, err
+	}
+	s.nextHostKeys = nextHostKeys
+	fc.Info.Printf("rotated %s host key, old key in use until retired", alg)
+	return k, nil
+}
+
+// RetireHostKey replaces the current host key of the given type with the key
+// from RotateHostKey.  New key is moved into place over the old key so a
+// failure leaves the old key in place. Existing connections are unaffected,
+// new connections are offered the new key.
+func (s *SshHandler) RetireHostKey(alg string) (*AsymmetricKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.opts.checkRotatable(alg); err != nil {
+		return nil, err
+	}
+	ks := s.host.Keystore()
+	next, err := ks.Key(nextHostKeyName(alg))
+	if err != nil {
+		return nil, fmt.Errorf("no rotated %s host key to switch to. %w", alg, err)
+	}
+	fname := hostKeyFile(s.opts.HostKeyDir, alg)
+	if err = os.Rename(nextHostKeyFile(s.opts.HostKeyDir, alg), fname); err != nil {
+		return nil, err
+	}
+	k := next.clone()
+	k.Name = hostKeyName(alg)
+	ks.SetKey(k)
+	ks.RemoveKey(next.Name)
+	hostKeys, err := s.loadHostKeys(s.opts)
+	if err != nil {
+		return nil, err
+	}
+	nextHostKeys, err := s.loadNextHostKeys(s.opts)
+	if err != nil {
+		return nil, err
+	}
+	s.hostKeys = hostKeys
+	s.nextHostKeys = nextHostKeys
+	s.config = s.newServerConfig()
+	fc.Info.Printf("retired old %s host key", alg)
+	return k, nil
+}
+
+func (s *SshHandler) loadAdminKeys(opts SshOptions) ([]ssh.PublicKey, error) {
+	var keys []ssh.PublicKey
+	if opts.AdminKey != "" {
+		pubkey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(opts.AdminKey))
+		if err != nil {
+			return nil, fmt.Errorf("invalid admin key. %w", err)
+		}
+		keys = append(keys, pubkey)
+	}
+	if opts.AdminKeyBag != "" {
+		bag, err := s.host.Truststore().SshPublicKeys(opts.AdminKeyBag)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, bag...)
+	}
+	return keys, nil
+}
+
 type SshStatus struct {
 	Running bool
+
+	// SHA256 fingerprints of host keys offered to clients
+	HostKeyFingerprints []string
+
+	// SHA256 fingerprints of rotated host keys waiting to be retired
+	NextHostKeyFingerprints []string
 }
 
 func (s *SshHandler) Status() SshStatus {
-	return SshStatus{
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := SshStatus{
 		Running: s.listener != nil,
 	}
+	for _, k := range s.hostKeys {
+		status.HostKeyFingerprints = append(status.HostKeyFingerprints, ssh.FingerprintSHA256(k.PublicKey()))
+	}
+	for _, k := range s.nextHostKeys {
+		status.NextHostKeyFingerprints = append(status.NextHostKeyFingerprints, ssh.FingerprintSHA256(k.PublicKey()))
+	}
+	return status
 }
 
 func (s *SshHandler) keyAuth(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
-	fc.Info.Printf("user '%s' from %s authenticated with key type %s", conn.User(), conn.RemoteAddr(), key.Type())
-	if conn.User() == s.opts.AdminUsername {
-
-		// consider moving this to options loading to be done once
-		pubkey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(s.opts.AdminKey))
-		if err != nil {
-			return nil, err
+	s.mu.Lock()
+	username, adminKeys := s.opts.AdminUsername, s.adminKeys
+	s.mu.Unlock()
+	valid := false
+	if conn.User() == username {
+		for _, adminKey := range adminKeys {
+			if bytes.Equal(key.Marshal(), adminKey.Marshal()) {
+				valid = true
+				break
+			}
 		}
-		adminKey := pubkey.Marshal()
+	}
+	return s.checkAuth(conn, "publickey", valid)
+}
 
-		if string(key.Marshal()) == string(adminKey) {
-			fc.Info.Printf("valid key auth for '%s'", conn.User())
-			return nil, nil
-		}
-		fc.Info.Printf("invalid key auth attempt for '%s'", conn.User())
-	} else {
-		fc.Info.Printf("invalid key auth for '%s'", conn.User())
+// checkAuth consults auth guard so brute force attempts are slowed, locked out
+// and audited.  Attempts while locked out are rejected right away instead of
+// waiting so they do not hold onto an unauthenticated connection slot.
+func (s *SshHandler) checkAuth(conn ssh.ConnMetadata, method string, valid bool) (*ssh.Permissions, error) {
+	guard := s.host.AuthGuard()
+	addr := conn.RemoteAddr().String()
+	if err := guard.Allowed(conn.User(), addr, method); err != nil {
+		return nil, err
 	}
+	if valid {
+		guard.Succeeded(conn.User(), addr, method)
+		return nil, nil
+	}
+	guard.Failed(conn.User(), addr, method)
 	return nil, ErrInvalidLogin
 }
 
-func (s *SshHandler) handleNewChannels(conn *ssh.ServerConn, newChannelRequests <-chan ssh.NewChannel) {
+// handleNewChannels serves sessions until connection closes.  onStart is
+// optional and called with each session once hello is exchanged.
+func (s *SshHandler) handleNewChannels(conn *ssh.ServerConn, newChannelRequests <-chan ssh.NewChannel, onStart func(*Session)) {
 	defer conn.Close()
 	for req := range newChannelRequests {
-		go s.handleConn(conn, req)
+		go s.handleConn(conn, req, onStart)
 	}
 }
 
-func (s *SshHandler) handleConn(conn *ssh.ServerConn, c ssh.NewChannel) {
+func (s *SshHandler) handleConn(conn *ssh.ServerConn, c ssh.NewChannel, onStart func(*Session)) {
 	fc.Debug.Println("ssh: got connection, waiting for message...")
 	if c.ChannelType() != "session" {
 		c.Reject(ssh.Prohibited, "channel type is not a session")
@@ -119,10 +480,18 @@ func (s *SshHandler) handleConn(conn *ssh.ServerConn, c ssh.NewChannel) {
 	}
 	user := conn.Conn.User()
 	sess := NewSession(s.host, user, s.dev, ch, ch)
-	ctx := context.Background()
+	opts := s.Options()
+	sess.helloTimeout = time.Duration(opts.HelloTimeout) * time.Second
+	sess.idleTimeout = time.Duration(opts.IdleTimeout) * time.Second
+	sess.transport = "netconf-ssh"
+	sess.remoteAddr = conn.RemoteAddr().String()
+	sess.onStart = onStart
+	ctx := sess.Context()
+	s.host.AddSession(sess)
 	go func(in <-chan *ssh.Request) {
 
 		defer fc.Debug.Printf("ssh: exiting ses=%d", sess.Id)
+		defer s.host.RemoveSession(sess)
 		defer ch.Close()
 		defer sess.close()
 		for {
@@ -130,7 +499,11 @@ func (s *SshHandler) handleConn(conn *ssh.ServerConn, c ssh.NewChannel) {
 			case <-ctx.Done():
 				fc.Debug.Printf("context closed on ses=%d", sess.Id)
 				return
-			case req := <-reqs:
+			case req, valid := <-reqs:
+				if !valid {
+					fc.Debug.Printf("channel closed on ses=%d", sess.Id)
+					return
+				}
 				fc.Debug.Printf("got request ses=%d", sess.Id)
 				switch req.Type {
 				case "subsystem":
@@ -139,11 +512,10 @@ func (s *SshHandler) handleConn(conn *ssh.ServerConn, c ssh.NewChannel) {
 
 							// sending hello shouldn't wait to recieve message from client
 							// https://datatracker.ietf.org/doc/html/rfc6242#section-3.1
-							go func() {
-								if serr := WriteResponseWithOptions(sess.Hello(), ch, true, false); serr != nil {
-									s.host.HandleErr(serr)
-								}
-							}()
+							if serr := sess.wtr.SendHello(sess.Hello()); serr != nil {
+								s.host.HandleErr(serr)
+								return
+							}
 
 							if req.WantReply {
 								req.Reply(true, []byte{})
@@ -170,56 +542,320 @@ func (s *SshHandler) handleConn(conn *ssh.ServerConn, c ssh.NewChannel) {
 var ErrInvalidLogin = errors.New("invalid login")
 
 func (s *SshHandler) adminPasswordCheck(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
-	if conn.User() == s.opts.AdminUsername {
-		if s.opts.AdminPassword == string(password) {
-			fc.Debug.Printf("password verified for '%s'", s.opts.AdminUsername)
-			return nil, nil
-		}
-	}
-	fc.Info.Printf("invalid password attempt for '%s'", conn.User())
-	return nil, ErrInvalidLogin
+	opts := s.Options()
+	valid := conn.User() == opts.AdminUsername &&
+		opts.AdminPassword != "" &&
+		subtle.ConstantTimeCompare([]byte(opts.AdminPassword), password) == 1
+	return s.checkAuth(conn, "password", valid)
 }
 
-func (s *SshHandler) rejectGlobalRequests(requests <-chan *ssh.Request) {
+// OpenSSH extension for clients to learn new host keys.
+//
+//	https://cvsweb.openbsd.org/src/usr.bin/ssh/PROTOCOL
+const (
+	hostKeysRequest      = "hostkeys-00@openssh.com"
+	hostKeysProveRequest = "hostkeys-prove-00@openssh.com"
+)
+
+// handleGlobalRequests answers requests to prove host keys and rejects all
+// others
+func (s *SshHandler) handleGlobalRequests(conn *ssh.ServerConn, requests <-chan *ssh.Request) {
 	for request := range requests {
+		if request.Type == hostKeysProveRequest && request.WantReply {
+			sigs, err := s.proveHostKeys(conn.SessionID(), request.Payload)
+			if err != nil {
+				fc.Debug.Printf("ssh: could not prove host keys to %s. %s", conn.RemoteAddr(), err)
+				_ = request.Reply(false, nil)
+				continue
+			}
+			_ = request.Reply(true, sigs)
+			continue
+		}
 		if request.WantReply {
 			_ = request.Reply(false, []byte("request type not supported"))
 		}
 	}
 }
 
-func (s *SshHandler) start() error {
-	var err error
-	s.listener, err = net.Listen("tcp", s.opts.Port)
-	if err != nil {
-		return err
+// announceHostKeys tells client of all host keys including rotated keys that
+// are not offered in handshake
+func (s *SshHandler) announceHostKeys(conn *ssh.ServerConn) {
+	s.mu.Lock()
+	if len(s.nextHostKeys) == 0 {
+		s.mu.Unlock()
+		return
+	}
+	var payload []byte
+	for _, k := range append(append([]ssh.Signer{}, s.hostKeys...), s.nextHostKeys...) {
+		payload = append(payload, sshString(k.PublicKey().Marshal())...)
+	}
+	s.mu.Unlock()
+	if _, _, err := conn.SendRequest(hostKeysRequest, false, payload); err != nil {
+		fc.Debug.Printf("ssh: could not announce host keys to %s. %s", conn.RemoteAddr(), err)
+	}
+}
+
+// proveHostKeys signs each public key in payload with its private key
+func (s *SshHandler) proveHostKeys(sessionId []byte, payload []byte) ([]byte, error) {
+	s.mu.Lock()
+	signers := append(append([]ssh.Signer{}, s.hostKeys...), s.nextHostKeys...)
+	s.mu.Unlock()
+	var resp []byte
+	for len(payload) > 0 {
+		var blob []byte
+		var err error
+		if blob, payload, err = parseSshString(payload); err != nil {
+			return nil, err
+		}
+		var signer ssh.Signer
+		for _, candidate := range signers {
+			if bytes.Equal(candidate.PublicKey().Marshal(), blob) {
+				signer = candidate
+				break
+			}
+		}
+		if signer == nil {
+			return nil, errors.New("not a host key")
+		}
+		var data []byte
+		data = append(data, sshString([]byte(hostKeysProveRequest))...)
+		data = append(data, sshString(sessionId)...)
+		data = append(data, sshString(blob)...)
+		var sig *ssh.Signature
+		if algSigner, valid := signer.(ssh.AlgorithmSigner); valid && signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+			sig, err = algSigner.SignWithAlgorithm(rand.Reader, data, ssh.KeyAlgoRSASHA512)
+		} else {
+			sig, err = signer.Sign(rand.Reader, data)
+		}
+		if err != nil {
+			return nil, err
+		}
+		resp = append(resp, sshString(ssh.Marshal(sig))...)
+	}
+	return resp, nil
+}
+
+func sshString(data []byte) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(data))), data...)
+}
+
+func parseSshString(in []byte) (data []byte, rest []byte, err error) {
+	if len(in) < 4 {
+		return nil, nil, errors.New("short ssh string")
+	}
+	n := binary.BigEndian.Uint32(in)
+	if uint32(len(in)-4) < n {
+		return nil, nil, errors.New("short ssh string")
 	}
-	config := ssh.ServerConfig{
+	return in[4 : 4+n], in[4+n:], nil
+}
+
+// newServerConfig is called with mu held
+func (s *SshHandler) newServerConfig() *ssh.ServerConfig {
+	config := &ssh.ServerConfig{
 		PublicKeyCallback: s.keyAuth,
 		PasswordCallback:  s.adminPasswordCheck,
+		MaxAuthTries:      s.opts.MaxAuthTries,
+	}
+	config.KeyExchanges = s.opts.KeyExchanges
+	config.Ciphers = s.opts.Ciphers
+	config.MACs = s.opts.MACs
+	if banner := s.opts.Banner; banner != "" {
+		config.BannerCallback = func(ssh.ConnMetadata) string {
+			return banner
+		}
+	}
+	for _, k := range s.hostKeys {
+		config.AddHostKey(k)
+	}
+	return config
+}
+
+// keepalive detects dead peers by sending keepalive requests and closing the
+// connection when too many go unanswered. Any reply, even a failure, means the
+// peer is alive.
+func (s *SshHandler) keepalive(conn *ssh.ServerConn, interval time.Duration, countMax int) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	replies := make(chan error, 1)
+	pending := false
+	missed := 0
+	for {
+		select {
+		case <-t.C:
+			if pending {
+				missed++
+				if missed >= countMax {
+					fc.Info.Printf("ssh: closing unresponsive connection from %s", conn.RemoteAddr())
+					conn.Close()
+					return
+				}
+				continue
+			}
+			pending = true
+			go func() {
+				_, _, err := conn.SendRequest("keepalive@openssh.com", true, nil)
+				replies <- err
+			}()
+		case err := <-replies:
+			if err != nil {
+				// connection closed
+				return
+			}
+			pending = false
+			missed = 0
+		}
 	}
-	config.AddHostKey(s.hostPrivateKeySigner)
+}
+
+func (s *SshHandler) serverConfig() *ssh.ServerConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.config
+}
 
+// Stop accepting new connections for good. Existing connections are
+// unaffected.
+func (s *SshHandler) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopped = true
+	if s.listener != nil {
+		s.listener.Close()
+		s.listener = nil
+	}
+}
+
+func (s *SshHandler) start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		// stopped while options were being applied
+		return ErrServerClosed
+	}
+	listener, err := net.Listen("tcp", s.opts.Port)
+	if err != nil {
+		return err
+	}
+	s.listener = listener
+	s.config = s.newServerConfig()
+
+	// options are replaced on restart, not edited, so accept loop keeps the
+	// values it started with
+	maxUnauthenticated := s.opts.MaxUnauthenticated
 	go func() {
-		defer s.listener.Close()
+		defer listener.Close()
 		for {
-			c, err := s.listener.Accept()
+			c, err := listener.Accept()
 			if err != nil {
 				if x, ok := err.(*net.OpError); ok && x.Op == "accept" {
 					fc.Info.Print("graceful shutdown")
 					return
 				}
 				s.host.HandleErr(err)
+				continue
 			}
-			sshConn, chans, globalRequests, err := ssh.NewServerConn(c, &config)
-			if err != nil {
-				s.host.HandleErr(err)
-			} else {
-				go s.handleNewChannels(sshConn, chans)
-				go s.rejectGlobalRequests(globalRequests)
+			if max := maxUnauthenticated; max > 0 && int(s.unauthenticated.Load()) >= max {
+				fc.Info.Printf("ssh: too many unauthenticated connections, dropping %s", c.RemoteAddr())
+				c.Close()
+				continue
 			}
+			s.unauthenticated.Add(1)
+			go s.handshake(c)
 		}
 	}()
 
 	return nil
 }
+
+// defaultLoginTimeout is how long a connection has to handshake and
+// authenticate when there is no hello timeout, same as OpenSSH LoginGraceTime
+const defaultLoginTimeout = 2 * time.Minute
+
+func (opts SshOptions) loginTimeout() time.Duration {
+	if opts.HelloTimeout > 0 {
+		return time.Duration(opts.HelloTimeout) * time.Second
+	}
+	return defaultLoginTimeout
+}
+
+// newServerConn is ssh handshake and authentication limited by login timeout
+// so clients cannot hold onto connection slots
+func (s *SshHandler) newServerConn(c net.Conn, config *ssh.ServerConfig) (*ssh.ServerConn, <-chan ssh.NewChannel, <-chan *ssh.Request, error) {
+	if err := c.SetDeadline(time.Now().Add(s.Options().loginTimeout())); err != nil {
+		c.Close()
+		return nil, nil, nil, err
+	}
+	sshConn, chans, globalRequests, err := ssh.NewServerConn(c, config)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err = c.SetDeadline(time.Time{}); err != nil {
+		sshConn.Close()
+		return nil, nil, nil, err
+	}
+	return sshConn, chans, globalRequests, nil
+}
+
+func (s *SshHandler) handshake(c net.Conn) {
+	sshConn, chans, globalRequests, err := s.newServerConn(c, s.serverConfig())
+	s.unauthenticated.Add(-1)
+	if err != nil {
+		fc.Debug.Printf("ssh: handshake failed from %s. %s", c.RemoteAddr(), err)
+		return
+	}
+	go s.handleNewChannels(sshConn, chans, nil)
+	go s.handleGlobalRequests(sshConn, globalRequests)
+	go s.announceHostKeys(sshConn)
+	s.startKeepalive(sshConn)
+}
+
+func (s *SshHandler) startKeepalive(conn *ssh.ServerConn) {
+	opts := s.Options()
+	if opts.KeepaliveInterval > 0 {
+		countMax := opts.KeepaliveCountMax
+		if countMax <= 0 {
+			countMax = 3
+		}
+		go s.keepalive(conn, time.Duration(opts.KeepaliveInterval)*time.Second, countMax)
+	}
+}
+
+// ErrSshNotRunning is when calling home before ssh is configured
+var ErrSshNotRunning = errors.New("netconf: ssh not running")
+
+// CallHome connects to a NETCONF client waiting at addr for servers to call,
+// RFC 8071.  Client then authenticates and opens sessions as if it had
+// connected to server.  onStart is called with each session once hello is
+// exchanged.  Returns once connection ends or ctx is done.
+func (s *SshHandler) CallHome(ctx context.Context, addr string, onStart func(*Session)) error {
+	config := s.serverConfig()
+	if config == nil {
+		return ErrSshNotRunning
+	}
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-done:
+		}
+	}()
+	sshConn, chans, globalRequests, err := s.newServerConn(c, config)
+	if err != nil {
+		c.Close()
+		return err
+	}
+	fc.Debug.Printf("ssh: called home to %s", addr)
+	go s.handleGlobalRequests(sshConn, globalRequests)
+	go s.announceHostKeys(sshConn)
+	s.startKeepalive(sshConn)
+	s.handleNewChannels(sshConn, chans, onStart)
+	return nil
+}
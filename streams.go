@@ -0,0 +1,122 @@
+package netconf
+
+import (
+	"sort"
+	"time"
+
+	"github.com/freeconf/restconf/estream"
+	"github.com/freeconf/yang/node"
+	"github.com/freeconf/yang/nodeutil"
+)
+
+// NetconfStream is the default stream every server has.  It carries every
+// notification from every module on the device.
+//
+//	https://datatracker.ietf.org/doc/html/rfc5277#section-3.2.3
+const NetconfStream = "NETCONF"
+
+// StreamInfo describes a stream to clients in netconf/streams
+type StreamInfo struct {
+	Name        string
+	Description string
+
+	// when replay is supported, when the log of past events started
+	ReplaySupport         bool
+	ReplayLogCreationTime time.Time
+}
+
+// AddStream adds stream to stream service and describes it to clients so
+// they can discover the stream before subscribing to it.
+func (s *Server) AddStream(stream estream.Stream, description string) error {
+	if err := s.streams.AddStream(stream); err != nil {
+		return err
+	}
+	s.describeStream(StreamInfo{Name: stream.Name, Description: description})
+	return nil
+}
+
+func (s *Server) describeStream(info StreamInfo) {
+	s.streamInfoMu.Lock()
+	defer s.streamInfoMu.Unlock()
+	if s.streamInfo == nil {
+		s.streamInfo = make(map[string]*StreamInfo)
+	}
+	s.streamInfo[info.Name] = &info
+}
+
+// Streams are the streams clients can subscribe to sorted by name with the
+// NETCONF stream first
+func (s *Server) Streams() []StreamInfo {
+	s.streamInfoMu.RLock()
+	defer s.streamInfoMu.RUnlock()
+	streams := make([]StreamInfo, 0, len(s.streamInfo))
+	for _, info := range s.streamInfo {
+		stream := *info
+		if log := s.replayLogs[info.Name]; log != nil {
+			stream.ReplaySupport = true
+			stream.ReplayLogCreationTime = log.CreationTime()
+		}
+		streams = append(streams, stream)
+	}
+	sort.Slice(streams, func(i, j int) bool {
+		if streams[i].Name == NetconfStream {
+			return true
+		}
+		if streams[j].Name == NetconfStream {
+			return false
+		}
+		return streams[i].Name < streams[j].Name
+	})
+	return streams
+}
+
+type streamEntry struct {
+	Name                  string
+	Description           string
+	ReplaySupport         bool
+	ReplayLogCreationTime string
+}
+
+// ncNotifications is the nc-notifications module
+func ncNotifications(s *Server) node.Node {
+	return &nodeutil.Basic{
+		OnChild: func(r node.ChildRequest) (node.Node, error) {
+			switch r.Meta.Ident() {
+			case "netconf":
+				return streamsNode(s.Streams()), nil
+			}
+			return nil, nil
+		},
+	}
+}
+
+func streamsNode(streams []StreamInfo) node.Node {
+	entries := make(map[string]*streamEntry, len(streams))
+	for _, info := range streams {
+		e := &streamEntry{
+			Name:          info.Name,
+			Description:   info.Description,
+			ReplaySupport: info.ReplaySupport,
+		}
+		if info.ReplaySupport {
+			e.ReplayLogCreationTime = info.ReplayLogCreationTime.Format(time.RFC3339)
+		}
+		entries[info.Name] = e
+	}
+	type streamsEntry struct {
+		Stream map[string]*streamEntry
+	}
+	return &nodeutil.Node{
+		Object: &struct {
+			Streams *streamsEntry
+		}{&streamsEntry{entries}},
+		OnField: func(n *nodeutil.Node, r node.FieldRequest, hnd *node.ValueHandle) error {
+			if r.Meta.Ident() == "replayLogCreationTime" {
+				if e := n.Object.(*streamEntry); e.ReplayLogCreationTime == "" {
+					return nil
+				}
+			}
+			return n.DoField(r, hnd)
+		},
+	}
+}
@@ -0,0 +1,86 @@
+package netconf
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/freeconf/restconf/estream"
+	"github.com/freeconf/restconf/testdata"
+	"github.com/freeconf/yang/fc"
+	"github.com/freeconf/yang/node"
+	"github.com/freeconf/yang/nodeutil"
+)
+
+func TestStreams(t *testing.T) {
+	d, s := newTestServer(t, testdata.Manage(testdata.New()))
+	err := s.AddStream(estream.Stream{
+		Name: "car:update",
+		Open: func() (*node.Selection, error) {
+			b, err := d.Browser("car")
+			if err != nil {
+				return nil, err
+			}
+			return b.Root().Find("update")
+		},
+	}, "car changes")
+	fc.RequireEqual(t, nil, err)
+
+	t.Run("discovery", func(t *testing.T) {
+		b, err := d.Browser("nc-notifications")
+		fc.RequireEqual(t, nil, err)
+		sel, err := b.Root().Find("netconf/streams/stream=car:update")
+		fc.RequireEqual(t, nil, err)
+		actual, err := nodeutil.WriteJSON(sel)
+		fc.RequireEqual(t, nil, err)
+		fc.AssertEqual(t, `{"name":"car:update","description":"car changes","replaySupport":false}`, actual)
+
+		streams := s.Streams()
+		fc.AssertEqual(t, NetconfStream, streams[0].Name)
+	})
+
+	t.Run("aggregate", func(t *testing.T) {
+		sels, err := netconfStreamEvents(d)
+		fc.RequireEqual(t, nil, err)
+		var paths []string
+		for _, sel := range sels {
+			paths = append(paths, sel.Path.String())
+		}
+		actual := strings.Join(paths, " ")
+		fc.AssertEqual(t, true, strings.Contains(actual, "car/update"), actual)
+		fc.AssertEqual(t, true, strings.Contains(actual, "fc-netconf/auth-event"), actual)
+		fc.AssertEqual(t, true, strings.Contains(actual, "ietf-netconf-notifications/netconf-session-start"), actual)
+		fc.AssertEqual(t, false, strings.Contains(actual, "replayComplete"), actual)
+	})
+}
+
+func TestNamedStreams(t *testing.T) {
+	d, s := newTestServer(t, testdata.Manage(testdata.New()), WithNamedStreams(NamedStreams{
+		Predefined: map[string]string{"logins": "fc-netconf:auth-event"},
+	}))
+	err := s.AddNamedStreams(NamedStreams{Predefined: map[string]string{"bad": "car"}})
+	fc.AssertEqual(t, "named stream bad. 'car' is not in form module:notification", err.Error())
+	var names []string
+	for _, stream := range s.Streams() {
+		names = append(names, stream.Name)
+	}
+	actual := strings.Join(names, " ")
+	fc.AssertEqual(t, true, strings.Contains(actual, "logins"), actual)
+
+	subscribe := func(stream string) (string, *testConn) {
+		c := newTestConn(t, s, d)
+		c.start()
+		t.Cleanup(func() { c.kill() })
+		return c.call(1, `<create-subscription xmlns="urn:ietf:params:xml:ns:netconf:notification:1.0"><stream>`+stream+`</stream></create-subscription>`), c
+	}
+	reply, c := subscribe("logins")
+	fc.AssertEqual(t, true, strings.Contains(reply, "<ok"), reply)
+	s.AuthGuard().Failed("bob", "1.2.3.4:1000", "password")
+	notification := c.recv()
+	fc.AssertEqual(t, true, strings.Contains(notification, ">bob</user>"), notification)
+
+	// notifications do not have to be registered as streams
+	reply, _ = subscribe("car:update")
+	fc.AssertEqual(t, true, strings.Contains(reply, "<ok"), reply)
+	reply, _ = subscribe("car:bogus")
+	fc.AssertEqual(t, true, strings.Contains(reply, "<rpc-error"), reply)
+}
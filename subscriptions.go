@@ -0,0 +1,719 @@
+package netconf
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/freeconf/restconf/device"
+	"github.com/freeconf/yang/fc"
+	"github.com/freeconf/yang/node"
+	"github.com/freeconf/yang/nodeutil"
+	"github.com/freeconf/yang/patch/xml"
+)
+
+// Dynamic subscriptions over NETCONF
+//
+//	https://datatracker.ietf.org/doc/html/rfc8639
+//	https://datatracker.ietf.org/doc/html/rfc8640
+const SubscribedNotificationsNs = "urn:ietf:params:xml:ns:yang:ietf-subscribed-notifications"
+
+// Subscription is a dynamic subscription from establish-subscription or a
+// configured subscription.  Dynamic subscriptions belong to the session that
+// established them and end with that session.
+type Subscription struct {
+	Id uint32
+
+	// Session is nil for configured subscriptions
+	Session *Session
+	Stream  string
+
+	// yang-push subscriptions are to a datastore instead of a stream
+	Datastore string
+
+	ctx context.Context
+	dev device.Device
+	mgr SessionManager
+	to  receiver
+
+	mu        sync.Mutex
+	filter    *eventFilter
+	selection *RpcFilter
+	filterXml string
+	stopTime  time.Time
+	period    time.Duration
+	anchor    time.Time
+
+	onChange    bool
+	dampening   time.Duration
+	syncOnStart bool
+	excluded    []string
+	ready       bool
+	held        []*Notification
+	suspended   bool
+	ended       bool
+	stop        func()
+
+	// forget tells session subscription no longer keeps it alive, nil for
+	// configured subscriptions
+	forget func()
+}
+
+// receiver is where notifications of a subscription are sent
+type receiver interface {
+	// notify drops notification with errNotificationDropped when receiver
+	// is not keeping up
+	notify(n *Notification) error
+
+	// notifyWait waits for room to send notification
+	notifyWait(n *Notification) error
+}
+
+// Subscriptions are the dynamic subscriptions of every session and the
+// configured subscriptions
+type Subscriptions struct {
+	mu      sync.Mutex
+	last    uint32
+	subs    map[uint32]*Subscription
+	changes configChanges
+}
+
+func NewSubscriptions() *Subscriptions {
+	return &Subscriptions{subs: make(map[uint32]*Subscription)}
+}
+
+func (s *Subscriptions) add(sub *Subscription) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// skip ids of configured subscriptions
+	for {
+		s.last++
+		if _, taken := s.subs[s.last]; !taken {
+			break
+		}
+	}
+	sub.Id = s.last
+	s.subs[sub.Id] = sub
+}
+
+// addConfigured registers subscription under id it was configured with
+func (s *Subscriptions) addConfigured(sub *Subscription) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, taken := s.subs[sub.Id]; taken {
+		return fmt.Errorf("subscription id %d already in use", sub.Id)
+	}
+	s.subs[sub.Id] = sub
+	return nil
+}
+
+func (s *Subscriptions) remove(id uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.subs, id)
+}
+
+// Find subscription by id or nil if not found
+func (s *Subscriptions) Find(id uint32) *Subscription {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.subs[id]
+}
+
+// List is all subscriptions sorted by id
+func (s *Subscriptions) List() []*Subscription {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	subs := make([]*Subscription, 0, len(s.subs))
+	for _, sub := range s.subs {
+		subs = append(subs, sub)
+	}
+	sort.Slice(subs, func(i, j int) bool {
+		return subs[i].Id < subs[j].Id
+	})
+	return subs
+}
+
+// subscriptionError is an rpc-error with the RFC 8639 identity of the reason
+// in error-app-tag
+func subscriptionError(reason string, msg string) *RpcError {
+	err := NewRpcError("application", "invalid-value", msg)
+	err.AppTag = "ietf-subscribed-notifications:" + reason
+	return err
+}
+
+// subscriptionParams are the input of establish, modify, delete and kill
+// subscription.
+type subscriptionParams struct {
+	id          uint32
+	stream      string
+	datastore   string
+	filter      *RpcFilter
+	filterXml   string
+	replayStart *time.Time
+	stopTime    *time.Time
+	periodic    bool
+	period      time.Duration
+	anchor      *time.Time
+	onChange    bool
+	dampening   time.Duration
+	syncOnStart bool
+	excluded    []string
+}
+
+func readSubscriptionParams(op *nodeutil.XmlNode) (*subscriptionParams, error) {
+	p := &subscriptionParams{}
+	for _, n := range op.Nodes {
+		content := strings.TrimSpace(string(n.Content))
+		switch n.XMLName.Local {
+		case "id":
+			id, err := strconv.ParseUint(content, 10, 32)
+			if err != nil {
+				return nil, NewRpcError("protocol", "invalid-value", fmt.Sprintf("bad id '%s'", content))
+			}
+			p.id = uint32(id)
+		case "stream":
+			p.stream = content
+		case "datastore":
+			p.datastore = identityName(content)
+		case "stream-xpath-filter", "datastore-xpath-filter":
+			p.filter = xpathFilterParam(op, n)
+			p.filterXml = nsTextElem(n.XMLName, content)
+		case "stream-subtree-filter", "datastore-subtree-filter":
+			f, data, err := subtreeFilterParam(n)
+			if err != nil {
+				return nil, err
+			}
+			p.filter = f
+			p.filterXml = string(data)
+		case "periodic":
+			if err := readPeriodic(n, p); err != nil {
+				return nil, err
+			}
+		case "on-change":
+			if err := readOnChange(n, p); err != nil {
+				return nil, err
+			}
+		case "stream-filter-name":
+			return nil, subscriptionError("filter-unavailable", fmt.Sprintf("no filter named '%s'", content))
+		case "replay-start-time", "stop-time":
+			t, err := time.Parse(time.RFC3339, content)
+			if err != nil {
+				return nil, NewRpcError("protocol", "invalid-value", fmt.Sprintf("bad %s '%s'", n.XMLName.Local, content))
+			}
+			if n.XMLName.Local == "stop-time" {
+				p.stopTime = &t
+			} else {
+				p.replayStart = &t
+			}
+		case "encoding":
+			if identityName(content) != "encode-xml" {
+				return nil, subscriptionError("encoding-unsupported", fmt.Sprintf("encoding '%s' not supported", content))
+			}
+		case "dscp":
+			return nil, subscriptionError("dscp-unavailable", "dscp marking not supported")
+		}
+	}
+	return p, nil
+}
+
+// xpathFilterParam is filter from a leaf holding an xpath in operation op
+func xpathFilterParam(op *nodeutil.XmlNode, n *nodeutil.XmlNode) *RpcFilter {
+	f := &RpcFilter{Type: "xpath", Select: strings.TrimSpace(string(n.Content)), shortcodes: make(map[string]string)}
+	// prefixes can be declared on any enclosing element
+	for _, attrs := range [][]xml.Attr{op.Attr, n.Attr} {
+		for _, a := range attrs {
+			if a.Name.Space == "xmlns" {
+				f.shortcodes[a.Name.Local] = a.Value
+			}
+		}
+	}
+	return f
+}
+
+// subtreeFilterParam is filter from an anydata holding a subtree filter
+// along with the filter as it can be written again
+func subtreeFilterParam(n *nodeutil.XmlNode) (*RpcFilter, []byte, error) {
+	dropNsDecls(n)
+	data, err := xml.Marshal(n)
+	if err != nil {
+		return nil, nil, err
+	}
+	f := &RpcFilter{}
+	if err := xml.Unmarshal(data, f); err != nil {
+		return nil, nil, err
+	}
+	return f, data, nil
+}
+
+// dropNsDecls removes namespace declarations from decoded elements so they
+// can be written again.  Element names already have their namespace.
+func dropNsDecls(n *nodeutil.XmlNode) {
+	var attrs []xml.Attr
+	for _, a := range n.Attr {
+		if a.Name.Space != "xmlns" && !(a.Name.Space == "" && a.Name.Local == "xmlns") {
+			attrs = append(attrs, a)
+		}
+	}
+	n.Attr = attrs
+	for _, child := range n.Nodes {
+		dropNsDecls(child)
+	}
+}
+
+// identityName drops the prefix of an identityref value
+func identityName(value string) string {
+	if _, name, found := strings.Cut(value, ":"); found {
+		return name
+	}
+	return value
+}
+
+func textElem(name string, value string) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "<%s>", name)
+	xml.EscapeText(&buf, []byte(value))
+	fmt.Fprintf(&buf, "</%s>", name)
+	return buf.String()
+}
+
+// nsTextElem is textElem for an element that may not be in the namespace of
+// the enclosing element
+func nsTextElem(name xml.Name, value string) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<%s xmlns="%s">`, name.Local, name.Space)
+	xml.EscapeText(&buf, []byte(value))
+	fmt.Fprintf(&buf, "</%s>", name.Local)
+	return buf.String()
+}
+
+func reasonElem(reason string) string {
+	return fmt.Sprintf(`<reason xmlns:sn="%s">sn:%s</reason>`, SubscribedNotificationsNs, reason)
+}
+
+// stateChange is a notification about the subscription itself
+//
+//	https://datatracker.ietf.org/doc/html/rfc8639#section-2.7
+func (sub *Subscription) stateChange(name string, elems ...string) *Notification {
+	content := textElem("id", strconv.FormatUint(uint64(sub.Id), 10)) + strings.Join(elems, "")
+	return &Notification{
+		EventTime: time.Now(),
+		Elems: []*nodeutil.XMLWtr2{
+			{XMLName: xml.Name{Space: SubscribedNotificationsNs, Local: name}, Content: content},
+		},
+	}
+}
+
+// settings are the elements of subscription-started and
+// subscription-modified
+func (sub *Subscription) settings() []string {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	var elems []string
+	if sub.Datastore != "" {
+		elems = append(elems, fmt.Sprintf(`<datastore xmlns="%s" xmlns:ds="%s">ds:%s</datastore>`, YangPushNs, DatastoresNs, sub.Datastore))
+	} else {
+		elems = append(elems, textElem("stream", sub.Stream))
+	}
+	if sub.filterXml != "" {
+		elems = append(elems, sub.filterXml)
+	}
+	if !sub.stopTime.IsZero() {
+		elems = append(elems, textElem("stop-time", sub.stopTime.Format(time.RFC3339Nano)))
+	}
+	if sub.period > 0 {
+		elems = append(elems, periodicElem(sub.period, sub.anchor))
+	}
+	if sub.onChange {
+		elems = append(elems, onChangeElem(sub.dampening, sub.syncOnStart))
+	}
+	return elems
+}
+
+// deliver sends event unless subscription is suspended.  Events are held
+// until subscription-started is sent.
+func (sub *Subscription) deliver(n *Notification) error {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if sub.ended || sub.suspended {
+		return nil
+	}
+	if !sub.ready {
+		sub.held = append(sub.held, n)
+		return nil
+	}
+	err := sub.to.notify(n)
+	if err == errNotificationDropped {
+		sub.suspended = true
+		go sub.suspend()
+	}
+	return err
+}
+
+// suspend the subscription until client catches up on reading
+func (sub *Subscription) suspend() {
+	fc.Info.Printf("suspending subscription %d", sub.Id)
+	if err := sub.to.notifyWait(sub.stateChange("subscription-suspended", reasonElem("insufficient-resources"))); err != nil {
+		return
+	}
+	if err := sub.to.notifyWait(sub.stateChange("subscription-resumed")); err != nil {
+		return
+	}
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	sub.suspended = false
+}
+
+// announce sends subscription-started or subscription-modified and then any
+// events that happened while waiting for rpc reply
+func (sub *Subscription) announce(name string) {
+	if err := sub.to.notifyWait(sub.stateChange(name, sub.settings()...)); err != nil {
+		fc.Debug.Printf("could not send %s for subscription %d. %s", name, sub.Id, err)
+	}
+	sub.mu.Lock()
+	held := sub.held
+	sub.held = nil
+	sub.ready = true
+	sub.mu.Unlock()
+	for _, n := range held {
+		sub.deliver(n)
+	}
+}
+
+// startLive sends events from stream as they happen
+func (sub *Subscription) startLive() error {
+	unsubscribe, err := subscribeStream(sub.mgr, sub.dev, sub.Stream, func(event *node.Selection, eventTime time.Time) error {
+		sub.mu.Lock()
+		filter := sub.filter
+		sub.mu.Unlock()
+		event, err := filter.apply(event)
+		if err != nil || event == nil {
+			return err
+		}
+		payload, err := encodeEvent(event)
+		if err != nil {
+			return err
+		}
+		return sub.deliver(&Notification{EventTime: eventTime, Elems: []*nodeutil.XMLWtr2{payload}})
+	})
+	if err != nil {
+		return err
+	}
+	sub.setStop(unsubscribe)
+	return nil
+}
+
+// start sending events or datastore updates
+func (sub *Subscription) start() error {
+	if sub.Datastore != "" {
+		if sub.onChange {
+			return sub.startOnChange()
+		}
+		return sub.startPeriodic()
+	}
+	return sub.startLive()
+}
+
+// setStop sets how sending is stopped and ends subscription at stop time
+func (sub *Subscription) setStop(closer func()) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	var timer *time.Timer
+	if !sub.stopTime.IsZero() {
+		timer = time.AfterFunc(time.Until(sub.stopTime), sub.complete)
+	}
+	sub.stop = func() {
+		if timer != nil {
+			timer.Stop()
+		}
+		closer()
+	}
+}
+
+// startReplay sends events since start and then events as they happen
+func (sub *Subscription) startReplay(log *ReplayLog, start time.Time) error {
+	ses := sub.Session
+	r := &replaySub{
+		ses:      ses,
+		filter:   sub.filter,
+		stopTime: sub.stopTime,
+		notify:   sub.deliver,
+		replayComplete: func() *Notification {
+			return sub.stateChange("replay-completed")
+		},
+		complete: func() *Notification {
+			return sub.stateChange("subscription-completed")
+		},
+		onEnd: func() {
+			sub.mu.Lock()
+			sub.ended = true
+			sub.mu.Unlock()
+			ses.mgr.Subscriptions().remove(sub.Id)
+			if sub.forget != nil {
+				sub.forget()
+			}
+		},
+	}
+	if err := r.start(log, start); err != nil {
+		return err
+	}
+	// replay has it's own stop time
+	sub.mu.Lock()
+	sub.stop = r.close
+	sub.mu.Unlock()
+	return nil
+}
+
+// complete is when stop time is reached
+func (sub *Subscription) complete() {
+	if sub.end() {
+		if err := sub.to.notifyWait(sub.stateChange("subscription-completed")); err != nil {
+			fc.Debug.Printf("could not send subscription-completed for subscription %d. %s", sub.Id, err)
+		}
+	}
+}
+
+// end stops sending events and removes subscription.  Returns false if
+// already ended.
+func (sub *Subscription) end() bool {
+	sub.mu.Lock()
+	if sub.ended {
+		sub.mu.Unlock()
+		return false
+	}
+	sub.ended = true
+	stop := sub.stop
+	sub.mu.Unlock()
+	stop()
+	sub.mgr.Subscriptions().remove(sub.Id)
+	if sub.forget != nil {
+		sub.forget()
+	}
+	return true
+}
+
+func establishSubscription(ctx context.Context, req *RpcRequest, reply *RpcReply) error {
+	ses := req.Session
+	p, err := readSubscriptionParams(req.Op)
+	if err != nil {
+		return err
+	}
+	sub := &Subscription{
+		Session:   ses,
+		Stream:    p.stream,
+		Datastore: p.datastore,
+		ctx:       ses.Context(),
+		dev:       ses.dev,
+		mgr:       ses.mgr,
+		to:        ses,
+		filterXml: p.filterXml,
+	}
+	switch {
+	case p.stream != "" && p.datastore != "":
+		return NewRpcError("protocol", "invalid-value", "stream and datastore cannot both be given")
+	case p.datastore != "":
+		if err := checkPush(ses.dev, p, false); err != nil {
+			return err
+		}
+		sub.selection = p.filter
+		sub.period = p.period
+		if p.anchor != nil {
+			sub.anchor = *p.anchor
+		}
+		sub.onChange = p.onChange
+		sub.dampening = p.dampening
+		sub.syncOnStart = p.syncOnStart
+		sub.excluded = p.excluded
+	case p.stream != "":
+		if sub.filter, err = compileEventFilter(ses.dev, p.filter); err != nil {
+			return filterError(err)
+		}
+	default:
+		return NewRpcError("protocol", "missing-element", "stream or datastore required")
+	}
+	now := time.Now()
+	if p.stopTime != nil {
+		if p.replayStart == nil && !p.stopTime.After(now) {
+			return NewRpcError("protocol", "invalid-value", "stop-time is in the past")
+		}
+		sub.stopTime = *p.stopTime
+	}
+	subs := ses.mgr.Subscriptions()
+	subs.add(sub)
+	sub.forget = ses.addSub(func() {
+		sub.end()
+	})
+	var revised *time.Time
+	if p.replayStart != nil {
+		log := ses.mgr.ReplayLog(p.stream)
+		if log == nil {
+			sub.forget()
+			subs.remove(sub.Id)
+			return subscriptionError("replay-unsupported", fmt.Sprintf("stream %s does not support replay", p.stream))
+		}
+		start := *p.replayStart
+		if start.After(now) {
+			sub.forget()
+			subs.remove(sub.Id)
+			return NewRpcError("protocol", "invalid-value", "replay-start-time is in the future")
+		}
+		// RFC 8639 Sec. 2.4.2.1 - start at earliest event kept
+		if logStart := log.Start(); start.Before(logStart) {
+			start = logStart
+			revised = &start
+		}
+		// subscription-started has to be sent before replay
+		ses.afterReply = append(ses.afterReply, func() {
+			sub.announce("subscription-started")
+		})
+		err = sub.startReplay(log, start)
+	} else {
+		err = sub.start()
+		ses.afterReply = append(ses.afterReply, func() {
+			sub.announce("subscription-started")
+		})
+	}
+	if err != nil {
+		sub.forget()
+		subs.remove(sub.Id)
+		return subscriptionError("stream-unavailable", err.Error())
+	}
+	reply.Out = []*nodeutil.XMLWtr2{
+		{XMLName: xml.Name{Space: SubscribedNotificationsNs, Local: "id"}, Content: strconv.FormatUint(uint64(sub.Id), 10)},
+	}
+	if revised != nil {
+		reply.Out = append(reply.Out, &nodeutil.XMLWtr2{
+			XMLName: xml.Name{Space: SubscribedNotificationsNs, Local: "replay-start-time-revision"},
+			Content: revised.Format(time.RFC3339Nano),
+		})
+	}
+	return nil
+}
+
+func filterError(err error) error {
+	if rpcErr, valid := err.(*RpcError); valid {
+		rpcErr.AppTag = "ietf-subscribed-notifications:filter-unsupported"
+	}
+	return err
+}
+
+// ownSubscription finds subscription of the session in params
+func ownSubscription(ses *Session, p *subscriptionParams) (*Subscription, error) {
+	sub := ses.mgr.Subscriptions().Find(p.id)
+	if sub == nil || sub.Session != ses {
+		return nil, subscriptionError("no-such-subscription", fmt.Sprintf("subscription %d not found", p.id))
+	}
+	return sub, nil
+}
+
+// modifySubscription changes filter, stop time or period.  Replay, if still
+// being sent, is ended and subscription continues with events as they happen.
+func modifySubscription(ctx context.Context, req *RpcRequest, reply *RpcReply) error {
+	ses := req.Session
+	p, err := readSubscriptionParams(req.Op)
+	if err != nil {
+		return err
+	}
+	sub, err := ownSubscription(ses, p)
+	if err != nil {
+		return err
+	}
+	var filter *eventFilter
+	if sub.Datastore != "" {
+		if err := checkPush(ses.dev, p, true); err != nil {
+			return err
+		}
+	} else if p.filter != nil {
+		if filter, err = compileEventFilter(ses.dev, p.filter); err != nil {
+			return filterError(err)
+		}
+	}
+	if p.stopTime != nil && !p.stopTime.After(time.Now()) {
+		return NewRpcError("protocol", "invalid-value", "stop-time is in the past")
+	}
+	sub.mu.Lock()
+	stop := sub.stop
+	if p.filter != nil {
+		if sub.Datastore != "" {
+			sub.selection = p.filter
+		} else {
+			sub.filter = filter
+		}
+		sub.filterXml = p.filterXml
+	}
+	if p.stopTime != nil {
+		sub.stopTime = *p.stopTime
+	}
+	if p.periodic && sub.period > 0 {
+		sub.period = p.period
+		if p.anchor != nil {
+			sub.anchor = *p.anchor
+		}
+	}
+	if p.onChange && sub.onChange {
+		sub.dampening = p.dampening
+		// changes since last update are sent, not everything again
+		sub.syncOnStart = false
+	}
+	sub.ready = false
+	sub.mu.Unlock()
+	stop()
+	if err := sub.start(); err != nil {
+		sub.end()
+		return subscriptionError("stream-unavailable", err.Error())
+	}
+	ses.afterReply = append(ses.afterReply, func() {
+		sub.announce("subscription-modified")
+	})
+	reply.OK = &Msg{}
+	return nil
+}
+
+func deleteSubscription(ctx context.Context, req *RpcRequest, reply *RpcReply) error {
+	p, err := readSubscriptionParams(req.Op)
+	if err != nil {
+		return err
+	}
+	sub, err := ownSubscription(req.Session, p)
+	if err != nil {
+		return err
+	}
+	sub.end()
+	reply.OK = &Msg{}
+	return nil
+}
+
+// killSubscription ends any session's subscription and tells the session
+// it was terminated
+func killSubscription(ctx context.Context, req *RpcRequest, reply *RpcReply) error {
+	ses := req.Session
+	p, err := readSubscriptionParams(req.Op)
+	if err != nil {
+		return err
+	}
+	sub := ses.mgr.Subscriptions().Find(p.id)
+	// configured subscriptions are only ended thru configuration
+	if sub == nil || sub.Session == nil {
+		return subscriptionError("no-such-subscription", fmt.Sprintf("subscription %d not found", p.id))
+	}
+	if sub.end() {
+		terminated := func() {
+			n := sub.stateChange("subscription-terminated", reasonElem("no-such-subscription"))
+			if err := sub.to.notifyWait(n); err != nil {
+				fc.Debug.Printf("could not send subscription-terminated ses=%d. %s", sub.Session.Id, err)
+			}
+		}
+		if sub.Session == ses {
+			ses.afterReply = append(ses.afterReply, terminated)
+		} else {
+			go terminated()
+		}
+	}
+	reply.OK = &Msg{}
+	return nil
+}
@@ -0,0 +1,113 @@
+package netconf
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/freeconf/yang/fc"
+)
+
+func TestDynamicSubscriptions(t *testing.T) {
+	d, s := newTestServer(t, nil)
+	fc.RequireEqual(t, nil, s.EnableReplay(NetconfStream, ReplayOptions{}))
+	defer s.closeReplayLogs()
+	s.PublishEvent(NetconfEvent{Type: EventSessionStart, Username: "joe", SessionId: 100})
+
+	c := newTestConn(t, s, d)
+	subId := regexp.MustCompile(`<id[^>]*>(\d+)</id>`)
+	c.start()
+
+	// errors
+	c.send(1, `<establish-subscription xmlns="urn:ietf:params:xml:ns:yang:ietf-subscribed-notifications"><stream>bogus</stream></establish-subscription>`)
+	c.expect("ietf-subscribed-notifications:stream-unavailable")
+	c.send(2, `<delete-subscription xmlns="urn:ietf:params:xml:ns:yang:ietf-subscribed-notifications"><id>99</id></delete-subscription>`)
+	c.expect("ietf-subscribed-notifications:no-such-subscription")
+	c.send(3, `<establish-subscription xmlns="urn:ietf:params:xml:ns:yang:ietf-subscribed-notifications"><stream>NETCONF</stream><dscp>10</dscp></establish-subscription>`)
+	c.expect("ietf-subscribed-notifications:dscp-unavailable")
+	fc.AssertEqual(t, false, c.ses.hasSubs())
+
+	// live w/filter
+	c.send(4, `<establish-subscription xmlns="urn:ietf:params:xml:ns:yang:ietf-subscribed-notifications" xmlns:ncn="urn:ietf:params:xml:ns:yang:ietf-netconf-notifications"><stream>NETCONF</stream><stream-xpath-filter>ncn:netconf-session-start/ncn:username='bob'</stream-xpath-filter></establish-subscription>`)
+	reply := c.expect("<rpc-reply")
+	match := subId.FindStringSubmatch(reply)
+	fc.RequireEqual(t, 2, len(match), reply)
+	id := match[1]
+	c.expect("subscription-started", "<stream>NETCONF</stream>", "stream-xpath-filter")
+	s.PublishEvent(NetconfEvent{Type: EventSessionStart, Username: "joe", SessionId: 101})
+	s.PublishEvent(NetconfEvent{Type: EventSessionStart, Username: "bob", SessionId: 102})
+	c.expect(">bob</username>")
+
+	c.send(5, fmt.Sprintf(`<modify-subscription xmlns="urn:ietf:params:xml:ns:yang:ietf-subscribed-notifications" xmlns:ncn="urn:ietf:params:xml:ns:yang:ietf-netconf-notifications"><id>%s</id><stream-xpath-filter>ncn:netconf-session-start/ncn:username='joe'</stream-xpath-filter></modify-subscription>`, id))
+	c.expect("<ok")
+	c.expect("subscription-modified", "username=&#39;joe&#39;")
+	s.PublishEvent(NetconfEvent{Type: EventSessionStart, Username: "bob", SessionId: 103})
+	s.PublishEvent(NetconfEvent{Type: EventSessionStart, Username: "joe", SessionId: 104})
+	c.expect(">joe</username>", ">104</session-id>")
+
+	c.send(6, fmt.Sprintf(`<delete-subscription xmlns="urn:ietf:params:xml:ns:yang:ietf-subscribed-notifications"><id>%s</id></delete-subscription>`, id))
+	c.expect("<ok")
+	fc.AssertEqual(t, 0, len(s.Subscriptions().List()))
+	// no longer keeps session from idle timeout
+	fc.AssertEqual(t, false, c.ses.hasSubs())
+
+	// replay from before log started is revised to log start
+	c.send(7, fmt.Sprintf(`<establish-subscription xmlns="urn:ietf:params:xml:ns:yang:ietf-subscribed-notifications"><stream>NETCONF</stream><replay-start-time>%s</replay-start-time></establish-subscription>`,
+		time.Now().Add(-time.Hour).Format(time.RFC3339)))
+	reply = c.expect("replay-start-time-revision")
+	id = subId.FindStringSubmatch(reply)[1]
+	c.expect("subscription-started")
+	c.expect(">100</session-id>")
+	for {
+		if strings.Contains(c.expect("notification"), "replay-completed") {
+			break
+		}
+	}
+
+	// kill by any session, owner is told
+	c.send(8, fmt.Sprintf(`<kill-subscription xmlns="urn:ietf:params:xml:ns:yang:ietf-subscribed-notifications"><id>%s</id></kill-subscription>`, id))
+	c.expect("<ok")
+	c.expect("subscription-terminated", "sn:no-such-subscription")
+	fc.AssertEqual(t, 0, len(s.Subscriptions().List()))
+	fc.AssertEqual(t, false, c.ses.hasSubs())
+
+	// ends with session
+	c.send(9, `<establish-subscription xmlns="urn:ietf:params:xml:ns:yang:ietf-subscribed-notifications"><stream>NETCONF</stream></establish-subscription>`)
+	c.expect("<id")
+	c.expect("subscription-started")
+	fc.AssertEqual(t, 1, len(s.Subscriptions().List()))
+	fc.AssertEqual(t, true, c.ses.hasSubs())
+	c.kill()
+	fc.AssertEqual(t, 0, len(s.Subscriptions().List()))
+}
+
+func TestModifyDuringReplay(t *testing.T) {
+	d, s := newTestServer(t, nil)
+	fc.RequireEqual(t, nil, s.EnableReplay(NetconfStream, ReplayOptions{}))
+	defer s.closeReplayLogs()
+	for i := 0; i < 20; i++ {
+		s.PublishEvent(NetconfEvent{Type: EventSessionStart, Username: "joe", SessionId: int64(100 + i)})
+	}
+	c := newTestConn(t, s, d)
+	c.start()
+	reply := c.call(1, fmt.Sprintf(`<establish-subscription xmlns="urn:ietf:params:xml:ns:yang:ietf-subscribed-notifications"><stream>NETCONF</stream><replay-start-time>%s</replay-start-time></establish-subscription>`,
+		time.Now().Add(-time.Hour).Format(time.RFC3339)))
+	id := regexp.MustCompile(`<id[^>]*>(\d+)</id>`).FindStringSubmatch(reply)[1]
+	c.expect("subscription-started")
+	// replay waits on client to read each event
+	c.expect(">100</session-id>")
+
+	c.send(2, fmt.Sprintf(`<modify-subscription xmlns="urn:ietf:params:xml:ns:yang:ietf-subscribed-notifications" xmlns:ncn="urn:ietf:params:xml:ns:yang:ietf-netconf-notifications"><id>%s</id><stream-xpath-filter>ncn:netconf-session-start/ncn:username='bob'</stream-xpath-filter></modify-subscription>`, id))
+	for !strings.Contains(c.recv(), "<rpc-reply") {
+	}
+	c.expect("subscription-modified")
+	// no more replay w/old filter, only live events w/new filter
+	c.expectNone(100 * time.Millisecond)
+	s.PublishEvent(NetconfEvent{Type: EventSessionStart, Username: "joe", SessionId: 200})
+	s.PublishEvent(NetconfEvent{Type: EventSessionStart, Username: "bob", SessionId: 201})
+	c.expect(">bob</username>", ">201</session-id>")
+	fc.AssertEqual(t, true, c.ses.hasSubs())
+	c.kill()
+}
@@ -63,14 +63,15 @@ func compileSubtree(x *Msg, f *subtreeFilter) error {
 }
 
 func compileSubtreeComponents(x *Msg, f *subtreeFilter) error {
-	if len(x.Elems) > 0 || len(x.Attrs) > 0 {
+	attrs := matchAttrs(x.Attrs)
+	if len(x.Elems) > 0 || len(attrs) > 0 {
 		child := &subtreeFilter{}
 		if f.containment == nil {
 			f.containment = make(map[xml.Name]*subtreeFilter)
 		}
 		f.containment[x.XMLName] = child
-		if len(x.Attrs) > 0 {
-			for _, a := range x.Attrs {
+		if len(attrs) > 0 {
+			for _, a := range attrs {
 				child.matching = append(child.matching, contentMatching{
 					field: a.Name,
 					value: a.Value,
@@ -98,6 +99,19 @@ func compileSubtreeComponents(x *Msg, f *subtreeFilter) error {
 	return nil
 }
 
+// matchAttrs are attributes that are attribute match expressions, i.e. not
+// namespace declarations
+func matchAttrs(attrs []xml.Attr) []xml.Attr {
+	var match []xml.Attr
+	for _, a := range attrs {
+		if a.Name.Space == "xmlns" || (a.Name.Space == "" && a.Name.Local == "xmlns") {
+			continue
+		}
+		match = append(match, a)
+	}
+	return match
+}
+
 func (root *subtreeFilter) CheckContainerPreConstraints(r *node.ChildRequest) (bool, error) {
 	f := root.currentFilter(r.Selection)
 	_, selected := f.selected(r.Meta.Ident())
@@ -93,6 +93,18 @@ func TestSubtreeCompile(t *testing.T) {
 				},
 			},
 		},
+		{
+			filter: `<x xmlns="n"><y xmlns="n" xmlns:p="m"/></x>`,
+			expected: &subtreeFilter{
+				containment: map[xml.Name]*subtreeFilter{
+					{Space: "n", Local: "x"}: {
+						selection: []xml.Name{
+							{Space: "n", Local: "y"},
+						},
+					},
+				},
+			},
+		},
 	}
 	for _, test := range tests {
 		var xf Msg